@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Before any RPC is served, a client sends authHeader followed by the
+// hex-encoded token and a newline. The server answers with authOK or
+// authDenied.
+const (
+	authHeader = "gocode-token "
+	authOK     = "ok\n"
+	authDenied = "no\n"
+	tokenLen   = 32
+)
+
+var (
+	errTokenRejected = errors.New("gocode daemon rejected the authentication token")
+	errNoAuth        = errors.New("gocode daemon does not support authentication")
+)
+
+// getTokenPath returns the path of the file holding the secret that
+// clients present to the daemon.
+func getTokenPath() (string, error) {
+	if *g_tokenfile != "" {
+		return *g_tokenfile, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	name := "unix"
+	if *g_sock != "unix" {
+		name = strings.Replace(*g_addr, ":", "_", -1)
+	}
+	return filepath.Join(dir, "gocode", "token."+name), nil
+}
+
+// newToken generates a token and stores it in a file only readable by
+// the current user.
+func newToken() (string, error) {
+	b := make([]byte, tokenLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	path, err := getTokenPath()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	// TempFile creates the file with mode 0600, and renaming it replaces
+	// any older token file regardless of its permissions.
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(token + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return token, nil
+}
+
+func readToken() (string, error) {
+	path, err := getTokenPath()
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// acceptAuthenticated serves RPCs on connections accepted from lis that
+// present the token.
+func acceptAuthenticated(lis net.Listener, token string) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			log.Print("rpc.Serve: accept:", err.Error())
+			return
+		}
+		go func() {
+			if !checkToken(conn, token) {
+				if *g_debug {
+					log.Printf("Rejected connection from %v", conn.RemoteAddr())
+				}
+				conn.Write([]byte(authDenied))
+				conn.Close()
+				return
+			}
+			rpc.ServeConn(conn)
+		}()
+	}
+}
+
+func checkToken(conn net.Conn, token string) bool {
+	want := authHeader + token + "\n"
+	// Read byte by byte, so nothing after the newline is consumed.
+	var got []byte
+	b := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(got) < len(want) && (len(got) == 0 || got[len(got)-1] != '\n') {
+		if _, err := conn.Read(b); err != nil {
+			return false
+		}
+		got = append(got, b[0])
+	}
+	conn.SetReadDeadline(time.Time{})
+	if subtle.ConstantTimeCompare(got, []byte(want)) != 1 {
+		return false
+	}
+	_, err := conn.Write([]byte(authOK))
+	return err == nil
+}
+
+// dialServer connects to the daemon and authenticates with the token.
+func dialServer(network, address string) (*rpc.Client, error) {
+	token, err := readToken()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, authHeader+token+"\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply := make([]byte, len(authOK))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		// Older daemons either drop the connection or wait for the
+		// rest of what they take for an RPC request.
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() || err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errNoAuth
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if string(reply) != authOK {
+		conn.Close()
+		path, _ := getTokenPath()
+		return nil, fmt.Errorf("%w in %s", errTokenRejected, path)
+	}
+	return rpc.NewClient(conn), nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// setTokenFile makes the token file a fresh one for the test.
+func setTokenFile(t *testing.T) string {
+	t.Helper()
+	old := *g_tokenfile
+	t.Cleanup(func() { *g_tokenfile = old })
+	*g_tokenfile = filepath.Join(t.TempDir(), "gocode", "token")
+	return *g_tokenfile
+}
+
+func TestNewToken(t *testing.T) {
+	path := setTokenFile(t)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// An older token file readable by others is replaced.
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	token, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 2*tokenLen {
+		t.Errorf("token %q has %d characters, want %d", token, len(token), 2*tokenLen)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Errorf("token file has mode %v, want 0600", fi.Mode().Perm())
+	}
+	if got, err := readToken(); err != nil || got != token {
+		t.Errorf("readToken() = %q, %v; want %q", got, err, token)
+	}
+	if other, _ := newToken(); other == token {
+		t.Error("newToken returned the same token twice")
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	const token = "0123abcd"
+	var tests = [...]struct {
+		name string
+		sent string // then the client closes the connection unless ok
+		ok   bool
+	}{
+		{"valid", authHeader + token + "\n", true},
+		{"wrong token", authHeader + "0123abce\n", false},
+		{"short token", authHeader + "0123\n", false},
+		{"long token", authHeader + token + "ef\n", false},
+		{"truncated header", authHeader[:4], false},
+		{"truncated token", authHeader + token, false},
+		{"no header", token + "\n", false},
+		{"empty", "", false},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		result, sent := make(chan bool), make(chan struct{})
+		go func() {
+			result <- checkToken(server, token)
+			server.Close()
+		}()
+		go func() {
+			defer close(sent)
+			io.WriteString(client, test.sent)
+			if !test.ok {
+				client.Close()
+				return
+			}
+			reply := make([]byte, len(authOK))
+			if _, err := io.ReadFull(client, reply); err != nil || string(reply) != authOK {
+				t.Errorf("%s: got reply %q, %v; want %q", test.name, reply, err, authOK)
+			}
+		}()
+		if ok := <-result; ok != test.ok {
+			t.Errorf("%s: checkToken = %v, want %v", test.name, ok, test.ok)
+		}
+		<-sent
+		client.Close()
+	}
+}
+
+// authConn sends the authentication header with the first write, in the
+// same write as the first RPC, and consumes the daemon's answer before
+// the first read.
+type authConn struct {
+	net.Conn
+	header []byte
+	answer []byte
+}
+
+func (c *authConn) Write(p []byte) (int, error) {
+	if c.header != nil {
+		buf := append(c.header, p...)
+		c.header = nil
+		n, err := c.Conn.Write(buf)
+		return n - (len(buf) - len(p)), err
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *authConn) Read(p []byte) (int, error) {
+	if c.answer == nil {
+		c.answer = make([]byte, len(authOK))
+		if _, err := io.ReadFull(c.Conn, c.answer); err != nil {
+			return 0, err
+		}
+		if string(c.answer) != authOK {
+			return 0, errTokenRejected
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+type authTestService struct{}
+
+func (authTestService) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+// TestCheckTokenLeavesRPC checks that checkToken consumes nothing after
+// the token, so that an RPC sent right behind it is served.
+func TestCheckTokenLeavesRPC(t *testing.T) {
+	const token = "0123abcd"
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Auth", authTestService{}); err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	go func() {
+		if checkToken(server, token) {
+			srv.ServeConn(server)
+		}
+		server.Close()
+	}()
+	c := rpc.NewClient(&authConn{Conn: client, header: []byte(authHeader + token + "\n")})
+	defer c.Close()
+	var reply string
+	if err := c.Call("Auth.Echo", "hello", &reply); err != nil || reply != "hello" {
+		t.Errorf("Echo(hello) = %q, %v; want hello", reply, err)
+	}
+}
+
+func TestDialServer(t *testing.T) {
+	path := setTokenFile(t)
+	token, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go acceptAuthenticated(lis, token)
+
+	c, err := dialServer("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("dialServer: %v", err)
+	}
+	c.Close()
+
+	// A client with another token is rejected.
+	if err := ioutil.WriteFile(path, []byte(strings.Repeat("0", 2*tokenLen)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := dialServer("tcp", lis.Addr().String()); !errors.Is(err, errTokenRejected) {
+		if c != nil {
+			c.Close()
+		}
+		t.Errorf("dialServer with a wrong token: %v, want %v", err, errTokenRejected)
+	}
+}
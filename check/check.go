@@ -0,0 +1,64 @@
+// Package check type-checks the package of a file being edited, so that
+// completion, lookup and error reporting can share one type-check.
+package check
+
+import (
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+
+	"github.com/mdempsky/gocode/pkgfiles"
+)
+
+// Package is the result of type-checking the package of an edited file.
+type Package struct {
+	Fset        *token.FileSet
+	Filename    string
+	File        *ast.File         // the edited file
+	Pkg         *types.Package    // never nil, but possibly incomplete
+	Info        *types.Info       // records Types, Defs, Uses and Scopes
+	ParseErrors scanner.ErrorList // syntax errors in the edited file
+	TypeErrors  []types.Error     // type errors in all files of the package
+}
+
+// Check parses data as the contents of filename, together with the other
+// files of its package, and type-checks them. Other files are read from
+// overlay if present there, and chosen by the build constraints of ctxt,
+// which defaults to build.Default if nil. If tests is true, test files
+// are included when filename is a test file itself.
+func Check(importer types.Importer, filename string, data []byte, overlay pkgfiles.Overlay, ctxt *build.Context, tests bool) *Package {
+	p := &Package{
+		Fset:     token.NewFileSet(),
+		Filename: filename,
+	}
+	var err error
+	p.File, err = parser.ParseFile(p.Fset, filename, data, parser.AllErrors)
+	if el, ok := err.(scanner.ErrorList); ok {
+		p.ParseErrors = el
+	}
+
+	var otherASTs []*ast.File
+	for _, otherName := range pkgfiles.OtherFiles(filename, p.File.Name.Name, tests, overlay, ctxt) {
+		ast, _ := parser.ParseFile(p.Fset, otherName, overlay.Source(otherName), 0)
+		otherASTs = append(otherASTs, ast)
+	}
+
+	var cfg types.Config
+	cfg.Importer = importer
+	cfg.Error = func(err error) {
+		if e, ok := err.(types.Error); ok {
+			p.TypeErrors = append(p.TypeErrors, e)
+		}
+	}
+	p.Info = &types.Info{
+		Types:  map[ast.Expr]types.TypeAndValue{},
+		Defs:   map[*ast.Ident]types.Object{},
+		Uses:   map[*ast.Ident]types.Object{},
+		Scopes: map[ast.Node]*types.Scope{},
+	}
+	p.Pkg, _ = cfg.Check("", p.Fset, append(otherASTs, p.File), p.Info)
+	return p
+}
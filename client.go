@@ -1,11 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"go/build"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/rpc"
 	"os"
 	"path/filepath"
@@ -14,6 +17,7 @@ import (
 	"time"
 
 	"github.com/mdempsky/gocode/gbimporter"
+	"github.com/mdempsky/gocode/pkgfiles"
 	"github.com/mdempsky/gocode/suggest"
 )
 
@@ -24,24 +28,81 @@ func clientConnect() *rpc.Client {
 	}
 
 	// client
-	client, err := rpc.Dial(*g_sock, addr)
+	client, err := dialServer(*g_sock, addr)
+	if errors.Is(err, errTokenRejected) {
+		log.Fatal(err)
+	}
+	if err == errNoAuth || os.IsNotExist(err) {
+		// Daemons predating authentication have no token and serve
+		// RPCs right away.
+		if client, err := rpc.Dial(*g_sock, addr); err == nil {
+			stopServer(client, addr)
+		}
+	}
+	if err == nil {
+		if err = handshake(client); err == nil {
+			return client
+		}
+		// The daemon runs another binary or protocol; replace it.
+		stopServer(client, addr)
+	}
+
+	// A stale socket is removed by the new server once it holds the
+	// daemon lock; if another daemon holds it, the new server exits.
+	err = tryStartServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err = tryToConnect(*g_sock, addr)
 	if err != nil {
-		if *g_sock == "unix" && fileExists(addr) {
-			os.Remove(addr)
+		if pid := daemonPID(); pid != 0 {
+			log.Fatalf("gocode daemon (pid %d) is not accepting connections on %s: %v", pid, addr, err)
 		}
+		log.Fatal(err)
+	}
+	if err = handshake(client); err != nil {
+		log.Fatal(err)
+	}
+	return client
+}
 
-		err = tryStartServer()
-		if err != nil {
-			log.Fatal(err)
+// handshake checks that the daemon speaks our protocol and runs the same
+// binary as the client.
+func handshake(c *rpc.Client) error {
+	req := HandshakeRequest{Protocol: protocolVersion, Binary: binaryID()}
+	var res HandshakeReply
+	if err := c.Call("Server.Handshake", &req, &res); err != nil {
+		return fmt.Errorf("gocode daemon does not support the handshake (%v); it is older than this client", err)
+	}
+	if res.Protocol != req.Protocol {
+		return fmt.Errorf("gocode daemon (pid %d) speaks protocol %d, this client speaks protocol %d", res.PID, res.Protocol, req.Protocol)
+	}
+	if res.Binary != req.Binary {
+		return fmt.Errorf("gocode daemon (pid %d) runs %s, this client runs %s", res.PID, res.Binary, req.Binary)
+	}
+	return nil
+}
+
+// stopServer asks the daemon to exit and waits until it stops accepting
+// connections and releases the daemon lock.
+func stopServer(c *rpc.Client, addr string) {
+	var req ExitRequest
+	var res ExitReply
+	c.Call("Server.Exit", &req, &res)
+	c.Close()
+	start := time.Now()
+	for time.Since(start) < 5*time.Second {
+		c, err := net.Dial(*g_sock, addr)
+		if err != nil && daemonPID() == 0 {
+			return
 		}
-		client, err = tryToConnect(*g_sock, addr)
-		if err != nil {
-			log.Fatal(err)
+		if err == nil {
+			c.Close()
 		}
-		return client
+		time.Sleep(50 * time.Millisecond)
 	}
-	return client
 }
+
 func doClient() {
 	if flag.NArg() > 0 {
 		switch flag.Arg(0) {
@@ -51,6 +112,20 @@ func doClient() {
 			cmdReportErrors()
 		case "lookup":
 			cmdLookup()
+		case "analyze":
+			cmdAnalyze()
+		case "watch":
+			cmdWatch()
+		case "prime":
+			cmdPrime()
+		case "status":
+			cmdStatus()
+		case "replay":
+			cmdReplay()
+		case "cancel":
+			c := clientConnect()
+			defer c.Close()
+			cmdCancel(c)
 		case "close", "exit":
 			c := clientConnect()
 			defer c.Close()
@@ -63,7 +138,8 @@ func doClient() {
 
 func tryStartServer() error {
 	path := get_executable_filename()
-	args := []string{os.Args[0], "-s", "-sock", *g_sock, "-addr", *g_addr}
+	args := []string{os.Args[0], "-s", "-sock", *g_sock, "-addr", *g_addr, "-idle", g_idle.String(),
+		"-sockperm", *g_sockperm, "-tokenfile", *g_tokenfile, "-exportcache", *g_exportcache}
 	cwd, _ := os.Getwd()
 
 	var err error
@@ -92,8 +168,9 @@ func tryStartServer() error {
 func tryToConnect(network, address string) (*rpc.Client, error) {
 	start := time.Now()
 	for {
-		client, err := rpc.Dial(network, address)
+		client, err := dialServer(network, address)
 		if err != nil && time.Since(start) < time.Second {
+			time.Sleep(10 * time.Millisecond)
 			continue
 		}
 		return client, err
@@ -103,7 +180,10 @@ func tryToConnect(network, address string) (*rpc.Client, error) {
 func cmdAutoComplete() {
 	var req AutoCompleteRequest
 	req.Filename, req.Data, req.Cursor = prepareFilenameDataCursor()
+	req.Overlay = prepareOverlay()
 	req.Filter = *g_filtersuggestions
+	req.Snippets = *g_snippets
+	req.ID, req.Deadline = prepareIDDeadline()
 	req.Context = gbimporter.PackContext(&build.Default)
 
 	var res AutoCompleteReply
@@ -115,9 +195,8 @@ func cmdAutoComplete() {
 		defer c.Close()
 		err = c.Call("Server.AutoComplete", &req, &res)
 	}
-	if err != nil {
-		panic(err)
-	}
+	checkError(err, res.Error)
+	reportCanceled(res.Canceled)
 
 	fmt := suggest.Formatters[*g_format]
 	if fmt == nil {
@@ -129,6 +208,8 @@ func cmdAutoComplete() {
 func cmdReportErrors() {
 	var req ReportErrorsRequest
 	req.Filename, req.Data = prepareFilenameData()
+	req.Overlay = prepareOverlay()
+	req.ID, req.Deadline = prepareIDDeadline()
 	req.Context = gbimporter.PackContext(&build.Default)
 
 	var res ReportErrorsReply
@@ -140,9 +221,8 @@ func cmdReportErrors() {
 		defer c.Close()
 		err = c.Call("Server.ReportErrors", &req, &res)
 	}
-	if err != nil {
-		panic(err)
-	}
+	checkError(err, res.Error)
+	reportCanceled(res.Canceled)
 	for _, e := range res.Errors {
 		fmt.Printf("Error: %d %d %s\n", e.Line, e.Col, e.Msg)
 	}
@@ -151,6 +231,8 @@ func cmdReportErrors() {
 func cmdLookup() {
 	var req LookupRequest
 	req.Filename, req.Data, req.Cursor = prepareFilenameDataCursor()
+	req.Overlay = prepareOverlay()
+	req.ID, req.Deadline = prepareIDDeadline()
 	req.Context = gbimporter.PackContext(&build.Default)
 
 	var res LookupReply
@@ -162,9 +244,8 @@ func cmdLookup() {
 		defer c.Close()
 		err = c.Call("Server.Lookup", &req, &res)
 	}
-	if err != nil {
-		panic(err)
-	}
+	checkError(err, res.Error)
+	reportCanceled(res.Canceled)
 	// Print out information about identifier at the cursor and the call if
 	// the cursor is within call parenthesis. One or both may be invalid.
 	// Ex:
@@ -192,11 +273,278 @@ func cmdLookup() {
 	print("call", res.Call)
 }
 
+func cmdAnalyze() {
+	var req AnalyzeRequest
+	req.Filename, req.Data, req.Cursor = prepareFilenameDataCursor()
+	req.Overlay = prepareOverlay()
+	req.Filter = *g_filtersuggestions
+	req.Snippets = *g_snippets
+	req.ID, req.Deadline = prepareIDDeadline()
+	req.Context = gbimporter.PackContext(&build.Default)
+	for _, f := range strings.Split(*g_features, ",") {
+		switch strings.TrimSpace(f) {
+		case "complete":
+			req.Complete = true
+		case "lookup":
+			req.Lookup = true
+		case "errors":
+			req.Errors = true
+		case "":
+		default:
+			fmt.Fprintf(os.Stderr, "gocode: unknown feature %q in -features\n", f)
+			os.Exit(2)
+		}
+	}
+
+	var res AnalyzeReply
+	var err error
+	if *g_oneshot {
+		err = Analyze(&req, &res)
+	} else {
+		c := clientConnect()
+		defer c.Close()
+		err = c.Call("Server.Analyze", &req, &res)
+	}
+	checkError(err, res.Error)
+	reportCanceled(res.Canceled)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	enc.Encode(&res)
+}
+
+// cmdWatch prints the errors in the given files, and again whenever they
+// change because packages the files import changed on disk.
+func cmdWatch() {
+	if flag.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "gocode: watch needs at least one file\n")
+		os.Exit(2)
+	}
+	var c *rpc.Client
+	if !*g_oneshot {
+		c = clientConnect()
+		defer c.Close()
+	}
+	subscribe := func(req *SubscribeRequest, res *SubscribeReply) error {
+		if c == nil {
+			return Subscribe(req, res)
+		}
+		return c.Call("Server.Subscribe", req, res)
+	}
+	diagnostics := func(req *DiagnosticsRequest, res *DiagnosticsReply) error {
+		if c == nil {
+			return Diagnostics(req, res)
+		}
+		return c.Call("Server.Diagnostics", req, res)
+	}
+
+	var id string
+	overlay := prepareOverlay()
+	for _, name := range flag.Args()[1:] {
+		var req SubscribeRequest
+		req.Subscriber = id
+		req.Filename, _ = filepath.Abs(name)
+		req.Overlay = overlay
+		req.Context = gbimporter.PackContext(&build.Default)
+		var res SubscribeReply
+		err := subscribe(&req, &res)
+		checkError(err, res.Error)
+		id = res.Subscriber
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		req := DiagnosticsRequest{Subscriber: id, Timeout: time.Minute}
+		var res DiagnosticsReply
+		err := diagnostics(&req, &res)
+		checkError(err, res.Error)
+		for _, d := range res.Updates {
+			if *g_format == "json" {
+				enc.Encode(&d)
+				continue
+			}
+			if len(d.Errors) == 0 {
+				fmt.Printf("%s: no errors\n", d.Filename)
+			}
+			for _, e := range d.Errors {
+				fmt.Printf("%s:%d:%d: %s\n", d.Filename, e.Line, e.Col, e.Msg)
+			}
+		}
+	}
+}
+
+func cmdCancel(c *rpc.Client) {
+	if flag.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "gocode: cancel requires a request ID\n")
+		os.Exit(2)
+	}
+	req := CancelRequest{ID: flag.Arg(1)}
+	var res CancelReply
+	err := c.Call("Server.Cancel", &req, &res)
+	checkError(err, nil)
+	if !res.Canceled {
+		fmt.Printf("No running request with ID %q.\n", req.ID)
+	}
+}
+
+func cmdStatus() {
+	var req StatusRequest
+	var res StatusReply
+	var err error
+	if *g_oneshot {
+		err = Status(&req, &res)
+	} else {
+		c := clientConnect()
+		defer c.Close()
+		err = c.Call("Server.Status", &req, &res)
+	}
+	checkError(err, nil)
+
+	if *g_format == "json" {
+		json.NewEncoder(os.Stdout).Encode(&res)
+		return
+	}
+	fmt.Printf("pid:        %d\n", res.PID)
+	fmt.Printf("uptime:     %v\n", res.Uptime.Round(time.Second))
+	fmt.Printf("executable: %s\n", res.Executable)
+	fmt.Printf("version:    %s (%s)\n", res.Version, res.GoVersion)
+	if ctx := res.Context; ctx != nil {
+		fmt.Printf("context:    GOOS=%s GOARCH=%s GOROOT=%s GOPATH=%s\n", ctx.GOOS, ctx.GOARCH, ctx.GOROOT, ctx.GOPATH)
+		fmt.Printf("            compiler=%s cgo=%v tags=%v\n", ctx.Compiler, ctx.CgoEnabled, ctx.BuildTags)
+		var env []string
+		for _, v := range [][2]string{{"GO111MODULE", ctx.GO111MODULE}, {"GOMODCACHE", ctx.GOMODCACHE}, {"GOWORK", ctx.GOWORK}, {"GOFLAGS", ctx.GOFLAGS}} {
+			if v[1] != "" {
+				env = append(env, v[0]+"="+v[1])
+			}
+		}
+		if len(env) > 0 {
+			fmt.Printf("            %s\n", strings.Join(env, " "))
+		}
+	}
+	for _, c := range res.Caches {
+		fmt.Printf("cache %s:\n", c.Context)
+		fmt.Printf("  %d dirs, %d packages, last stale check took %v, last used %v ago\n",
+			c.Dirs, c.Packages, c.LastStaleCheck, time.Since(c.LastUse).Round(time.Second))
+		for _, path := range c.FailedPackages {
+			fmt.Printf("  failed: %s\n", path)
+		}
+	}
+	for _, r := range res.Requests {
+		timedOut := ""
+		if r.TimedOut > 0 {
+			timedOut = fmt.Sprintf(", %d timed out", r.TimedOut)
+		}
+		fmt.Printf("%-13s %d requests, %d canceled%s, p50=%v p90=%v p99=%v max=%v\n",
+			r.Kind+":", r.Count, r.Canceled, timedOut, r.P50, r.P90, r.P99, r.Max)
+	}
+	for _, p := range res.Priming {
+		fmt.Printf("priming %s: %s\n", strings.Join(p.Patterns, " "), primeProgressString(&p))
+	}
+}
+
+// cmdPrime loads the dependencies of the packages in the given
+// directories into the daemon's cache, printing the progress.
+func cmdPrime() {
+	if flag.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "gocode: prime needs at least one directory or pattern\n")
+		os.Exit(2)
+	}
+	if *g_oneshot {
+		fmt.Fprintf(os.Stderr, "gocode: prime needs the daemon\n")
+		os.Exit(2)
+	}
+	var req PrimeRequest
+	for _, pattern := range flag.Args()[1:] {
+		recursive := strings.HasSuffix(pattern, "/...")
+		dir, err := filepath.Abs(strings.TrimSuffix(pattern, "/..."))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if recursive {
+			dir += "/..."
+		}
+		req.Patterns = append(req.Patterns, dir)
+	}
+	req.Overlay = prepareOverlay()
+	req.Context = gbimporter.PackContext(&build.Default)
+	req.ID = *g_id
+
+	c := clientConnect()
+	defer c.Close()
+	var res PrimeReply
+	err := c.Call("Server.Prime", &req, &res)
+	checkError(err, res.Error)
+
+	// The daemon keeps priming if we are interrupted.
+	last := ""
+	for {
+		sreq := PrimeStatusRequest{Job: res.Job}
+		var sres PrimeStatusReply
+		err := c.Call("Server.PrimeStatus", &sreq, &sres)
+		checkError(err, sres.Error)
+		p := &sres.Progress
+		if s := primeProgressString(p); s != last {
+			fmt.Println(s)
+			last = s
+		}
+		if p.Done {
+			if p.Canceled {
+				os.Exit(1)
+			}
+			return
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func primeProgressString(p *PrimeProgress) string {
+	switch {
+	case p.Canceled:
+		return fmt.Sprintf("canceled after %d/%d directories, %d imports, %v", p.DirsDone, p.Dirs, p.Imports, p.Elapsed.Round(time.Millisecond))
+	case p.Done:
+		return fmt.Sprintf("primed %d directories, %d imports in %v", p.DirsDone, p.Imports, p.Elapsed.Round(time.Millisecond))
+	case p.Dirs == 0:
+		return "searching directories"
+	}
+	return fmt.Sprintf("%d/%d directories, %d imports: %s", p.DirsDone, p.Dirs, p.Imports, p.Current)
+}
+
 func cmdExit(c *rpc.Client) {
 	var req ExitRequest
 	var res ExitReply
-	if err := c.Call("Server.Exit", &req, &res); err != nil {
-		panic(err)
+	err := c.Call("Server.Exit", &req, &res)
+	checkError(err, nil)
+}
+
+func prepareIDDeadline() (string, time.Time) {
+	var deadline time.Time
+	if *g_timeout > 0 {
+		deadline = time.Now().Add(*g_timeout)
+	}
+	return *g_id, deadline
+}
+
+// checkError prints the error of a failed call or request to stderr and
+// exits with a non-zero status.
+func checkError(err error, reqErr *RequestError) {
+	if reqErr != nil {
+		err = reqErr
+	}
+	if err == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "gocode: %v\n", err)
+	if reqErr != nil && reqErr.Stack != "" {
+		fmt.Fprintf(os.Stderr, "\n%s", reqErr.Stack)
+	}
+	os.Exit(1)
+}
+
+// reportCanceled notes on stderr when results are incomplete, leaving
+// the formatted output untouched.
+func reportCanceled(canceled bool) {
+	if canceled {
+		fmt.Fprintf(os.Stderr, "gocode: request canceled; results may be incomplete\n")
 	}
 }
 
@@ -267,3 +615,36 @@ func prepareFilenameData() (string, []byte) {
 
 	return filename, file
 }
+
+// prepareOverlay reads the file named by -overlay. Like the file accepted
+// by 'go build -overlay', it maps source file paths to files holding their
+// replacement contents:
+//
+//	{"Replace": {"/path/to/file.go": "/tmp/unsaved-buffer.go"}}
+func prepareOverlay() pkgfiles.Overlay {
+	if *g_overlay == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(*g_overlay)
+	if err != nil {
+		panic(err.Error())
+	}
+	var spec struct {
+		Replace map[string]string
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		panic(fmt.Sprintf("%s: %v", *g_overlay, err))
+	}
+
+	overlay := make(pkgfiles.Overlay)
+	for filename, replacement := range spec.Replace {
+		contents, err := ioutil.ReadFile(replacement)
+		if err != nil {
+			panic(err.Error())
+		}
+		filename, _ = filepath.Abs(filename)
+		overlay[filename] = contents
+	}
+	return overlay
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errLocked is returned by lockFile if another process holds the lock.
+var errLocked = errors.New("locked by another process")
+
+// daemonLock is held by the server for as long as it runs. Keeping a
+// reference also keeps the file from being closed by its finalizer.
+var daemonLock *os.File
+
+// getLockPath returns the path of the lockfile that makes sure only one
+// daemon serves a socket. It also holds the PID of that daemon.
+func getLockPath() string {
+	if *g_sock == "unix" {
+		return getSocketPath() + ".lock"
+	}
+	return getSocketPath() + "." + strings.Replace(*g_addr, ":", "_", -1) + ".lock"
+}
+
+// lockDaemon takes the daemon lock and records the PID of this process
+// in the lockfile. It returns errLocked if another daemon is running.
+func lockDaemon() error {
+	f, err := lockFile(getLockPath())
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d\n", os.Getpid()); err != nil {
+		f.Close()
+		return err
+	}
+	daemonLock = f
+	return nil
+}
+
+// daemonPID returns the PID of the running daemon, or 0 if there is
+// none. It only reads the lockfile, so that it never holds the lock
+// while a daemon is starting; the PID of a daemon that exited is
+// ignored.
+func daemonPID() int {
+	data, err := ioutil.ReadFile(getLockPath())
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	if pid <= 0 || !processAlive(pid) {
+		return 0
+	}
+	return pid
+}
@@ -55,18 +55,20 @@ symbol is preceded by a \".\", ignoring `company-minimum-prefix-length'."
 
 (defun company-go--invoke-autocomplete ()
   (let ((temp-buffer (generate-new-buffer "*gocode*")))
-    (prog2
-        (call-process-region (point-min)
-                             (point-max)
-                             company-go-gocode-command
-                             nil
-                             temp-buffer
-                             nil
-                             "-f=csv"
-                             "autocomplete"
-                             (or (buffer-file-name) "")
-                             (concat "c" (int-to-string (- (point) 1))))
-        (with-current-buffer temp-buffer (buffer-string))
+    (unwind-protect
+        (let ((status (call-process-region (point-min)
+                                           (point-max)
+                                           company-go-gocode-command
+                                           nil
+                                           (list temp-buffer nil)
+                                           nil
+                                           "-f=csv"
+                                           "autocomplete"
+                                           (or (buffer-file-name) "")
+                                           (concat "c" (int-to-string (- (point) 1))))))
+          (unless (eq status 0)
+            (error "gocode failed: run \"gocode -s -debug\" for details"))
+          (with-current-buffer temp-buffer (buffer-string)))
       (kill-buffer temp-buffer))))
 
 (defun company-go--format-meta (candidate)
@@ -85,10 +87,7 @@ symbol is preceded by a \".\", ignoring `company-minimum-prefix-length'."
               (propertize (nth 1 candidate) 'meta (company-go--format-meta candidate)))) strings))
 
 (defun company-go--candidates ()
-  (let ((candidates (company-go--get-candidates (split-string (company-go--invoke-autocomplete) "\n" t))))
-    (if (equal candidates '("PANIC"))
-        (error "GOCODE PANIC: Please check your code by \"go build\"")
-      candidates)))
+  (company-go--get-candidates (split-string (company-go--invoke-autocomplete) "\n" t)))
 
 (defun company-go--location (arg)
   (when (require 'go-mode nil t)
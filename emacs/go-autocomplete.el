@@ -92,18 +92,20 @@
 (defun ac-go-invoke-autocomplete ()
   (let ((temp-buffer (generate-new-buffer "*gocode*")))
     (unwind-protect
-        (progn
-          (call-process-region (point-min)
-                               (point-max)
-                               "gocode"
-                               nil
-                               temp-buffer
-                               nil
-                               "-f=emacs"
-                               "autocomplete"
-                               (or (buffer-file-name) "")
-                               (concat "c" (int-to-string (- (point) 1))))
-          (with-current-buffer temp-buffer (buffer-string)))
+        (let ((status (call-process-region (point-min)
+                                           (point-max)
+                                           "gocode"
+                                           nil
+                                           (list temp-buffer nil)
+                                           nil
+                                           "-f=emacs"
+                                           "autocomplete"
+                                           (or (buffer-file-name) "")
+                                           (concat "c" (int-to-string (- (point) 1))))))
+          (if (eq status 0)
+              (with-current-buffer temp-buffer (buffer-string))
+            (message "gocode failed: run \"gocode -s -debug\" for details")
+            ""))
       (kill-buffer temp-buffer))))
 
 (defun ac-go-format-autocomplete (buffer-contents)
@@ -178,13 +180,8 @@
         nil)))
 
 (defun ac-go-candidates ()
-  (let ((candidates (ac-go-get-candidates
-                     (ac-go-format-autocomplete (ac-go-invoke-autocomplete)))))
-    (if (equal candidates '("PANIC"))
-        (progn
-          (message "GOCODE PANIC: Please check your code by \"go build\"")
-          nil)
-      candidates)))
+  (ac-go-get-candidates
+   (ac-go-format-autocomplete (ac-go-invoke-autocomplete))))
 
 (defun ac-go-prefix ()
   (or (ac-prefix-symbol)
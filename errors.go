@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// ErrorCode classifies the errors reported in replies.
+type ErrorCode int
+
+const (
+	ErrInternal   ErrorCode = iota + 1 // gocode crashed while serving the request
+	ErrBadRequest                      // the request is malformed, eg the cursor is out of range
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrInternal:
+		return "internal error"
+	case ErrBadRequest:
+		return "bad request"
+	}
+	return fmt.Sprintf("error %d", int(c))
+}
+
+// RequestError describes why a request failed. Replies carry it instead
+// of results, so clients can tell a failure from an empty result.
+type RequestError struct {
+	Code    ErrorCode
+	Message string
+	Stack   string // stack trace of a panic, only in debug mode
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Code, e.Message)
+}
+
+// panicError logs a recovered panic and converts it to an error for the
+// reply.
+func panicError(v interface{}) *RequestError {
+	stack := debug.Stack()
+	log.Printf("panic: %v\n\n%s", v, stack)
+	e := &RequestError{Code: ErrInternal, Message: fmt.Sprint(v)}
+	if *g_debug {
+		e.Stack = string(stack)
+	}
+	return e
+}
+
+// checkCursor reports an error if cursor is not an offset in data.
+func checkCursor(data []byte, cursor int) *RequestError {
+	if cursor < 0 || cursor > len(data) {
+		return &RequestError{Code: ErrBadRequest, Message: fmt.Sprintf("cursor %d out of range [0, %d]", cursor, len(data))}
+	}
+	return nil
+}
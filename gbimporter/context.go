@@ -1,8 +1,13 @@
 package gbimporter
 
-import "go/build"
+import (
+	"go/build"
+	"os"
+)
 
-// PackedContext is a copy of build.Context without the func fields.
+// PackedContext is a copy of build.Context without the func fields,
+// plus the settings of the go command that affect how imports are
+// resolved in module mode.
 //
 // TODO(mdempsky): Not sure this belongs here.
 type PackedContext struct {
@@ -16,8 +21,15 @@ type PackedContext struct {
 	BuildTags     []string
 	ReleaseTags   []string
 	InstallSuffix string
+
+	GO111MODULE string
+	GOMODCACHE  string
+	GOWORK      string
+	GOFLAGS     string
 }
 
+// PackContext returns the settings of ctx, and the module settings of
+// the go command in the environment of the calling process.
 func PackContext(ctx *build.Context) PackedContext {
 	return PackedContext{
 		GOARCH:        ctx.GOARCH,
@@ -30,5 +42,26 @@ func PackContext(ctx *build.Context) PackedContext {
 		BuildTags:     ctx.BuildTags,
 		ReleaseTags:   ctx.ReleaseTags,
 		InstallSuffix: ctx.InstallSuffix,
+		GO111MODULE:   os.Getenv("GO111MODULE"),
+		GOMODCACHE:    os.Getenv("GOMODCACHE"),
+		GOWORK:        os.Getenv("GOWORK"),
+		GOFLAGS:       os.Getenv("GOFLAGS"),
+	}
+}
+
+// UnpackContext returns a build.Context with the settings of ctx. Its
+// func fields are nil, so it accesses the local file system.
+func UnpackContext(ctx *PackedContext) *build.Context {
+	return &build.Context{
+		GOARCH:        ctx.GOARCH,
+		GOOS:          ctx.GOOS,
+		GOROOT:        ctx.GOROOT,
+		GOPATH:        ctx.GOPATH,
+		CgoEnabled:    ctx.CgoEnabled,
+		UseAllFiles:   ctx.UseAllFiles,
+		Compiler:      ctx.Compiler,
+		BuildTags:     ctx.BuildTags,
+		ReleaseTags:   ctx.ReleaseTags,
+		InstallSuffix: ctx.InstallSuffix,
 	}
 }
@@ -5,18 +5,32 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/mdempsky/gocode/srcimporter"
 )
 
 var (
 	g_is_server         = flag.Bool("s", false, "run a server instead of a client")
 	g_format            = flag.String("f", "nice", "output format (vim | emacs | nice | csv | json)")
 	g_input             = flag.String("in", "", "use this file instead of stdin input")
+	g_overlay           = flag.String("overlay", "", "JSON file of unsaved buffers, in the format of 'go build -overlay'")
 	g_sock              = flag.String("sock", defaultSocketType, "socket type (unix | tcp)")
 	g_addr              = flag.String("addr", "127.0.0.1:37373", "address for tcp socket")
 	g_debug             = flag.Bool("debug", false, "enable server-side debug mode")
 	g_filtersuggestions = flag.Bool("filtersuggestions", true, "filter suggestions with text before cursor")
+	g_snippets          = flag.Bool("snippets", false, "insert functions as snippets with parameter placeholders")
 	g_importsrc         = flag.Bool("importsrc", true, "import source instead of binaries")
 	g_oneshot           = flag.Bool("oneshot", false, "no server")
+	g_timeout           = flag.Duration("timeout", 0, "return partial results after this long (0 means no deadline)")
+	g_features          = flag.String("features", "complete,lookup,errors", "results computed by the analyze command")
+	g_id                = flag.String("id", "", "request ID, for use with the cancel command")
+	g_lsp               = flag.Bool("lsp", false, "speak the Language Server Protocol on stdin/stdout")
+	g_tokenfile         = flag.String("tokenfile", "", "file holding the daemon's authentication token (default: in the user config dir)")
+	g_sockperm          = flag.String("sockperm", "0600", "permissions of the unix socket")
+	g_record            = flag.String("record", "", "server saves requests and replies as JSON files in this directory")
+	g_exportcache       = flag.String("exportcache", "", "directory caching type-checked packages across runs, or \"off\" (default: in the user cache dir)")
+	g_idle              = flag.Duration("idle", 30*time.Minute, "server exits after being idle this long (0 means never)")
 )
 
 func getSocketPath() string {
@@ -29,7 +43,7 @@ func getSocketPath() string {
 
 func usage() {
 	fmt.Fprintf(os.Stderr,
-		"Usage: %s [-s] [-f=<format>] [-in=<path>] [-sock=<type>] [-addr=<addr>]\n"+
+		"Usage: %s [-s | -lsp] [-f=<format>] [-in=<path>] [-sock=<type>] [-addr=<addr>]\n"+
 			"       <command> [<args>]\n\n",
 		os.Args[0])
 	fmt.Fprintf(os.Stderr,
@@ -40,16 +54,42 @@ func usage() {
 			"  autocomplete [<path>] <offset>     main autocompletion command\n"+
 			"  lookup [<path>] <offset>           definition location, type, and doc\n"+
 			"  reporterrors <path>                list syntax and type errors in file\n"+
+			"  analyze [<path>] <offset>          all of the above as JSON, from one type-check (see -features)\n"+
+			"  watch <path>...                    print errors in files whenever packages they import change\n"+
+			"  prime <dir|dir/...>...             load the packages the directories import into the daemon's cache\n"+
+			"  status                             show the state of the gocode daemon\n"+
+			"  replay <dir>                       re-run requests saved with -record and diff the replies\n"+
+			"  cancel <id>                        cancel the running request with the given -id\n"+
 			"  exit                               terminate the gocode daemon\n")
 }
 
+// getExportCacheDir returns the directory of the export cache, or "" if
+// it is disabled.
+func getExportCacheDir() string {
+	switch *g_exportcache {
+	case "off":
+		return ""
+	case "":
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return ""
+		}
+		return filepath.Join(dir, "gocode", "export")
+	}
+	return *g_exportcache
+}
+
 func main() {
 	flag.Usage = usage
 	flag.Parse()
+	srcimporter.SetExportCache(getExportCacheDir())
 
-	if *g_is_server {
+	switch {
+	case *g_lsp:
+		doLSP()
+	case *g_is_server:
 		doServer()
-	} else {
+	default:
 		doClient()
 	}
 }
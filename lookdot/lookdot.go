@@ -137,12 +137,10 @@ func walk(typ0 types.Type, addable0, value bool, v Visitor) {
 	}
 }
 
-// namedOf returns the named type T when given T or *T.
-// Otherwise, it returns nil.
+// namedOf returns the named type T when given T or *T, or aliases of
+// them. Otherwise, it returns nil.
 func namedOf(typ types.Type) *types.Named {
-	if ptr, isPtr := typ.(*types.Pointer); isPtr {
-		typ = ptr.Elem()
-	}
+	typ, _ = chasePointer(typ)
 	res, _ := typ.(*types.Named)
 	return res
 }
@@ -152,9 +150,12 @@ func hasPtrRecv(m *types.Func) bool {
 	return ok
 }
 
+// chasePointer returns the element type of a pointer type, and whether
+// typ was a pointer type. Aliases are resolved on the way.
 func chasePointer(typ types.Type) (types.Type, bool) {
+	typ = types.Unalias(typ)
 	if ptr, isPtr := typ.(*types.Pointer); isPtr {
-		return ptr.Elem(), true
+		return types.Unalias(ptr.Elem()), true
 	}
 	return typ, false
 }
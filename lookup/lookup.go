@@ -3,15 +3,15 @@ package lookup
 import (
 	"bytes"
 	"go/ast"
-	"go/parser"
+	"go/build"
 	"go/token"
 	"go/types"
-	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 
+	"github.com/mdempsky/gocode/check"
+	"github.com/mdempsky/gocode/pkgfiles"
 	"github.com/mdempsky/gocode/srcimporter"
 )
 
@@ -139,29 +139,21 @@ func lookupObject(importer types.Importer, thisPkg *types.Package, thisFset *tok
 	return result
 }
 
-func Lookup(importer types.Importer, filename string, data []byte, cursor int) (id Result, call Result) {
-	fset := token.NewFileSet()
-	fileAST, _ := parser.ParseFile(fset, filename, data, parser.AllErrors)
-
-	var otherASTs []*ast.File
-	for _, otherName := range findOtherPackageFiles(filename, fileAST.Name.Name) {
-		ast, _ := parser.ParseFile(fset, otherName, nil, 0)
-		otherASTs = append(otherASTs, ast)
-	}
-
-	var cfg types.Config
-	cfg.Importer = importer
-	cfg.Error = func(err error) {}
-	info := types.Info{
-		Types: map[ast.Expr]types.TypeAndValue{},
-		Defs:  map[*ast.Ident]types.Object{},
-		Uses:  map[*ast.Ident]types.Object{},
-	}
-	pkg, err := cfg.Check("", fset, append(otherASTs, fileAST), &info)
+// Lookup returns the object at the cursor and the function called
+// around the cursor, if any. Other files of the package are read from
+// overlay if present there, and chosen by the build constraints of ctxt;
+// see check.Check.
+func Lookup(importer types.Importer, filename string, data []byte, cursor int, overlay pkgfiles.Overlay, ctxt *build.Context) (id Result, call Result) {
+	return LookupPackage(importer, check.Check(importer, filename, data, overlay, ctxt, true), cursor)
+}
 
-	_, _ = pkg, err
+// LookupPackage is like Lookup, but uses the results of type-checking the
+// package of the edited file. importer must be the importer used for
+// type-checking.
+func LookupPackage(importer types.Importer, p *check.Package, cursor int) (id Result, call Result) {
+	fset, pkg, info := p.Fset, p.Pkg, p.Info
 	cs := cursorSearch{cursor: cursor, fset: fset}
-	ast.Walk(&cs, fileAST)
+	ast.Walk(&cs, p.File)
 
 	if cs.id != nil {
 		id = lookupObject(importer, pkg, fset, info.ObjectOf(cs.id))
@@ -183,47 +175,3 @@ func Lookup(importer types.Importer, filename string, data []byte, cursor int) (
 	}
 	return id, call
 }
-
-//
-// The following was copied from suggest.go.
-//
-func findOtherPackageFiles(filename, pkgName string) []string {
-	if filename == "" {
-		return nil
-	}
-
-	dir, file := filepath.Split(filename)
-	dents, err := ioutil.ReadDir(dir)
-	if err != nil {
-		panic(err)
-	}
-	isTestFile := strings.HasSuffix(file, "_test.go")
-
-	// TODO(mdempsky): Use go/build.(*Context).MatchFile or
-	// something to properly handle build tags?
-	var out []string
-	for _, dent := range dents {
-		name := dent.Name()
-		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
-			continue
-		}
-		if name == file || !strings.HasSuffix(name, ".go") {
-			continue
-		}
-		if !isTestFile && strings.HasSuffix(name, "_test.go") {
-			continue
-		}
-
-		abspath := filepath.Join(dir, name)
-		if pkgNameFor(abspath) == pkgName {
-			out = append(out, abspath)
-		}
-	}
-
-	return out
-}
-
-func pkgNameFor(filename string) string {
-	file, _ := parser.ParseFile(token.NewFileSet(), filename, nil, parser.PackageClauseOnly)
-	return file.Name.Name
-}
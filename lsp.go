@@ -0,0 +1,956 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/mdempsky/gocode/gbimporter"
+	"github.com/mdempsky/gocode/pkgfiles"
+	"github.com/mdempsky/gocode/srcimporter"
+)
+
+// doLSP serves the Language Server Protocol over stdin and stdout. The
+// requests are answered in-process by the same handlers the daemon uses,
+// so the shared srcimporter cache lives as long as the editor session.
+func doLSP() {
+	s := &lspServer{
+		in:   bufio.NewReader(os.Stdin),
+		out:  os.Stdout,
+		docs: make(map[string]*lspDocument),
+	}
+	srcimporter.OnStale(func(dirs []string) { s.publishAll() })
+	go s.keepAlive()
+	os.Exit(s.run())
+}
+
+type lspServer struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	outMu sync.Mutex // serializes writes to out
+
+	mu       sync.Mutex // protects docs and publishing
+	docs     map[string]*lspDocument
+	shutdown bool
+	snippets bool // the client accepts snippets as completion text
+
+	// publishing holds the URIs whose diagnostics are being computed,
+	// mapped to whether they must be computed again afterwards.
+	publishing map[string]bool
+}
+
+type lspDocument struct {
+	filename string
+	version  int
+	text     []byte
+}
+
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *lspError) Error() string { return e.Message }
+
+// JSON-RPC and LSP error codes.
+const (
+	lspParseError     = -32700
+	lspMethodNotFound = -32601
+	lspInvalidParams  = -32602
+	lspInternalError  = -32603
+
+	lspContentModified = -32801
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type lspTextDocumentPositionParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+	Position     lspPosition               `json:"position"`
+}
+
+type lspDidOpenParams struct {
+	TextDocument struct {
+		URI     string `json:"uri"`
+		Version int    `json:"version"`
+		Text    string `json:"text"`
+	} `json:"textDocument"`
+}
+
+type lspDidChangeParams struct {
+	TextDocument struct {
+		URI     string `json:"uri"`
+		Version int    `json:"version"`
+	} `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type lspDidCloseParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+}
+
+type lspCompletionItem struct {
+	Label    string       `json:"label"`
+	Kind     int          `json:"kind,omitempty"`
+	Detail   string       `json:"detail,omitempty"`
+	SortText string       `json:"sortText,omitempty"`
+	TextEdit *lspTextEdit `json:"textEdit,omitempty"`
+
+	InsertTextFormat    int           `json:"insertTextFormat,omitempty"`
+	AdditionalTextEdits []lspTextEdit `json:"additionalTextEdits,omitempty"`
+}
+
+// InsertTextFormat values.
+const (
+	lspPlainText = 1
+	lspSnippet   = 2
+)
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspCompletionList struct {
+	IsIncomplete bool                `json:"isIncomplete"`
+	Items        []lspCompletionItem `json:"items"`
+}
+
+type lspMarkupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type lspHover struct {
+	Contents lspMarkupContent `json:"contents"`
+}
+
+type lspParameterInformation struct {
+	Label string `json:"label"`
+}
+
+type lspSignatureInformation struct {
+	Label         string                    `json:"label"`
+	Documentation *lspMarkupContent         `json:"documentation,omitempty"`
+	Parameters    []lspParameterInformation `json:"parameters"`
+}
+
+type lspSignatureHelp struct {
+	Signatures      []lspSignatureInformation `json:"signatures"`
+	ActiveSignature int                       `json:"activeSignature"`
+	ActiveParameter int                       `json:"activeParameter"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspPublishDiagnosticsParams struct {
+	URI         string          `json:"uri"`
+	Version     int             `json:"version"`
+	Diagnostics []lspDiagnostic `json:"diagnostics"`
+}
+
+func (s *lspServer) run() int {
+	for {
+		msg, err := s.read()
+		if err == io.EOF {
+			return 1
+		}
+		if err != nil {
+			log.Printf("lsp: %v", err)
+			s.reply(nil, nil, &lspError{lspParseError, err.Error()})
+			continue
+		}
+
+		if msg.ID == nil {
+			if msg.Method == "exit" {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				if s.shutdown {
+					return 0
+				}
+				return 1
+			}
+			s.notification(msg)
+			continue
+		}
+
+		// Document state is only touched by notifications, which
+		// are handled in order above, so requests may run
+		// concurrently.
+		go s.request(msg)
+	}
+}
+
+func (s *lspServer) read() (*lspMessage, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if i := strings.IndexByte(line, ':'); i >= 0 && strings.EqualFold(line[:i], "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[i+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("bad Content-Length: %q", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("missing Content-Length header")
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.in, body); err != nil {
+		return nil, err
+	}
+	var msg lspMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (s *lspServer) write(msg *lspMessage) {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("lsp: %v", err)
+		return
+	}
+
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n", len(body))
+	s.out.Write(body)
+}
+
+func (s *lspServer) reply(id *json.RawMessage, result interface{}, err *lspError) {
+	if id == nil {
+		null := json.RawMessage("null")
+		id = &null
+	}
+	if result == nil && err == nil {
+		// A successful response must carry a result, even if
+		// it is null.
+		result = json.RawMessage("null")
+	}
+	s.write(&lspMessage{ID: id, Result: result, Error: err})
+}
+
+func (s *lspServer) notify(method string, params interface{}) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		log.Printf("lsp: %v", err)
+		return
+	}
+	s.write(&lspMessage{Method: method, Params: raw})
+}
+
+func (s *lspServer) request(msg *lspMessage) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("lsp: panic in %s: %v", msg.Method, err)
+			s.reply(msg.ID, nil, &lspError{lspInternalError, fmt.Sprint(err)})
+		}
+	}()
+
+	var result interface{}
+	var err error
+	switch msg.Method {
+	case "initialize":
+		result = s.initialize(msg.Params)
+	case "shutdown":
+		s.mu.Lock()
+		s.shutdown = true
+		s.mu.Unlock()
+	case "textDocument/completion":
+		result, err = s.completion(lspRequestID(msg.ID), msg.Params)
+	case "textDocument/hover":
+		result, err = s.hover(lspRequestID(msg.ID), msg.Params)
+	case "textDocument/signatureHelp":
+		result, err = s.signatureHelp(lspRequestID(msg.ID), msg.Params)
+	case "textDocument/definition":
+		result, err = s.definition(lspRequestID(msg.ID), msg.Params)
+	default:
+		s.reply(msg.ID, nil, &lspError{lspMethodNotFound, "method not found: " + msg.Method})
+		return
+	}
+	if err, ok := err.(*lspError); ok {
+		s.reply(msg.ID, nil, err)
+		return
+	}
+	if err, ok := err.(*RequestError); ok && err.Code == ErrInternal {
+		s.reply(msg.ID, nil, &lspError{lspInternalError, err.Error()})
+		return
+	}
+	if err != nil {
+		s.reply(msg.ID, nil, &lspError{lspInvalidParams, err.Error()})
+		return
+	}
+	s.reply(msg.ID, result, nil)
+}
+
+// lspRequestID maps a JSON-RPC request ID onto a daemon request ID.
+func lspRequestID(id *json.RawMessage) string {
+	return "lsp:" + string(*id)
+}
+
+func (s *lspServer) notification(msg *lspMessage) {
+	switch msg.Method {
+	case "$/cancelRequest":
+		var params struct {
+			ID *json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil || params.ID == nil {
+			log.Printf("lsp: %s: bad params", msg.Method)
+			return
+		}
+		// The canceled request still replies, with partial results.
+		cancelRequest(lspRequestID(params.ID))
+	case "textDocument/didOpen":
+		var params lspDidOpenParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			log.Printf("lsp: %s: %v", msg.Method, err)
+			return
+		}
+		td := params.TextDocument
+		s.setDocument(td.URI, td.Version, []byte(td.Text))
+	case "textDocument/didChange":
+		var params lspDidChangeParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			log.Printf("lsp: %s: %v", msg.Method, err)
+			return
+		}
+		// We only advertise full document sync, so the last
+		// change holds the complete text.
+		if n := len(params.ContentChanges); n > 0 {
+			td := params.TextDocument
+			s.setDocument(td.URI, td.Version, []byte(params.ContentChanges[n-1].Text))
+		}
+	case "textDocument/didClose":
+		var params lspDidCloseParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			log.Printf("lsp: %s: %v", msg.Method, err)
+			return
+		}
+		s.mu.Lock()
+		delete(s.docs, params.TextDocument.URI)
+		s.mu.Unlock()
+		s.notify("textDocument/publishDiagnostics", lspPublishDiagnosticsParams{
+			URI:         params.TextDocument.URI,
+			Diagnostics: []lspDiagnostic{},
+		})
+	case "textDocument/didSave":
+		var params lspDidCloseParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			log.Printf("lsp: %s: %v", msg.Method, err)
+			return
+		}
+		s.mu.Lock()
+		if s.docs[params.TextDocument.URI] != nil {
+			s.publish(params.TextDocument.URI)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *lspServer) initialize(params json.RawMessage) interface{} {
+	var p struct {
+		Capabilities struct {
+			TextDocument struct {
+				Completion struct {
+					CompletionItem struct {
+						SnippetSupport bool `json:"snippetSupport"`
+					} `json:"completionItem"`
+				} `json:"completion"`
+			} `json:"textDocument"`
+		} `json:"capabilities"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		log.Printf("lsp: initialize: %v", err)
+	}
+	s.mu.Lock()
+	s.snippets = p.Capabilities.TextDocument.Completion.CompletionItem.SnippetSupport
+	s.mu.Unlock()
+
+	type syncOptions struct {
+		OpenClose bool `json:"openClose"`
+		Change    int  `json:"change"`
+		Save      bool `json:"save"`
+	}
+	type triggers struct {
+		TriggerCharacters []string `json:"triggerCharacters"`
+	}
+	type capabilities struct {
+		TextDocumentSync      syncOptions `json:"textDocumentSync"`
+		CompletionProvider    triggers    `json:"completionProvider"`
+		HoverProvider         bool        `json:"hoverProvider"`
+		SignatureHelpProvider triggers    `json:"signatureHelpProvider"`
+		DefinitionProvider    bool        `json:"definitionProvider"`
+	}
+	type serverInfo struct {
+		Name string `json:"name"`
+	}
+	return struct {
+		Capabilities capabilities `json:"capabilities"`
+		ServerInfo   serverInfo   `json:"serverInfo"`
+	}{
+		Capabilities: capabilities{
+			TextDocumentSync:      syncOptions{OpenClose: true, Change: 1, Save: true},
+			CompletionProvider:    triggers{[]string{"."}},
+			HoverProvider:         true,
+			SignatureHelpProvider: triggers{[]string{"(", ","}},
+			DefinitionProvider:    true,
+		},
+		ServerInfo: serverInfo{Name: "gocode"},
+	}
+}
+
+func (s *lspServer) setDocument(uri string, version int, text []byte) {
+	filename, err := uriToFilename(uri)
+	if err != nil {
+		log.Printf("lsp: %v", err)
+		return
+	}
+	doc := &lspDocument{filename: filename, version: version, text: text}
+	s.mu.Lock()
+	s.docs[uri] = doc
+	// Other open files of the package see the new contents too.
+	dir := filepath.Dir(filename)
+	for otherURI, other := range s.docs {
+		if otherURI != uri && filepath.Dir(other.filename) == dir {
+			s.publish(otherURI)
+		}
+	}
+	s.publish(uri)
+	s.mu.Unlock()
+}
+
+// publishAll publishes diagnostics for all open documents, which may have
+// new errors after packages changed on disk.
+func (s *lspServer) publishAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for uri := range s.docs {
+		s.publish(uri)
+	}
+}
+
+// publish publishes the diagnostics of the open document uri in the
+// background. Publishes requested while the diagnostics are computed
+// are merged into one for the latest version of the document, so that
+// fast typing does not pile up type-checks. s.mu must be held.
+func (s *lspServer) publish(uri string) {
+	if s.publishing == nil {
+		s.publishing = make(map[string]bool)
+	}
+	if _, ok := s.publishing[uri]; ok {
+		s.publishing[uri] = true
+		return
+	}
+	s.publishing[uri] = false
+	go func() {
+		for {
+			s.mu.Lock()
+			doc := s.docs[uri]
+			s.publishing[uri] = false
+			s.mu.Unlock()
+			if doc != nil {
+				s.publishDiagnostics(uri, doc)
+			}
+			s.mu.Lock()
+			again := s.publishing[uri] && s.docs[uri] != nil
+			if !again {
+				delete(s.publishing, uri)
+			}
+			s.mu.Unlock()
+			if !again {
+				return
+			}
+		}
+	}()
+}
+
+// keepAlive keeps the caches of open documents checking for modified
+// files while the editor sends no requests.
+func (s *lspServer) keepAlive() {
+	ctx := gbimporter.PackContext(&build.Default)
+	for range time.Tick(time.Minute) {
+		s.mu.Lock()
+		for _, doc := range s.docs {
+			srcimporter.KeepAlive(&ctx, doc.filename)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// overlay returns the contents of all open documents.
+func (s *lspServer) overlay() pkgfiles.Overlay {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	overlay := make(pkgfiles.Overlay, len(s.docs))
+	for _, doc := range s.docs {
+		overlay[doc.filename] = doc.text
+	}
+	return overlay
+}
+
+// document returns the current snapshot of the document at uri, or nil
+// if the editor has not opened it.
+func (s *lspServer) document(uri string) *lspDocument {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.docs[uri]
+}
+
+func (s *lspServer) publishDiagnostics(uri string, doc *lspDocument) {
+	req := ReportErrorsRequest{
+		Filename: doc.filename,
+		Data:     doc.text,
+		Overlay:  s.overlay(),
+		Context:  gbimporter.PackContext(&build.Default),
+	}
+	var res ReportErrorsReply
+	if err := ReportErrors(&req, &res); err != nil {
+		log.Printf("lsp: reporterrors: %v", err)
+		return
+	}
+	if res.Error != nil {
+		log.Printf("lsp: reporterrors: %v", res.Error)
+		return
+	}
+
+	// Drop the results if the document changed in the meantime;
+	// the newer version has its own diagnostics on the way.
+	if s.document(uri) != doc {
+		return
+	}
+
+	diags := []lspDiagnostic{}
+	for _, e := range res.Errors {
+		pos := lineColToPosition(doc.text, e.Line, e.Col)
+		diags = append(diags, lspDiagnostic{
+			Range:    lspRange{pos, pos},
+			Severity: 1,
+			Source:   "gocode",
+			Message:  e.Msg,
+		})
+	}
+	s.notify("textDocument/publishDiagnostics", lspPublishDiagnosticsParams{
+		URI:         uri,
+		Version:     doc.version,
+		Diagnostics: diags,
+	})
+}
+
+// positionParams decodes params and returns the document and byte offset
+// they refer to.
+func (s *lspServer) positionParams(params json.RawMessage) (*lspDocument, int, error) {
+	var p lspTextDocumentPositionParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, 0, err
+	}
+	doc := s.document(p.TextDocument.URI)
+	if doc == nil {
+		return nil, 0, fmt.Errorf("document not open: %s", p.TextDocument.URI)
+	}
+	return doc, positionToOffset(doc.text, p.Position), nil
+}
+
+func (s *lspServer) completion(id string, params json.RawMessage) (interface{}, error) {
+	doc, cursor, err := s.positionParams(params)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	snippets := s.snippets
+	s.mu.Unlock()
+
+	req := AutoCompleteRequest{
+		Filename: doc.filename,
+		Data:     doc.text,
+		Overlay:  s.overlay(),
+		Cursor:   cursor,
+		Context:  gbimporter.PackContext(&build.Default),
+		Filter:   true,
+		Snippets: snippets,
+		ID:       id,
+	}
+	var res AutoCompleteReply
+	if err := AutoComplete(&req, &res); err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	list := lspCompletionList{IsIncomplete: res.Canceled, Items: []lspCompletionItem{}}
+	for i, c := range res.Candidates {
+		replace := lspRange{
+			Start: offsetToPosition(doc.text, c.Replace[0]),
+			End:   offsetToPosition(doc.text, c.Replace[1]),
+		}
+		text, format := c.Name, lspPlainText
+		if c.Snippet != "" {
+			text, format = c.Snippet, lspSnippet
+		}
+		var edits []lspTextEdit
+		for _, e := range c.AdditionalEdits {
+			edits = append(edits, lspTextEdit{
+				Range: lspRange{
+					Start: offsetToPosition(doc.text, e.Start),
+					End:   offsetToPosition(doc.text, e.End),
+				},
+				NewText: e.NewText,
+			})
+		}
+		list.Items = append(list.Items, lspCompletionItem{
+			Label:  c.Name,
+			Kind:   lspCompletionKind(c.Class, c.Type),
+			Detail: c.Type,
+			// Keep the ranking by match score rather than
+			// letting the editor sort by label.
+			SortText: fmt.Sprintf("%05d", i),
+			TextEdit: &lspTextEdit{Range: replace, NewText: text},
+
+			InsertTextFormat:    format,
+			AdditionalTextEdits: edits,
+		})
+	}
+	return list, nil
+}
+
+// lspCompletionKind maps a candidate class onto an LSP CompletionItemKind.
+func lspCompletionKind(class, typ string) int {
+	switch class {
+	case "func":
+		return 3
+	case "var":
+		return 6
+	case "const":
+		return 21
+	case "package":
+		return 9
+	case "type":
+		switch typ {
+		case "struct":
+			return 22
+		case "interface":
+			return 8
+		}
+		return 7
+	}
+	return 1
+}
+
+// lookup looks up the identifier and call at the position in params.
+// Lookups for different methods are kinds of their own, so that they
+// do not supersede each other. A canceled lookup fails with
+// ContentModified, since its result may be incomplete.
+func (s *lspServer) lookup(kind, id string, params json.RawMessage) (*LookupReply, error) {
+	doc, cursor, err := s.positionParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	req := LookupRequest{
+		Filename: doc.filename,
+		Data:     doc.text,
+		Overlay:  s.overlay(),
+		Cursor:   cursor,
+		Context:  gbimporter.PackContext(&build.Default),
+		Kind:     kind,
+		ID:       id,
+	}
+	var res LookupReply
+	if err := Lookup(&req, &res); err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.Canceled {
+		return nil, &lspError{lspContentModified, kind + " canceled"}
+	}
+	return &res, nil
+}
+
+func (s *lspServer) hover(id string, params json.RawMessage) (interface{}, error) {
+	res, err := s.lookup("hover", id, params)
+	if err != nil || res.Cursor.Path == "" {
+		return nil, err
+	}
+	li := res.Cursor
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "```go\n%s\n```\n", declString(li))
+	if doc := stripCommentMarkers(li.Doc); doc != "" {
+		fmt.Fprintf(&buf, "\n%s\n", doc)
+	}
+	return lspHover{Contents: lspMarkupContent{Kind: "markdown", Value: buf.String()}}, nil
+}
+
+func (s *lspServer) signatureHelp(id string, params json.RawMessage) (interface{}, error) {
+	res, err := s.lookup("signatureHelp", id, params)
+	if err != nil || res.Call.Path == "" {
+		return nil, err
+	}
+	li := res.Call
+
+	sig := lspSignatureInformation{
+		Label:      declString(li),
+		Parameters: []lspParameterInformation{},
+	}
+	if doc := stripCommentMarkers(li.Doc); doc != "" {
+		sig.Documentation = &lspMarkupContent{Kind: "markdown", Value: doc}
+	}
+	for _, p := range splitParams(li.Type) {
+		sig.Parameters = append(sig.Parameters, lspParameterInformation{Label: p})
+	}
+
+	active := li.CallArg
+	if n := len(sig.Parameters); active >= n && n > 0 && strings.Contains(sig.Parameters[n-1].Label, "...") {
+		active = n - 1
+	}
+	return lspSignatureHelp{
+		Signatures:      []lspSignatureInformation{sig},
+		ActiveParameter: active,
+	}, nil
+}
+
+func (s *lspServer) definition(id string, params json.RawMessage) (interface{}, error) {
+	res, err := s.lookup("definition", id, params)
+	if err != nil || res.Cursor.Path == "" {
+		return nil, err
+	}
+	li := res.Cursor
+
+	var text []byte
+	uri := filenameToURI(li.Path)
+	if doc := s.document(uri); doc != nil {
+		text = doc.text
+	} else {
+		text, _ = ioutil.ReadFile(li.Path)
+	}
+	pos := lineColToPosition(text, li.Line, li.Column)
+	return lspLocation{URI: uri, Range: lspRange{pos, pos}}, nil
+}
+
+// declString formats a lookup result like a Go declaration, e.g.
+// "func Name(x int) error" or "var name T".
+func declString(li LookupInfo) string {
+	if strings.HasPrefix(li.Type, "func(") {
+		return "func " + li.Name + strings.TrimPrefix(li.Type, "func")
+	}
+	return li.Name + " " + li.Type
+}
+
+// stripCommentMarkers turns the "//" comment lines returned by lookup
+// into plain text.
+func stripCommentMarkers(doc string) string {
+	if doc == "" {
+		return ""
+	}
+	lines := strings.Split(doc, "\n")
+	for i, line := range lines {
+		line = strings.TrimPrefix(line, "//")
+		lines[i] = strings.TrimPrefix(line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// splitParams returns the parameters of the function type typ, e.g.
+// ["x int", "y ...string"] for "func(x int, y ...string) error".
+func splitParams(typ string) []string {
+	if !strings.HasPrefix(typ, "func(") {
+		return nil
+	}
+	var params []string
+	depth, start := 0, len("func(")
+	for i := start; i < len(typ); i++ {
+		switch typ[i] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth == 0 {
+				if p := strings.TrimSpace(typ[start:i]); p != "" {
+					params = append(params, p)
+				}
+				return params
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				params = append(params, strings.TrimSpace(typ[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return params
+}
+
+func uriToFilename(uri string) (string, error) {
+	path, err := uriToPath(uri, runtime.GOOS)
+	if err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(path), nil
+}
+
+// uriToPath returns the slash-separated path of the file URI uri on the
+// operating system goos. Percent-escapes are decoded, so that VS Code's
+// "file:///c%3A/dir/file.go" is "c:/dir/file.go" on Windows.
+func uriToPath(uri, goos string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported URI scheme: %s", uri)
+	}
+	path := u.Path
+	if goos == "windows" {
+		if u.Host != "" && u.Host != "localhost" {
+			// A UNC path, \\host\share\file.go.
+			return "//" + u.Host + path, nil
+		}
+		// file:///C:/dir/file.go has the path "/C:/dir/file.go".
+		if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+			path = path[1:]
+		}
+	}
+	return path, nil
+}
+
+func filenameToURI(filename string) string {
+	path := filepath.ToSlash(filename)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	u := url.URL{Scheme: "file", Path: path}
+	return u.String()
+}
+
+// positionToOffset converts an LSP position, whose character is counted
+// in UTF-16 code units, into a byte offset in text.
+func positionToOffset(text []byte, pos lspPosition) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		i := bytes.IndexByte(text[offset:], '\n')
+		if i < 0 {
+			return len(text)
+		}
+		offset += i + 1
+	}
+	for units := 0; units < pos.Character && offset < len(text); {
+		r, size := utf8.DecodeRune(text[offset:])
+		if r == '\n' || r == '\r' && bytes.HasPrefix(text[offset+1:], []byte("\n")) {
+			// Past the end of the line.
+			break
+		}
+		units += utf16Len(r)
+		offset += size
+	}
+	return offset
+}
+
+// offsetToPosition converts a byte offset in text into an LSP position.
+func offsetToPosition(text []byte, offset int) lspPosition {
+	if offset > len(text) {
+		offset = len(text)
+	}
+	var pos lspPosition
+	lineStart := 0
+	if i := bytes.LastIndexByte(text[:offset], '\n'); i >= 0 {
+		pos.Line = bytes.Count(text[:offset], []byte("\n"))
+		lineStart = i + 1
+	}
+	for _, r := range string(text[lineStart:offset]) {
+		pos.Character += utf16Len(r)
+	}
+	return pos
+}
+
+// lineColToPosition converts a 1-based line and byte column, as used by
+// go/token, into an LSP position.
+func lineColToPosition(text []byte, line, col int) lspPosition {
+	// go/token uses 0 for unknown lines and columns.
+	if line < 1 {
+		line = 1
+	}
+	if col < 1 {
+		col = 1
+	}
+	offset := 0
+	for l := 1; l < line; l++ {
+		i := bytes.IndexByte(text[offset:], '\n')
+		if i < 0 {
+			return lspPosition{Line: line - 1, Character: col - 1}
+		}
+		offset += i + 1
+	}
+	if offset+col-1 > len(text) {
+		return lspPosition{Line: line - 1, Character: col - 1}
+	}
+	return offsetToPosition(text, offset+col-1)
+}
+
+func utf16Len(r rune) int {
+	if r1, _ := utf16.EncodeRune(r); r1 != utf8.RuneError {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPositionToOffset(t *testing.T) {
+	var tests = [...]struct {
+		text   string
+		pos    lspPosition
+		offset int
+	}{
+		{"abc\ndef", lspPosition{0, 0}, 0},
+		{"abc\ndef", lspPosition{0, 2}, 2},
+		{"abc\ndef", lspPosition{1, 1}, 5},
+		{"abc\ndef", lspPosition{1, 3}, 7},
+		// Characters past the end of a line stop at the line break.
+		{"abc\ndef", lspPosition{0, 10}, 3},
+		{"abc\ndef", lspPosition{5, 0}, 7},
+		{"abc\r\ndef", lspPosition{0, 3}, 3},
+		{"abc\r\ndef", lspPosition{0, 10}, 3},
+		{"abc\r\ndef", lspPosition{1, 2}, 7},
+		// A lone carriage return is not a line break.
+		{"a\rb\nc", lspPosition{0, 3}, 3},
+		// "é" is 2 bytes and 1 UTF-16 unit, "😀" 4 bytes and 2 units.
+		{"é😀x", lspPosition{0, 1}, 2},
+		{"é😀x", lspPosition{0, 3}, 6},
+		{"é😀x", lspPosition{0, 4}, 7},
+		{"\n\t日本語", lspPosition{1, 3}, 8},
+	}
+	for _, test := range tests {
+		if got := positionToOffset([]byte(test.text), test.pos); got != test.offset {
+			t.Errorf("positionToOffset(%q, %v) = %d, want %d", test.text, test.pos, got, test.offset)
+		}
+	}
+}
+
+func TestOffsetToPosition(t *testing.T) {
+	var tests = [...]struct {
+		text   string
+		offset int
+		pos    lspPosition
+	}{
+		{"abc\ndef", 0, lspPosition{0, 0}},
+		{"abc\ndef", 3, lspPosition{0, 3}},
+		{"abc\ndef", 4, lspPosition{1, 0}},
+		{"abc\ndef", 7, lspPosition{1, 3}},
+		{"abc\ndef", 100, lspPosition{1, 3}},
+		{"abc\r\ndef", 3, lspPosition{0, 3}},
+		{"abc\r\ndef", 6, lspPosition{1, 1}},
+		{"\n\nx", 2, lspPosition{2, 0}},
+		{"é😀x", 2, lspPosition{0, 1}},
+		{"é😀x", 6, lspPosition{0, 3}},
+		{"é😀x", 7, lspPosition{0, 4}},
+		{"\n\t日本語", 8, lspPosition{1, 3}},
+	}
+	for _, test := range tests {
+		if got := offsetToPosition([]byte(test.text), test.offset); got != test.pos {
+			t.Errorf("offsetToPosition(%q, %d) = %v, want %v", test.text, test.offset, got, test.pos)
+		}
+	}
+}
+
+func TestLineColToPosition(t *testing.T) {
+	text := []byte("package p\n\nvar é, x = 1, \"😀\"\n")
+	var tests = [...]struct {
+		line, col int
+		pos       lspPosition
+	}{
+		{1, 1, lspPosition{0, 0}},
+		{3, 5, lspPosition{2, 4}},
+		// Byte column 9 is after "é," which is 2 UTF-16 units.
+		{3, 9, lspPosition{2, 7}},
+		{3, 22, lspPosition{2, 18}},
+		// Positions outside the text are passed through.
+		{10, 4, lspPosition{9, 3}},
+		// Unknown lines and columns are taken as 1.
+		{0, 0, lspPosition{0, 0}},
+		{3, 0, lspPosition{2, 0}},
+		{0, 3, lspPosition{0, 2}},
+	}
+	for _, test := range tests {
+		if got := lineColToPosition(text, test.line, test.col); got != test.pos {
+			t.Errorf("lineColToPosition(%d, %d) = %v, want %v", test.line, test.col, got, test.pos)
+		}
+	}
+}
+
+// TestPublishMerges checks that publishes requested while the diagnostics
+// of a document are pending are merged into one.
+func TestPublishMerges(t *testing.T) {
+	var out bytes.Buffer
+	filename := filepath.Join(t.TempDir(), "p.go")
+	uri := filenameToURI(filename)
+	s := &lspServer{out: &out, docs: make(map[string]*lspDocument)}
+	s.mu.Lock()
+	for version := 1; version <= 3; version++ {
+		s.docs[uri] = &lspDocument{filename: filename, version: version, text: []byte("package p\n")}
+		s.publish(uri)
+	}
+	s.mu.Unlock()
+
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		n := len(s.publishing)
+		s.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Since(start) > time.Minute {
+			t.Fatal("diagnostics not published")
+		}
+	}
+	got := out.String()
+	if n := strings.Count(got, "textDocument/publishDiagnostics"); n != 1 || !strings.Contains(got, `"version":3`) {
+		t.Errorf("got %d publishes in %s, want 1 of version 3", n, got)
+	}
+}
+
+func TestURIToPath(t *testing.T) {
+	var tests = [...]struct {
+		uri, goos, path string
+		err             bool
+	}{
+		{"file:///home/u/p.go", "linux", "/home/u/p.go", false},
+		{"file:///home/u/my%20dir/p%2Bq.go", "linux", "/home/u/my dir/p+q.go", false},
+		{"file:///C:/dir/p.go", "linux", "/C:/dir/p.go", false},
+		{"file:///C:/dir/p.go", "windows", "C:/dir/p.go", false},
+		{"file:///c%3A/dir/p.go", "windows", "c:/dir/p.go", false},
+		{"file:///c%3A/My%20Documents/p.go", "windows", "c:/My Documents/p.go", false},
+		{"file://server/share/p.go", "windows", "//server/share/p.go", false},
+		{"file://localhost/C:/p.go", "windows", "C:/p.go", false},
+		{"untitled:Untitled-1", "linux", "", true},
+		{"http://example.com/p.go", "linux", "", true},
+	}
+	for _, test := range tests {
+		path, err := uriToPath(test.uri, test.goos)
+		if (err != nil) != test.err || path != test.path {
+			t.Errorf("uriToPath(%q, %s) = %q, %v; want %q, error %v", test.uri, test.goos, path, err, test.path, test.err)
+		}
+	}
+}
+
+func TestFilenameToURI(t *testing.T) {
+	filename := filepath.FromSlash("/home/u/my dir/p.go")
+	uri := filenameToURI(filename)
+	if want := "file:///home/u/my%20dir/p.go"; uri != want {
+		t.Errorf("filenameToURI(%q) = %q, want %q", filename, uri, want)
+	}
+	if back, err := uriToFilename(uri); err != nil || back != filename {
+		t.Errorf("uriToFilename(%q) = %q, %v; want %q", uri, back, err, filename)
+	}
+}
+
+func TestSplitParams(t *testing.T) {
+	var tests = [...]struct {
+		typ    string
+		params []string
+	}{
+		{"func()", nil},
+		{"func() error", nil},
+		{"func(x int)", []string{"x int"}},
+		{"func(x, y int, s ...string) (int, error)", []string{"x", "y int", "s ...string"}},
+		{"func(f func(a, b int) bool, m map[string]struct{ x, y int })", []string{"f func(a, b int) bool", "m map[string]struct{ x, y int }"}},
+		{"func(p [2]interface{ M(int, int) })", []string{"p [2]interface{ M(int, int) }"}},
+		{"func(c chan<- T[int, string])", []string{"c chan<- T[int, string]"}},
+		{"int", nil},
+	}
+	for _, test := range tests {
+		if got := splitParams(test.typ); !reflect.DeepEqual(got, test.params) {
+			t.Errorf("splitParams(%q) = %q, want %q", test.typ, got, test.params)
+		}
+	}
+}
+
+// TestLSPCompletion runs a session of initialize, didOpen and completion
+// requests against a server connected by in-memory pipes.
+func TestLSPCompletion(t *testing.T) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	s := &lspServer{
+		in:   bufio.NewReader(inR),
+		out:  outW,
+		docs: make(map[string]*lspDocument),
+	}
+	go s.run()
+	defer inW.Close()
+
+	// Collect the replies by ID, skipping notifications.
+	replies := make(chan *lspMessage)
+	go func() {
+		client := &lspServer{in: bufio.NewReader(outR)}
+		for {
+			msg, err := client.read()
+			if err != nil {
+				close(replies)
+				return
+			}
+			if msg.ID != nil {
+				replies <- msg
+			}
+		}
+	}()
+	send := func(id int, method string, params interface{}) {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": json.RawMessage(raw)}
+		if id != 0 {
+			msg["id"] = id
+		}
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(inW, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	call := func(id int, method string, params, result interface{}) {
+		t.Helper()
+		send(id, method, params)
+		select {
+		case msg := <-replies:
+			if msg == nil || string(*msg.ID) != fmt.Sprint(id) {
+				t.Fatalf("%s: got reply %+v", method, msg)
+			}
+			if msg.Error != nil {
+				t.Fatalf("%s: %s", method, msg.Error.Message)
+			}
+			raw, _ := json.Marshal(msg.Result)
+			if err := json.Unmarshal(raw, result); err != nil {
+				t.Fatalf("%s: %v", method, err)
+			}
+		case <-time.After(time.Minute):
+			t.Fatalf("%s: no reply", method)
+		}
+	}
+
+	var init struct {
+		Capabilities struct {
+			CompletionProvider *struct{} `json:"completionProvider"`
+		} `json:"capabilities"`
+	}
+	call(1, "initialize", map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"completion": map[string]interface{}{
+					"completionItem": map[string]bool{"snippetSupport": true},
+				},
+			},
+		},
+	}, &init)
+	if init.Capabilities.CompletionProvider == nil {
+		t.Errorf("initialize: no completionProvider in %+v", init)
+	}
+
+	src := "package p\r\n\r\nimport \"fmt\"\r\n\r\n// é😀\r\nfunc _() { fmt.Sprin }\r\n"
+	uri := filenameToURI(filepath.Join(t.TempDir(), "p.go"))
+	send(0, "textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "go", "version": 1, "text": src},
+	})
+
+	var list lspCompletionList
+	col := len("func _() { fmt.Sprin")
+	call(2, "textDocument/completion", lspTextDocumentPositionParams{
+		TextDocument: lspTextDocumentIdentifier{URI: uri},
+		Position:     lspPosition{Line: 5, Character: col},
+	}, &list)
+	var labels []string
+	for _, item := range list.Items {
+		labels = append(labels, item.Label)
+		if item.Label != "Sprintf" {
+			continue
+		}
+		want := lspTextEdit{
+			Range:   lspRange{lspPosition{5, col - len("Sprin")}, lspPosition{5, col}},
+			NewText: "Sprintf(${1:format}, ${2:a...})",
+		}
+		if *item.TextEdit != want || item.InsertTextFormat != lspSnippet {
+			t.Errorf("Sprintf: got edit %+v in format %d, want %+v as a snippet", *item.TextEdit, item.InsertTextFormat, want)
+		}
+	}
+	if got := strings.Join(labels, " "); got != "Sprint Sprintf Sprintln" {
+		t.Errorf("got completions %s, want Sprint Sprintf Sprintln", got)
+	}
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"flag"
 	"fmt"
-	"path/filepath"
+	"os"
 	"syscall"
 	"unsafe"
 )
 
 const defaultSocketType = "tcp"
 
+const errorSharingViolation syscall.Errno = 32
+
 var (
 	kernel32 = syscall.NewLazyDLL("kernel32.dll")
 
@@ -26,3 +27,36 @@ func get_executable_filename() string {
 	}
 	return syscall.UTF16ToString(b)
 }
+
+// lockFile opens path and locks it without blocking. Other processes may
+// still read the file. The lock is released when the file is closed or
+// the process exits.
+func lockFile(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		syscall.FILE_SHARE_READ, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if err == errorSharingViolation {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+// stillActive is the exit code of a process that has not exited.
+const stillActive = 259
+
+// processAlive reports whether a process with the given PID is running.
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	return syscall.GetExitCodeProcess(h, &code) == nil && code == stillActive
+}
@@ -0,0 +1,143 @@
+// Package pkgfiles finds the files making up the package of a file
+// being edited, taking unsaved editor buffers into account.
+package pkgfiles
+
+import (
+	"bytes"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Overlay maps absolute file names to the contents of unsaved editor
+// buffers. Contents in an overlay take precedence over the files on disk,
+// and overlay files need not exist on disk at all.
+type Overlay map[string][]byte
+
+// Source returns the overlay contents of filename in a form suitable for
+// the src argument of go/parser.ParseFile: nil if filename should be read
+// from disk.
+func (o Overlay) Source(filename string) interface{} {
+	if data, ok := o[filename]; ok {
+		return data
+	}
+	return nil
+}
+
+// ReadFile returns the contents of filename, preferring the overlay.
+func (o Overlay) ReadFile(filename string) ([]byte, error) {
+	if data, ok := o[filename]; ok {
+		return data, nil
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// OpenFile opens filename, preferring the overlay. It is suitable for
+// build.Context.OpenFile.
+func (o Overlay) OpenFile(filename string) (io.ReadCloser, error) {
+	if data, ok := o[filename]; ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return os.Open(filename)
+}
+
+// OtherFiles returns the other files in filename's directory that belong
+// to package pkgName and match the build context ctxt, which defaults to
+// build.Default if nil. If tests is true, test files are included when
+// filename is itself a test file.
+func OtherFiles(filename, pkgName string, tests bool, overlay Overlay, ctxt *build.Context) []string {
+	if filename == "" {
+		return nil
+	}
+	bctxt := fileContext(filename, ctxt)
+	bctxt.OpenFile = overlay.OpenFile
+
+	dir, file := filepath.Split(filename)
+	dents, err := ioutil.ReadDir(dir)
+	if err != nil && len(overlay) == 0 {
+		panic(err)
+	}
+	names := make(map[string]bool)
+	for _, dent := range dents {
+		names[dent.Name()] = true
+	}
+	for name := range overlay {
+		if filepath.Dir(name) == filepath.Clean(dir) {
+			names[filepath.Base(name)] = true
+		}
+	}
+	isTestFile := tests && strings.HasSuffix(file, "_test.go")
+
+	var out []string
+	for name := range names {
+		if name == file || !strings.HasSuffix(name, ".go") {
+			continue
+		}
+		if !isTestFile && strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		// MatchFile also rejects names starting with "." or "_".
+		if ok, err := bctxt.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+
+		abspath := filepath.Join(dir, name)
+		if pkgNameFor(abspath, overlay) == pkgName {
+			out = append(out, abspath)
+		}
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// fileContext returns the build context for the package of filename. If
+// the name of filename rules it out in ctxt, such as foo_windows.go on
+// Linux, the GOOS and GOARCH implied by the name are used instead, so
+// that the other files of the package are those for that platform.
+func fileContext(filename string, ctxt *build.Context) build.Context {
+	bctxt := build.Default
+	if ctxt != nil {
+		bctxt = *ctxt
+	}
+	// Only the name of filename counts here; its contents are not
+	// necessarily on disk.
+	bctxt.OpenFile = func(string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("package p\n")), nil
+	}
+	dir, file := filepath.Split(filename)
+	if ok, _ := bctxt.MatchFile(dir, file); ok {
+		return bctxt
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(file, ".go"), "_test")
+	l := strings.Split(name, "_")
+	var tries [][2]string // GOOS, GOARCH
+	if n := len(l); n >= 3 {
+		tries = append(tries, [2]string{l[n-2], l[n-1]})
+	}
+	if n := len(l); n >= 2 {
+		tries = append(tries, [2]string{l[n-1], bctxt.GOARCH}, [2]string{bctxt.GOOS, l[n-1]})
+	}
+	for _, try := range tries {
+		c := bctxt
+		c.GOOS, c.GOARCH = try[0], try[1]
+		if ok, _ := c.MatchFile(dir, file); ok {
+			return c
+		}
+	}
+	return bctxt
+}
+
+func pkgNameFor(filename string, overlay Overlay) string {
+	file, _ := parser.ParseFile(token.NewFileSet(), filename, overlay.Source(filename), parser.PackageClauseOnly)
+	if file == nil || file.Name == nil {
+		return ""
+	}
+	return file.Name.Name
+}
@@ -0,0 +1,108 @@
+package pkgfiles_test
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mdempsky/gocode/pkgfiles"
+)
+
+func TestOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"a.go":         "package p\n",
+		"a_test.go":    "package p\n",
+		"x_test.go":    "package p_test\n",
+		"b_linux.go":   "package p\n",
+		"b_windows.go": "package p\n",
+		"c.go":         "//go:build go1.99\n\npackage p\n",
+		"d.go":         "//go:build custom\n\npackage p\n",
+		"old.go":       "// +build !linux\n\npackage p\n",
+		"g.go":         "package q\n",
+		"_ignored.go":  "package p\n",
+		"doc.txt":      "package p\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	overlay := pkgfiles.Overlay{
+		// Only in the overlay.
+		filepath.Join(dir, "e.go"): []byte("package p\n"),
+		// In another package on disk.
+		filepath.Join(dir, "g.go"): []byte("package p\n"),
+	}
+	linux := build.Default
+	linux.GOOS, linux.GOARCH = "linux", "amd64"
+	linux.BuildTags = nil
+	linux.ReleaseTags = []string{"go1.1", "go1.2"}
+	custom := linux
+	custom.BuildTags = []string{"custom"}
+	future := linux
+	future.ReleaseTags = append(linux.ReleaseTags, "go1.99")
+
+	var tests = [...]struct {
+		file, pkg string
+		tests     bool
+		ctxt      *build.Context
+		want      []string
+	}{
+		{"a.go", "p", false, &linux, []string{"b_linux.go", "e.go", "g.go"}},
+		{"a.go", "p", true, &linux, []string{"b_linux.go", "e.go", "g.go"}},
+		{"a_test.go", "p", true, &linux, []string{"a.go", "b_linux.go", "e.go", "g.go"}},
+		{"a_test.go", "p", false, &linux, []string{"a.go", "b_linux.go", "e.go", "g.go"}},
+		{"x_test.go", "p_test", true, &linux, nil},
+		{"a.go", "p", false, &custom, []string{"b_linux.go", "d.go", "e.go", "g.go"}},
+		{"a.go", "p", false, &future, []string{"b_linux.go", "c.go", "e.go", "g.go"}},
+		// A file for another platform selects the files for that
+		// platform.
+		{"b_windows.go", "p", false, &linux, []string{"a.go", "e.go", "g.go", "old.go"}},
+		// The file being edited need not exist on disk.
+		{"new.go", "p", false, &linux, []string{"a.go", "b_linux.go", "e.go", "g.go"}},
+	}
+	for _, test := range tests {
+		var want []string
+		for _, name := range test.want {
+			want = append(want, filepath.Join(dir, name))
+		}
+		got := pkgfiles.OtherFiles(filepath.Join(dir, test.file), test.pkg, test.tests, overlay, test.ctxt)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("OtherFiles(%s, %s, %v) in %s/%s tags=%v release=%v:\ngot  %v\nwant %v", test.file, test.pkg, test.tests,
+				test.ctxt.GOOS, test.ctxt.GOARCH, test.ctxt.BuildTags, test.ctxt.ReleaseTags[len(test.ctxt.ReleaseTags)-1], got, want)
+		}
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	disk := filepath.Join(dir, "disk.go")
+	if err := os.WriteFile(disk, []byte("disk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unsaved := filepath.Join(dir, "unsaved.go")
+	overlay := pkgfiles.Overlay{unsaved: []byte("unsaved")}
+
+	if src := overlay.Source(disk); src != nil {
+		t.Errorf("Source(%s) = %v, want nil", disk, src)
+	}
+	for filename, want := range map[string]string{disk: "disk", unsaved: "unsaved"} {
+		data, err := overlay.ReadFile(filename)
+		if err != nil || string(data) != want {
+			t.Errorf("ReadFile(%s) = %q, %v; want %q", filename, data, err, want)
+		}
+		f, err := overlay.OpenFile(filename)
+		if err != nil {
+			t.Errorf("OpenFile(%s): %v", filename, err)
+			continue
+		}
+		buf := make([]byte, 16)
+		n, _ := f.Read(buf)
+		f.Close()
+		if string(buf[:n]) != want {
+			t.Errorf("OpenFile(%s) reads %q, want %q", filename, buf[:n], want)
+		}
+	}
+}
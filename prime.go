@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdempsky/gocode/gbimporter"
+	"github.com/mdempsky/gocode/pkgfiles"
+	"github.com/mdempsky/gocode/srcimporter"
+)
+
+type PrimeRequest struct {
+	// Patterns are absolute directories; a directory followed by
+	// "/..." includes its subdirectories, except for vendor and
+	// testdata directories and those starting with "." or "_".
+	Patterns []string
+	Overlay  pkgfiles.Overlay // unsaved contents of files, in any package
+	Context  gbimporter.PackedContext
+	ID       string // optional; allows canceling priming with Server.Cancel
+}
+
+type PrimeReply struct {
+	Job   int
+	Error *RequestError // set if the request failed
+}
+
+type PrimeStatusRequest struct {
+	Job int
+}
+
+type PrimeStatusReply struct {
+	Progress PrimeProgress
+	Error    *RequestError // set if the request failed
+}
+
+// PrimeProgress describes how far a prime job got.
+type PrimeProgress struct {
+	Job      int
+	Patterns []string
+	Dirs     int    // directories to prime; 0 while they are searched for
+	DirsDone int    // directories whose packages have been loaded
+	Imports  int    // distinct packages imported for the directories so far
+	Current  string // directory being primed
+	Elapsed  time.Duration
+	Done     bool
+	Canceled bool
+}
+
+// primeJobKeep is how long the progress of finished prime jobs can be
+// queried.
+const primeJobKeep = time.Minute
+
+var primeJobs = struct {
+	sync.Mutex
+	byID map[int]*PrimeProgress
+	next int
+}{
+	byID: make(map[int]*PrimeProgress),
+}
+
+// Prime starts importing the packages in the given directories, and the
+// packages their tests import, into the shared cache, so that later
+// requests find them loaded already. It returns right away; use
+// PrimeStatus to follow the progress.
+func Prime(req *PrimeRequest, res *PrimeReply) error {
+	var roots []primeRoot
+	for _, pattern := range req.Patterns {
+		dir, recursive := pattern, false
+		if strings.HasSuffix(pattern, "/...") {
+			dir, recursive = strings.TrimSuffix(pattern, "/..."), true
+		}
+		if !filepath.IsAbs(dir) {
+			res.Error = &RequestError{Code: ErrBadRequest, Message: fmt.Sprintf("pattern %q is not an absolute directory", pattern)}
+			return nil
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			res.Error = &RequestError{Code: ErrBadRequest, Message: fmt.Sprintf("pattern %q: no such directory", pattern)}
+			return nil
+		}
+		roots = append(roots, primeRoot{filepath.Clean(dir), recursive})
+	}
+
+	primeJobs.Lock()
+	primeJobs.next++
+	p := &PrimeProgress{Job: primeJobs.next, Patterns: req.Patterns}
+	primeJobs.byID[p.Job] = p
+	primeJobs.Unlock()
+	res.Job = p.Job
+
+	// Priming counts as a running request, so the daemon does not exit
+	// while it is busy.
+	ctx, done := beginRequest("prime", req.ID, "", time.Time{})
+	go func() {
+		defer done()
+		prime(ctx, req, roots, p)
+	}()
+	return nil
+}
+
+func (s *Server) Prime(req *PrimeRequest, res *PrimeReply) error {
+	return Prime(req, res)
+}
+
+func PrimeStatus(req *PrimeStatusRequest, res *PrimeStatusReply) error {
+	primeJobs.Lock()
+	defer primeJobs.Unlock()
+	p := primeJobs.byID[req.Job]
+	if p == nil {
+		res.Error = &RequestError{Code: ErrBadRequest, Message: fmt.Sprintf("unknown prime job %d", req.Job)}
+		return nil
+	}
+	res.Progress = *p
+	return nil
+}
+
+func (s *Server) PrimeStatus(req *PrimeStatusRequest, res *PrimeStatusReply) error {
+	return PrimeStatus(req, res)
+}
+
+// primeProgress returns the progress of the running prime jobs.
+func primeProgress() []PrimeProgress {
+	primeJobs.Lock()
+	defer primeJobs.Unlock()
+	var list []PrimeProgress
+	for _, p := range primeJobs.byID {
+		if !p.Done {
+			list = append(list, *p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Job < list[j].Job })
+	return list
+}
+
+type primeRoot struct {
+	dir       string
+	recursive bool
+}
+
+func prime(ctx context.Context, req *PrimeRequest, roots []primeRoot, p *PrimeProgress) {
+	start := time.Now()
+	update := func(f func()) {
+		primeJobs.Lock()
+		f()
+		p.Elapsed = time.Since(start)
+		primeJobs.Unlock()
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			panicError(err)
+		}
+		update(func() {
+			p.Current = ""
+			p.Done = true
+			p.Canceled = ctx.Err() != nil
+		})
+		time.AfterFunc(primeJobKeep, func() {
+			primeJobs.Lock()
+			delete(primeJobs.byID, p.Job)
+			primeJobs.Unlock()
+		})
+	}()
+
+	var dirs []string
+	for _, root := range roots {
+		dirs = append(dirs, primeDirs(root)...)
+	}
+	update(func() { p.Dirs = len(dirs) })
+
+	imported := map[string]bool{}
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			return
+		}
+		update(func() { p.Current = dir })
+		// Import the package in the directory and the imports of its
+		// tests the way requests for files in the directory would,
+		// eg using its vendor directories, build constraints and the
+		// overlay. Only the directory of the file name matters.
+		imp := newImporter(&req.Context, filepath.Join(dir, "prime.go"), req.Overlay, ctx.Done())
+		pkgPath, imports := srcimporter.DirImports(imp, dir)
+		if pkgPath != "" {
+			imports = append([]string{pkgPath}, imports...)
+		}
+		for _, path := range imports {
+			if path == "C" {
+				continue
+			}
+			if _, err := imp.ImportFrom(path, dir, 0); err != nil && *g_debug {
+				log.Printf("prime: %s: import %q: %v", dir, path, err)
+			}
+			imported[path] = true
+		}
+		update(func() {
+			p.DirsDone++
+			p.Imports = len(imported)
+		})
+	}
+}
+
+// primeDirs returns the directories matched by root.
+func primeDirs(root primeRoot) []string {
+	if !root.recursive {
+		return []string{root.dir}
+	}
+	var dirs []string
+	// Walk follows the root only if it is a symbolic link ending in a
+	// separator.
+	start := root.dir + string(filepath.Separator)
+	filepath.Walk(start, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+		if name := fi.Name(); path != start && (name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, filepath.Clean(path))
+		return nil
+	})
+	return dirs
+}
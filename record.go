@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// record is a request and its reply, as saved by a server started with
+// -record.
+type record struct {
+	Kind    string // "autocomplete", "lookup", "reporterrors" or "analyze"
+	Time    time.Time
+	Request json.RawMessage
+	Reply   json.RawMessage
+}
+
+// recordRequest saves req and res to the -record directory, if any.
+func recordRequest(kind string, req, res interface{}) {
+	if *g_record == "" {
+		return
+	}
+	r := record{Kind: kind, Time: time.Now()}
+	var err error
+	if r.Request, err = json.Marshal(req); err != nil {
+		log.Printf("record: %v", err)
+		return
+	}
+	if r.Reply, err = json.Marshal(res); err != nil {
+		log.Printf("record: %v", err)
+		return
+	}
+	data, err := json.MarshalIndent(&r, "", "\t")
+	if err != nil {
+		log.Printf("record: %v", err)
+		return
+	}
+	// Requests contain source code, so keep them private.
+	name := fmt.Sprintf("%s-%s.json", r.Time.Format("20060102-150405.000000000"), kind)
+	if err := ioutil.WriteFile(filepath.Join(*g_record, name), data, 0600); err != nil {
+		log.Printf("record: %v", err)
+	}
+}
+
+// replay re-executes the request of r and returns the reply.
+func replay(r *record) (interface{}, error) {
+	// The recorded deadline has passed long ago.
+	switch r.Kind {
+	case "autocomplete":
+		var req AutoCompleteRequest
+		var res AutoCompleteReply
+		if err := json.Unmarshal(r.Request, &req); err != nil {
+			return nil, err
+		}
+		req.ID, req.Deadline = "", time.Time{}
+		return &res, AutoComplete(&req, &res)
+	case "lookup":
+		var req LookupRequest
+		var res LookupReply
+		if err := json.Unmarshal(r.Request, &req); err != nil {
+			return nil, err
+		}
+		req.ID, req.Deadline = "", time.Time{}
+		return &res, Lookup(&req, &res)
+	case "reporterrors":
+		var req ReportErrorsRequest
+		var res ReportErrorsReply
+		if err := json.Unmarshal(r.Request, &req); err != nil {
+			return nil, err
+		}
+		req.ID, req.Deadline = "", time.Time{}
+		return &res, ReportErrors(&req, &res)
+	case "analyze":
+		var req AnalyzeRequest
+		var res AnalyzeReply
+		if err := json.Unmarshal(r.Request, &req); err != nil {
+			return nil, err
+		}
+		req.ID, req.Deadline = "", time.Time{}
+		return &res, Analyze(&req, &res)
+	}
+	return nil, fmt.Errorf("unknown request kind %q", r.Kind)
+}
+
+// cmdReplay re-executes the requests recorded in a directory in oneshot
+// mode and reports replies that differ from the recorded ones.
+func cmdReplay() {
+	if flag.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "gocode: replay requires a directory\n")
+		os.Exit(2)
+	}
+	files, err := filepath.Glob(filepath.Join(flag.Arg(1), "*.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(files)
+
+	failed := 0
+	for _, file := range files {
+		if !replayFile(file) {
+			failed++
+		}
+	}
+	fmt.Printf("%d of %d replies differ\n", failed, len(files))
+	if failed != 0 {
+		os.Exit(1)
+	}
+}
+
+func replayFile(file string) bool {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Printf("FAIL %s: %v\n", file, err)
+		return false
+	}
+	var r record
+	if err := json.Unmarshal(data, &r); err != nil {
+		fmt.Printf("FAIL %s: %v\n", file, err)
+		return false
+	}
+	res, err := replay(&r)
+	if err != nil {
+		fmt.Printf("FAIL %s: %v\n", file, err)
+		return false
+	}
+	got, err := json.MarshalIndent(res, "", "\t")
+	if err != nil {
+		fmt.Printf("FAIL %s: %v\n", file, err)
+		return false
+	}
+	var want bytes.Buffer
+	if err := json.Indent(&want, r.Reply, "", "\t"); err != nil {
+		fmt.Printf("FAIL %s: %v\n", file, err)
+		return false
+	}
+	if bytes.Equal(got, want.Bytes()) {
+		fmt.Printf("ok   %s\n", file)
+		return true
+	}
+	fmt.Printf("FAIL %s: reply differs (-recorded +replayed)\n", file)
+	fmt.Print(diffLines(want.String(), string(got)))
+	return false
+}
+
+// diffLines returns the lines removed from a and added in b, prefixed
+// with "-" and "+" respectively.
+func diffLines(a, b string) string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:]
+	// and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			i++
+			j++
+		case j == len(y) || i < len(x) && lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&buf, "-%s\n", x[i])
+			i++
+		default:
+			fmt.Fprintf(&buf, "+%s\n", y[j])
+			j++
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	var tests = [...]struct {
+		a, b string
+		diff string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nb\nc\n", "a\nc\n", "-b\n"},
+		{"a\nc\n", "a\nb\nc\n", "+b\n"},
+		{"a\nb\nc\n", "a\nx\nc\n", "-b\n+x\n"},
+		{"x\na\n", "a\ny\n", "-x\n+y\n"},
+		// The final newline is optional.
+		{"a\nb", "a\nb\n", ""},
+	}
+	for _, test := range tests {
+		if got := diffLines(test.a, test.b); got != test.diff {
+			t.Errorf("diffLines(%q, %q) = %q, want %q", test.a, test.b, got, test.diff)
+		}
+	}
+}
+
+// TestReplay replays the recordings in testdata/replay, which were made
+// with -record from requests about testdata/replay/p/p.go.
+func TestReplay(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "replay", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no recordings")
+	}
+	for _, file := range files {
+		if !replayFile(file) {
+			t.Errorf("%s: replayed reply differs", file)
+		}
+	}
+}
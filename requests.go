@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// inflight tracks running requests so they can be canceled, either
+// explicitly by ID or implicitly by a newer request of the same kind for
+// the same file.
+var inflight = struct {
+	sync.Mutex
+	byID     map[string]*inflightRequest
+	byFile   map[string]*inflightRequest
+	running  int       // number of running requests
+	lastDone time.Time // when the last request finished
+	stats    map[string]*kindStats
+}{
+	byID:     make(map[string]*inflightRequest),
+	byFile:   make(map[string]*inflightRequest),
+	lastDone: time.Now(),
+	stats:    make(map[string]*kindStats),
+}
+
+type inflightRequest struct {
+	key    string
+	cancel context.CancelFunc
+}
+
+// beginRequest registers a request and returns a context that is done
+// when the request is canceled, superseded, or reaches its deadline. The
+// returned func must be called when the request finishes.
+func beginRequest(kind, id, filename string, deadline time.Time) (context.Context, func()) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadline.IsZero() {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	}
+	r := &inflightRequest{key: kind + ":" + filename, cancel: cancel}
+	start := time.Now()
+
+	inflight.Lock()
+	inflight.running++
+	if filename != "" {
+		if old := inflight.byFile[r.key]; old != nil {
+			old.cancel()
+		}
+		inflight.byFile[r.key] = r
+	}
+	if id != "" {
+		if old := inflight.byID[id]; old != nil {
+			old.cancel()
+		}
+		inflight.byID[id] = r
+	}
+	inflight.Unlock()
+
+	return ctx, func() {
+		inflight.Lock()
+		inflight.running--
+		inflight.lastDone = time.Now()
+		st := kindStatsFor(kind)
+		st.add(inflight.lastDone.Sub(start), ctx.Err() != nil)
+		if inflight.byFile[r.key] == r {
+			delete(inflight.byFile, r.key)
+		}
+		if id != "" && inflight.byID[id] == r {
+			delete(inflight.byID, id)
+		}
+		inflight.Unlock()
+		r.cancel()
+	}
+}
+
+// cancelRequest cancels the running request with the given ID and
+// reports whether there was one.
+func cancelRequest(id string) bool {
+	inflight.Lock()
+	defer inflight.Unlock()
+	r := inflight.byID[id]
+	if r == nil {
+		return false
+	}
+	r.cancel()
+	return true
+}
+
+// idleTime returns how long no request has been running.
+func idleTime() time.Duration {
+	inflight.Lock()
+	defer inflight.Unlock()
+	if inflight.running > 0 {
+		return 0
+	}
+	return time.Since(inflight.lastDone)
+}
+
+// countTimeout records that a long poll of the given kind ended because
+// its timeout passed without news.
+func countTimeout(kind string) {
+	inflight.Lock()
+	defer inflight.Unlock()
+	kindStatsFor(kind).timedOut++
+}
+
+// kindStatsFor returns the statistics of the given kind of request.
+// inflight must be locked.
+func kindStatsFor(kind string) *kindStats {
+	st := inflight.stats[kind]
+	if st == nil {
+		st = &kindStats{}
+		inflight.stats[kind] = st
+	}
+	return st
+}
+
+// latencyWindow is the number of recent latencies kept per request kind.
+const latencyWindow = 1000
+
+// kindStats collects statistics about requests of one kind.
+type kindStats struct {
+	count     int
+	canceled  int
+	timedOut  int
+	latencies []time.Duration // ring buffer of the most recent latencies
+	next      int
+}
+
+func (st *kindStats) add(latency time.Duration, canceled bool) {
+	st.count++
+	if canceled {
+		st.canceled++
+	}
+	if len(st.latencies) < latencyWindow {
+		st.latencies = append(st.latencies, latency)
+		return
+	}
+	st.latencies[st.next] = latency
+	st.next = (st.next + 1) % latencyWindow
+}
+
+// RequestStats summarizes the requests of one kind served so far.
+// Percentiles are computed over the most recent requests.
+type RequestStats struct {
+	Kind     string
+	Count    int
+	Canceled int
+	TimedOut int // long polls that ended without news
+	P50      time.Duration
+	P90      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// requestStats returns statistics for each kind of request, sorted by
+// kind.
+func requestStats() []RequestStats {
+	inflight.Lock()
+	defer inflight.Unlock()
+	var stats []RequestStats
+	for kind, st := range inflight.stats {
+		lat := append([]time.Duration(nil), st.latencies...)
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		percentile := func(p int) time.Duration {
+			return lat[(len(lat)-1)*p/100]
+		}
+		stats = append(stats, RequestStats{
+			Kind:     kind,
+			Count:    st.count,
+			Canceled: st.canceled,
+			TimedOut: st.timedOut,
+			P50:      percentile(50),
+			P90:      percentile(90),
+			P99:      percentile(99),
+			Max:      lat[len(lat)-1],
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Kind < stats[j].Kind })
+	return stats
+}
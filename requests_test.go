@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBeginRequestSupersedes checks that a request cancels the running one
+// of the same kind for the same file, and only that one.
+func TestBeginRequestSupersedes(t *testing.T) {
+	hover, doneHover := beginRequest("hover", "", "a.go", time.Time{})
+	defer doneHover()
+	definition, doneDefinition := beginRequest("definition", "", "a.go", time.Time{})
+	defer doneDefinition()
+	other, doneOther := beginRequest("hover", "", "b.go", time.Time{})
+	defer doneOther()
+	if hover.Err() != nil || definition.Err() != nil || other.Err() != nil {
+		t.Fatal("requests of other kinds or files canceled each other")
+	}
+
+	_, doneNewer := beginRequest("hover", "", "a.go", time.Time{})
+	defer doneNewer()
+	if hover.Err() == nil {
+		t.Error("older hover of a.go not canceled")
+	}
+	if definition.Err() != nil || other.Err() != nil {
+		t.Error("newer hover of a.go canceled other requests")
+	}
+}
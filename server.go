@@ -2,18 +2,21 @@ package main
 
 import (
 	"bytes"
-	"fmt"
+	"go/build"
 	"go/types"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
 	"os/signal"
-	"runtime/debug"
+	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/mdempsky/gocode/check"
 	"github.com/mdempsky/gocode/gbimporter"
 	"github.com/mdempsky/gocode/lookup"
+	"github.com/mdempsky/gocode/pkgfiles"
 	"github.com/mdempsky/gocode/reporterrors"
 	"github.com/mdempsky/gocode/srcimporter"
 	"github.com/mdempsky/gocode/suggest"
@@ -24,23 +27,75 @@ func doServer() {
 	if *g_sock == "unix" {
 		addr = getSocketPath()
 	}
+	sockPerm, err := strconv.ParseUint(*g_sockperm, 8, 32)
+	if err != nil {
+		log.Fatalf("invalid -sockperm: %v", err)
+	}
+
+	if *g_record != "" {
+		if err := os.MkdirAll(*g_record, 0700); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	serverBinary = binaryID()
+	if err := lockDaemon(); err == errLocked {
+		log.Fatalf("gocode daemon already running (pid %d)", daemonPID())
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	if *g_sock == "unix" {
+		// We hold the lock, so a socket left behind belongs to a
+		// daemon that died without cleaning up.
+		_ = os.Remove(addr)
+	}
 
 	lis, err := net.Listen(*g_sock, addr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *g_sock == "unix" {
+		if err := os.Chmod(addr, os.FileMode(sockPerm)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Clients retry until the token is written.
+	token, err := newToken()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, os.Interrupt)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sigs
 		exitServer()
 	}()
+	if *g_idle > 0 {
+		go exitWhenIdle(*g_idle)
+	}
 
 	if err = rpc.Register(&Server{}); err != nil {
 		log.Fatal(err)
 	}
-	rpc.Accept(lis)
+	acceptAuthenticated(lis, token)
+}
+
+// exitWhenIdle exits the server once no request has been running for the
+// given duration.
+func exitWhenIdle(timeout time.Duration) {
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		if idleTime() >= timeout {
+			if *g_debug {
+				log.Printf("Idle for %v, exiting", timeout)
+			}
+			exitServer()
+		}
+	}
 }
 
 func exitServer() {
@@ -56,34 +111,50 @@ type Server struct {
 type AutoCompleteRequest struct {
 	Filename string
 	Data     []byte
+	Overlay  pkgfiles.Overlay // unsaved contents of other files, in any package
 	Cursor   int
 	Context  gbimporter.PackedContext
 	Filter   bool
+	Snippets bool      // compute the snippets of the candidates
+	ID       string    // optional; allows canceling the request with Server.Cancel
+	Deadline time.Time // optional; partial results are returned once it passes
 }
 
 type AutoCompleteReply struct {
 	Candidates []suggest.Candidate
 	Len        int
+	Canceled   bool          // request was canceled or timed out; results may be incomplete
+	Error      *RequestError // set if the request failed
 }
 
-func newImporter(ctx *gbimporter.PackedContext, filename string) types.ImporterFrom {
+func newImporter(ctx *gbimporter.PackedContext, filename string, overlay pkgfiles.Overlay, done <-chan struct{}) types.ImporterFrom {
+	noteContext(ctx)
 	if *g_importsrc {
-		return srcimporter.New(ctx, filename)
+		return srcimporter.New(ctx, filename, overlay, done)
 	} else {
 		return gbimporter.New(ctx, filename)
 	}
 }
+
+// buildContext returns the build context that selects the files of the
+// package being edited. Its release tags are those that srcimporter
+// selects the files of imported packages by.
+func buildContext(ctx *gbimporter.PackedContext) *build.Context {
+	c := gbimporter.UnpackContext(ctx)
+	c.ReleaseTags = srcimporter.ReleaseTags(ctx)
+	return c
+}
+
 func AutoComplete(req *AutoCompleteRequest, res *AutoCompleteReply) error {
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Printf("panic: %s\n\n", err)
-			debug.PrintStack()
-
-			res.Candidates = []suggest.Candidate{
-				{Class: "PANIC", Name: "PANIC", Type: "PANIC"},
-			}
+			res.Candidates, res.Len = nil, 0
+			res.Error = panicError(err)
 		}
 	}()
+	if res.Error = checkCursor(req.Data, req.Cursor); res.Error != nil {
+		return nil
+	}
 	if *g_debug {
 		var buf bytes.Buffer
 		log.Printf("Got autocompletion request for '%s'\n", req.Filename)
@@ -96,9 +167,11 @@ func AutoComplete(req *AutoCompleteRequest, res *AutoCompleteReply) error {
 		log.Println("-------------------------------------------------------")
 	}
 	now := time.Now()
-	imp := newImporter(&req.Context, req.Filename)
+	ctx, done := beginRequest("autocomplete", req.ID, req.Filename, req.Deadline)
+	defer done()
+	imp := newImporter(&req.Context, req.Filename, req.Overlay, ctx.Done())
 
-	candidates, d := suggest.New(*g_debug).Suggest(imp, req.Filename, req.Data, req.Cursor, req.Filter)
+	candidates, d := suggest.New(*g_debug, req.Snippets).Suggest(imp, req.Filename, req.Data, req.Cursor, req.Overlay, buildContext(&req.Context), req.Filter)
 	elapsed := time.Since(now)
 	if *g_debug {
 		log.Printf("Elapsed duration: %v\n", elapsed)
@@ -111,43 +184,66 @@ func AutoComplete(req *AutoCompleteRequest, res *AutoCompleteReply) error {
 		log.Println("=======================================================")
 	}
 	res.Candidates, res.Len = candidates, d
+	res.Canceled = ctx.Err() != nil
 	return nil
 }
 func (s *Server) AutoComplete(req *AutoCompleteRequest, res *AutoCompleteReply) error {
-	return AutoComplete(req, res)
+	err := AutoComplete(req, res)
+	recordRequest("autocomplete", req, res)
+	return err
 }
 
 type ReportErrorsRequest struct {
 	Filename string
 	Data     []byte
+	Overlay  pkgfiles.Overlay // unsaved contents of other files, in any package
 	Context  gbimporter.PackedContext
+	ID       string    // optional; allows canceling the request with Server.Cancel
+	Deadline time.Time // optional; partial results are returned once it passes
 }
 
 type ReportErrorsReply struct {
-	Errors []reporterrors.Error
+	Errors   []reporterrors.Error
+	Canceled bool          // request was canceled or timed out; results may be incomplete
+	Error    *RequestError // set if the request failed
 }
 
 func ReportErrors(req *ReportErrorsRequest, res *ReportErrorsReply) error {
+	return reportErrors("reporterrors", req, res)
+}
+
+// reportErrors serves ReportErrors as a request of the given kind, so
+// that it neither cancels nor gets canceled by requests of other kinds
+// for the same file.
+func reportErrors(kind string, req *ReportErrorsRequest, res *ReportErrorsReply) error {
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Printf("panic: %s\n\n", err)
-			debug.PrintStack()
 			res.Errors = nil
+			res.Error = panicError(err)
 		}
 	}()
-	imp := newImporter(&req.Context, req.Filename)
-	res.Errors = reporterrors.Report(imp, req.Filename, req.Data)
+	ctx, done := beginRequest(kind, req.ID, req.Filename, req.Deadline)
+	defer done()
+	imp := newImporter(&req.Context, req.Filename, req.Overlay, ctx.Done())
+	res.Errors = reporterrors.Report(imp, req.Filename, req.Data, req.Overlay, buildContext(&req.Context))
+	res.Canceled = ctx.Err() != nil
 	return nil
 }
 func (s *Server) ReportErrors(req *ReportErrorsRequest, res *ReportErrorsReply) error {
-	return ReportErrors(req, res)
+	err := ReportErrors(req, res)
+	recordRequest("reporterrors", req, res)
+	return err
 }
 
 type LookupRequest struct {
 	Filename string
 	Data     []byte
+	Overlay  pkgfiles.Overlay // unsaved contents of other files, in any package
 	Cursor   int
 	Context  gbimporter.PackedContext
+	Kind     string    // optional; a newer request of the same kind for the same file supersedes it; "lookup" by default
+	ID       string    // optional; allows canceling the request with Server.Cancel
+	Deadline time.Time // optional; partial results are returned once it passes
 }
 
 type LookupInfo struct {
@@ -161,8 +257,10 @@ type LookupInfo struct {
 	CallArg int
 }
 type LookupReply struct {
-	Cursor LookupInfo // ident at cursor
-	Call   LookupInfo // call at cursor
+	Cursor   LookupInfo    // ident at cursor
+	Call     LookupInfo    // call at cursor
+	Canceled bool          // request was canceled or timed out; results may be incomplete
+	Error    *RequestError // set if the request failed
 }
 
 func ToLookupInfo(lu lookup.Result) LookupInfo {
@@ -178,16 +276,141 @@ func ToLookupInfo(lu lookup.Result) LookupInfo {
 	return li
 }
 func Lookup(req *LookupRequest, res *LookupReply) error {
-	imp := newImporter(&req.Context, req.Filename)
+	defer func() {
+		if err := recover(); err != nil {
+			res.Cursor, res.Call = LookupInfo{}, LookupInfo{}
+			res.Error = panicError(err)
+		}
+	}()
+	if res.Error = checkCursor(req.Data, req.Cursor); res.Error != nil {
+		return nil
+	}
+	kind := req.Kind
+	if kind == "" {
+		kind = "lookup"
+	}
+	ctx, done := beginRequest(kind, req.ID, req.Filename, req.Deadline)
+	defer done()
+	imp := newImporter(&req.Context, req.Filename, req.Overlay, ctx.Done())
 
-	lu, call := lookup.Lookup(imp, req.Filename, req.Data, req.Cursor)
+	lu, call := lookup.Lookup(imp, req.Filename, req.Data, req.Cursor, req.Overlay, buildContext(&req.Context))
 	res.Cursor = ToLookupInfo(lu)
 	res.Call = ToLookupInfo(call)
+	res.Canceled = ctx.Err() != nil
 	return nil
 }
 
 func (s *Server) Lookup(req *LookupRequest, res *LookupReply) error {
-	return Lookup(req, res)
+	err := Lookup(req, res)
+	recordRequest("lookup", req, res)
+	return err
+}
+
+type AnalyzeRequest struct {
+	Filename string
+	Data     []byte
+	Overlay  pkgfiles.Overlay // unsaved contents of other files, in any package
+	Cursor   int
+	Context  gbimporter.PackedContext
+	Filter   bool
+	Snippets bool      // compute the snippets of the candidates
+	Complete bool      // compute completion candidates at the cursor
+	Lookup   bool      // look up the ident and call at the cursor
+	Errors   bool      // report the errors in the file
+	ID       string    // optional; allows canceling the request with Server.Cancel
+	Deadline time.Time // optional; partial results are returned once it passes
+}
+
+type AnalyzeReply struct {
+	Candidates []suggest.Candidate // if Complete was requested
+	Len        int
+	Cursor     LookupInfo           // if Lookup was requested
+	Call       LookupInfo           // if Lookup was requested
+	Errors     []reporterrors.Error // if Errors was requested
+	Canceled   bool                 // request was canceled or timed out; results may be incomplete
+	Error      *RequestError        // set if the request failed
+}
+
+// Analyze type-checks the file once and computes the requested results
+// from it, which is cheaper than separate AutoComplete, Lookup and
+// ReportErrors requests. As with those, the other test files of a test
+// file are only checked for completion and lookup; errors then cover
+// them too.
+func Analyze(req *AnalyzeRequest, res *AnalyzeReply) error {
+	defer func() {
+		if err := recover(); err != nil {
+			*res = AnalyzeReply{Error: panicError(err)}
+		}
+	}()
+	if req.Complete || req.Lookup {
+		if res.Error = checkCursor(req.Data, req.Cursor); res.Error != nil {
+			return nil
+		}
+	}
+	ctx, done := beginRequest("analyze", req.ID, req.Filename, req.Deadline)
+	defer done()
+	imp := newImporter(&req.Context, req.Filename, req.Overlay, ctx.Done())
+
+	p := check.Check(imp, req.Filename, req.Data, req.Overlay, buildContext(&req.Context), req.Complete || req.Lookup)
+	if req.Complete {
+		res.Candidates, res.Len = suggest.New(*g_debug, req.Snippets).SuggestPackage(imp, p, req.Data, req.Cursor, req.Filter)
+	}
+	if req.Lookup {
+		lu, call := lookup.LookupPackage(imp, p, req.Cursor)
+		res.Cursor = ToLookupInfo(lu)
+		res.Call = ToLookupInfo(call)
+	}
+	if req.Errors {
+		res.Errors = reporterrors.ReportPackage(p)
+	}
+	res.Canceled = ctx.Err() != nil
+	return nil
+}
+
+func (s *Server) Analyze(req *AnalyzeRequest, res *AnalyzeReply) error {
+	err := Analyze(req, res)
+	recordRequest("analyze", req, res)
+	return err
+}
+
+type CancelRequest struct {
+	ID string
+}
+
+type CancelReply struct {
+	Canceled bool // a request with the ID was running
+}
+
+func (s *Server) Cancel(req *CancelRequest, res *CancelReply) error {
+	res.Canceled = cancelRequest(req.ID)
+	return nil
+}
+
+// protocolVersion must be incremented whenever the request or reply types
+// change, so that clients replace daemons speaking an older protocol.
+const protocolVersion = 12
+
+// serverBinary identifies the binary the daemon was started from.
+var serverBinary string
+
+type HandshakeRequest struct {
+	Protocol int
+	Binary   string
+}
+
+type HandshakeReply struct {
+	Protocol int
+	Binary   string
+	Version  string
+	PID      int
+}
+
+func (s *Server) Handshake(req *HandshakeRequest, res *HandshakeReply) error {
+	res.Protocol = protocolVersion
+	res.Binary = serverBinary
+	res.Version = gocodeVersion()
+	res.PID = os.Getpid()
+	return nil
 }
 
 type ExitRequest struct{}
@@ -2,12 +2,21 @@ package srcimporter
 
 import (
 	"bytes"
+	"fmt"
+	"go/build/constraint"
+	"io/ioutil"
 	"os"
 	pathpkg "path"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/mdempsky/gocode/gbimporter"
 )
 
 // This code was hacked out of go/build.
@@ -30,13 +39,7 @@ func defaultContext() Context {
 	c.GOROOT = pathpkg.Clean(runtime.GOROOT())
 	c.GOPATH = envOr("GOPATH", "")
 	c.Compiler = runtime.Compiler
-
-	// Each major Go release in the Go 1.x series should add a tag here.
-	// Old tags should not be removed. That is, the go1.x tag is present
-	// in all releases >= Go 1.x. Code that requires Go 1.x or later should
-	// say "+build go1.x", and code that should only be built before Go 1.x
-	// (perhaps it is the stub to use in that case) should say "+build !go1.x".
-	c.ReleaseTags = []string{"go1.1", "go1.2", "go1.3", "go1.4", "go1.5", "go1.6"}
+	c.ReleaseTags = releaseTags(c.GOROOT)
 
 	switch os.Getenv("CGO_ENABLED") {
 	case "1":
@@ -55,6 +58,68 @@ func defaultContext() Context {
 	return c
 }
 
+var gReleaseTags sync.Map // GOROOT -> []string
+
+// releaseTags returns the release tags of the Go release in goroot: the
+// go1.x tags of all releases it is compatible with. It falls back to the
+// release gocode was built with if the release cannot be determined.
+func releaseTags(goroot string) []string {
+	if tags, ok := gReleaseTags.Load(goroot); ok {
+		return tags.([]string)
+	}
+	minor := goMinorVersion(goroot)
+	if minor == 0 {
+		minor = goMinorVersion(runtime.GOROOT())
+	}
+	var tags []string
+	for i := 1; i <= minor; i++ {
+		tags = append(tags, "go1."+strconv.Itoa(i))
+	}
+	gReleaseTags.Store(goroot, tags)
+	return tags
+}
+
+var goversionRE = regexp.MustCompile(`(?m)^const Version = (\d+)`)
+
+var gGoMinorVersions sync.Map // GOROOT -> int
+
+// goMinorVersion returns x for the Go 1.x release in goroot, or 0 if it
+// cannot be determined. It is read once per GOROOT, since every request
+// needs it.
+func goMinorVersion(goroot string) int {
+	if n, ok := gGoMinorVersions.Load(goroot); ok {
+		return n.(int)
+	}
+	n := readGoMinorVersion(goroot)
+	gGoMinorVersions.Store(goroot, n)
+	return n
+}
+
+func readGoMinorVersion(goroot string) int {
+	if goroot == "" {
+		return 0
+	}
+	// Development versions have no VERSION file, but all versions
+	// since Go 1.9 have goversion.go.
+	data, err := ioutil.ReadFile(filepath.Join(goroot, "src", "internal", "goversion", "goversion.go"))
+	if err == nil {
+		if m := goversionRE.FindSubmatch(data); m != nil {
+			n, _ := strconv.Atoi(string(m[1]))
+			return n
+		}
+	}
+	data, err = ioutil.ReadFile(filepath.Join(goroot, "VERSION"))
+	if err == nil && bytes.HasPrefix(data, []byte("go1.")) {
+		v := string(data[len("go1."):])
+		if i := strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+			v = v[:i]
+		}
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
 // A Context specifies the supporting context for a build.
 type Context struct {
 	GOARCH      string // target architecture
@@ -62,11 +127,11 @@ type Context struct {
 	GOROOT      string // Go root
 	GOPATH      string // Go path
 	CgoEnabled  bool   // whether cgo can be used
-	UseAllFiles bool   // use files regardless of +build lines, file names
+	UseAllFiles bool   // use files regardless of build constraints, file names
 	Compiler    string // compiler to assume when computing target paths
 
 	// The build and release tags specify build constraints
-	// that should be considered satisfied when processing +build lines.
+	// that should be considered satisfied when processing build lines.
 	// Clients creating a new context may customize BuildTags, which
 	// defaults to empty, but it is usually an error to customize ReleaseTags,
 	// which defaults to the list of Go releases the current release is compatible with.
@@ -84,22 +149,66 @@ type Context struct {
 	InstallSuffix string
 }
 
+// buildContext returns the context for the packed context of a request.
+// Its release tags are those of the request's GOROOT, which need not be
+// the release the client was built with.
+func buildContext(ctx *gbimporter.PackedContext) Context {
+	c := Context{
+		GOARCH:        ctx.GOARCH,
+		GOOS:          ctx.GOOS,
+		GOROOT:        ctx.GOROOT,
+		GOPATH:        ctx.GOPATH,
+		CgoEnabled:    ctx.CgoEnabled,
+		UseAllFiles:   ctx.UseAllFiles,
+		Compiler:      ctx.Compiler,
+		BuildTags:     ctx.BuildTags,
+		InstallSuffix: ctx.InstallSuffix,
+	}
+	c.ReleaseTags = ReleaseTags(ctx)
+	return c
+}
+
+// ReleaseTags returns the release tags that files are selected by in the
+// packed context of a request: those of the Go release in its GOROOT, or
+// if that cannot be determined, the context's own.
+func ReleaseTags(ctx *gbimporter.PackedContext) []string {
+	switch {
+	case goMinorVersion(ctx.GOROOT) != 0:
+		return releaseTags(ctx.GOROOT)
+	case len(ctx.ReleaseTags) != 0:
+		return ctx.ReleaseTags
+	}
+	return defBuildContext.ReleaseTags
+}
+
+// key identifies the settings of ctxt that affect which files are built.
+func (ctxt *Context) key() string {
+	key := fmt.Sprintf("%s/%s cgo=%v tags=%s", ctxt.GOOS, ctxt.GOARCH, ctxt.CgoEnabled, strings.Join(ctxt.BuildTags, ","))
+	if n := len(ctxt.ReleaseTags); n > 0 {
+		key += " release=" + ctxt.ReleaseTags[n-1]
+	}
+	if ctxt.UseAllFiles {
+		key += " all"
+	}
+	return key
+}
+
 // goodOSArchFile returns false if the name contains a $GOOS or $GOARCH
 // suffix which does not match the current system.
 // The recognized name formats are:
 //
-//     name_$(GOOS).*
-//     name_$(GOARCH).*
-//     name_$(GOOS)_$(GOARCH).*
-//     name_$(GOOS)_test.*
-//     name_$(GOARCH)_test.*
-//     name_$(GOOS)_$(GOARCH)_test.*
+//	name_$(GOOS).*
+//	name_$(GOARCH).*
+//	name_$(GOOS)_$(GOARCH).*
+//	name_$(GOOS)_test.*
+//	name_$(GOARCH)_test.*
+//	name_$(GOOS)_$(GOARCH)_test.*
 //
-// An exception: if GOOS=android, then files with GOOS=linux are also matched.
+// Exceptions: if GOOS=android, then files with GOOS=linux are also matched;
+// ios matches darwin and illumos matches solaris the same way.
 func (ctxt *Context) goodOSArchFile(name string, allTags map[string]bool) bool {
-	if dot := strings.Index(name, "."); dot != -1 {
-		name = name[:dot]
-	}
+	name, _, _ = strings.Cut(name, ".")
+
 	// Before Go 1.4, a file called "linux.go" would be equivalent to having a
 	// build tag "linux" in that file. For Go 1.4 and beyond, we require this
 	// auto-tagging to apply only to files with a non-empty prefix, so
@@ -118,40 +227,18 @@ func (ctxt *Context) goodOSArchFile(name string, allTags map[string]bool) bool {
 		l = l[:n-1]
 	}
 	n := len(l)
-
 	if n >= 2 && knownOS[l[n-2]] && knownArch[l[n-1]] {
-		if allTags != nil {
-			allTags[l[n-2]] = true
-			allTags[l[n-1]] = true
-		}
-		if l[n-1] != ctxt.GOARCH {
-			return false
-		}
-		if ctxt.GOOS == "android" && l[n-2] == "linux" {
-			return true
-		}
-		return l[n-2] == ctxt.GOOS
+		return ctxt.matchTag(l[n-1], allTags) && ctxt.matchTag(l[n-2], allTags)
 	}
-	if n >= 1 && knownOS[l[n-1]] {
-		if allTags != nil {
-			allTags[l[n-1]] = true
-		}
-		if ctxt.GOOS == "android" && l[n-1] == "linux" {
-			return true
-		}
-		return l[n-1] == ctxt.GOOS
-	}
-	if n >= 1 && knownArch[l[n-1]] {
-		if allTags != nil {
-			allTags[l[n-1]] = true
-		}
-		return l[n-1] == ctxt.GOARCH
+	if n >= 1 && (knownOS[l[n-1]] || knownArch[l[n-1]]) {
+		return ctxt.matchTag(l[n-1], allTags)
 	}
 	return true
 }
 
 var knownOS = make(map[string]bool)
 var knownArch = make(map[string]bool)
+var unixOS = make(map[string]bool)
 
 func init() {
 	for _, v := range strings.Fields(goosList) {
@@ -160,26 +247,33 @@ func init() {
 	for _, v := range strings.Fields(goarchList) {
 		knownArch[v] = true
 	}
+	for _, v := range strings.Fields(unixList) {
+		unixOS[v] = true
+	}
 }
 
-const goosList = "android darwin dragonfly freebsd linux nacl netbsd openbsd plan9 solaris windows "
-const goarchList = "386 amd64 amd64p32 arm armbe arm64 arm64be ppc64 ppc64le mips mipsle mips64 mips64le mips64p32 mips64p32le ppc s390 s390x sparc sparc64 "
+// The lists of go/build, including ports that were removed since, so
+// that their files are still recognized.
+const goosList = "aix android darwin dragonfly freebsd hurd illumos ios js linux nacl netbsd openbsd plan9 solaris wasip1 windows zos "
+const goarchList = "386 amd64 amd64p32 arm armbe arm64 arm64be loong64 mips mipsle mips64 mips64le mips64p32 mips64p32le ppc ppc64 ppc64le riscv riscv64 s390 s390x sparc sparc64 wasm "
 
-var slashslash = []byte("//")
+// unixList lists the GOOS values satisfying the "unix" build tag.
+const unixList = "aix android darwin dragonfly freebsd hurd illumos ios linux netbsd openbsd solaris "
 
-// shouldBuild reports whether it is okay to use this file,
+// shouldBuild reports whether it is okay to use this file.
 // The rule is that in the file's leading run of // comments
 // and blank lines, which must be followed by a blank line
 // (to avoid including a Go package clause doc comment),
-// lines beginning with '// +build' are taken as build directives.
+// a //go:build line is taken as the build constraint of the file.
+// Files without one may use // +build lines instead; each of them
+// must be satisfied.
 //
-// The file is accepted only if each such line lists something
-// matching the file.  For example:
+// For example, both of
 //
+//	//go:build windows || linux
 //	// +build windows linux
 //
-// marks the file as applicable only on Windows and Linux.
-//
+// mark the file as applicable only on Windows and Linux.
 func (ctxt *Context) shouldBuild(content []byte, allTags map[string]bool) bool {
 	// Pass 1. Identify leading run of // comments and blank lines,
 	// which must be followed by a blank line.
@@ -197,15 +291,16 @@ func (ctxt *Context) shouldBuild(content []byte, allTags map[string]bool) bool {
 			end = len(content) - len(p)
 			continue
 		}
-		if !bytes.HasPrefix(line, slashslash) { // Not comment line
+		if !bytes.HasPrefix(line, slashSlash) { // Not comment line
 			break
 		}
 	}
 	content = content[:end]
 
-	// Pass 2.  Process each line in the run.
+	// Pass 2. Collect the constraints in the run.
+	var goBuild constraint.Expr
+	var plusBuild []constraint.Expr
 	p = content
-	allok := true
 	for len(p) > 0 {
 		line := p
 		if i := bytes.IndexByte(line, '\n'); i >= 0 {
@@ -213,62 +308,47 @@ func (ctxt *Context) shouldBuild(content []byte, allTags map[string]bool) bool {
 		} else {
 			p = p[len(p):]
 		}
-		line = bytes.TrimSpace(line)
-		if bytes.HasPrefix(line, slashslash) {
-			line = bytes.TrimSpace(line[len(slashslash):])
-			if len(line) > 0 && line[0] == '+' {
-				// Looks like a comment +line.
-				f := strings.Fields(string(line))
-				if f[0] == "+build" {
-					ok := false
-					for _, tok := range f[1:] {
-						if ctxt.match(tok, allTags) {
-							ok = true
-						}
-					}
-					if !ok {
-						allok = false
-					}
-				}
+		text := string(bytes.TrimSpace(line))
+		switch {
+		case constraint.IsGoBuild(text):
+			x, err := constraint.Parse(text)
+			if err != nil || goBuild != nil {
+				// Like the go command, reject files with
+				// malformed or repeated //go:build lines.
+				return false
+			}
+			goBuild = x
+		case constraint.IsPlusBuild(text):
+			if x, err := constraint.Parse(text); err == nil {
+				plusBuild = append(plusBuild, x)
 			}
 		}
 	}
 
+	ok := func(tag string) bool { return ctxt.matchTag(tag, allTags) }
+	if goBuild != nil {
+		return goBuild.Eval(ok)
+	}
+	allok := true
+	for _, x := range plusBuild {
+		// Evaluate all lines so that allTags sees every tag.
+		if !x.Eval(ok) {
+			allok = false
+		}
+	}
 	return allok
 }
 
-// match reports whether the name is one of:
+// matchTag reports whether the tag name is satisfied by ctxt:
 //
-//	$GOOS
+//	$GOOS, or unix if $GOOS is a Unix system
 //	$GOARCH
 //	cgo (if cgo is enabled)
-//	!cgo (if cgo is disabled)
 //	ctxt.Compiler
-//	!ctxt.Compiler
 //	tag (if tag is listed in ctxt.BuildTags or ctxt.ReleaseTags)
-//	!tag (if tag is not listed in ctxt.BuildTags or ctxt.ReleaseTags)
-//	a comma-separated list of any of these
 //
-func (ctxt *Context) match(name string, allTags map[string]bool) bool {
-	if name == "" {
-		if allTags != nil {
-			allTags[name] = true
-		}
-		return false
-	}
-	if i := strings.Index(name, ","); i >= 0 {
-		// comma-separated list
-		ok1 := ctxt.match(name[:i], allTags)
-		ok2 := ctxt.match(name[i+1:], allTags)
-		return ok1 && ok2
-	}
-	if strings.HasPrefix(name, "!!") { // bad syntax, reject always
-		return false
-	}
-	if strings.HasPrefix(name, "!") { // negation
-		return len(name) > 1 && !ctxt.match(name[1:], allTags)
-	}
-
+// Negations and other operators are handled by the caller.
+func (ctxt *Context) matchTag(name string, allTags map[string]bool) bool {
 	if allTags != nil {
 		allTags[name] = true
 	}
@@ -291,6 +371,15 @@ func (ctxt *Context) match(name string, allTags map[string]bool) bool {
 	if ctxt.GOOS == "android" && name == "linux" {
 		return true
 	}
+	if ctxt.GOOS == "illumos" && name == "solaris" {
+		return true
+	}
+	if ctxt.GOOS == "ios" && name == "darwin" {
+		return true
+	}
+	if name == "unix" && unixOS[ctxt.GOOS] {
+		return true
+	}
 
 	// other tags
 	for _, tag := range ctxt.BuildTags {
@@ -0,0 +1,160 @@
+package srcimporter
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mdempsky/gocode/gbimporter"
+)
+
+func TestShouldBuild(t *testing.T) {
+	ctxt := &Context{
+		GOOS:        "linux",
+		GOARCH:      "amd64",
+		CgoEnabled:  true,
+		Compiler:    "gc",
+		BuildTags:   []string{"custom"},
+		ReleaseTags: []string{"go1.1", "go1.2", "go1.21"},
+	}
+	var tests = [...]struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"none", "package p\n", true},
+		{"go:build", "//go:build linux\n\npackage p\n", true},
+		{"go:build negated", "//go:build !linux\n\npackage p\n", false},
+		{"go:build or", "//go:build windows || amd64\n\npackage p\n", true},
+		{"go:build and", "//go:build linux && arm64\n\npackage p\n", false},
+		{"go:build parens", "//go:build (windows || linux) && !386\n\npackage p\n", true},
+		{"go:build unix", "//go:build unix\n\npackage p\n", true},
+		{"go:build cgo", "//go:build cgo && gc\n\npackage p\n", true},
+		{"go:build custom tag", "//go:build custom\n\npackage p\n", true},
+		{"go:build unknown tag", "//go:build other\n\npackage p\n", false},
+		{"go:build ignore", "//go:build ignore\n\npackage p\n", false},
+		{"go:build release", "//go:build go1.21\n\npackage p\n", true},
+		{"go:build future release", "//go:build go1.99\n\npackage p\n", false},
+		{"go:build after comments", "// Copyright\n\n// More\n//go:build !linux\n\npackage p\n", false},
+		{"go:build malformed", "//go:build linux &&\n\npackage p\n", false},
+		{"go:build repeated", "//go:build linux\n//go:build amd64\n\npackage p\n", false},
+		// Constraints must be followed by a blank line, and come
+		// before the package clause.
+		{"go:build doc comment", "//go:build ignore\npackage p\n", true},
+		{"go:build after package", "package p\n\n//go:build ignore\n", true},
+		{"go:build in block comment", "/*\n//go:build ignore\n*/\n\npackage p\n", true},
+
+		{"+build", "// +build linux\n\npackage p\n", true},
+		{"+build or", "// +build windows linux\n\npackage p\n", true},
+		{"+build and", "// +build linux,arm64\n\npackage p\n", false},
+		{"+build negated", "// +build !linux\n\npackage p\n", false},
+		{"+build lines are anded", "// +build linux\n// +build arm64\n\npackage p\n", false},
+		{"+build release", "// +build go1.2\n\npackage p\n", true},
+		// //go:build takes precedence over // +build lines.
+		{"go:build wins", "//go:build linux\n// +build ignore\n\npackage p\n", true},
+		{"go:build wins negated", "// +build linux\n//go:build ignore\n\npackage p\n", false},
+	}
+	for _, test := range tests {
+		if got := ctxt.shouldBuild([]byte(test.content), nil); got != test.want {
+			t.Errorf("%s: shouldBuild(%q) = %v, want %v", test.name, test.content, got, test.want)
+		}
+	}
+}
+
+func TestGoodOSArchFile(t *testing.T) {
+	linux := &Context{GOOS: "linux", GOARCH: "amd64"}
+	android := &Context{GOOS: "android", GOARCH: "arm64"}
+	var tests = [...]struct {
+		ctxt *Context
+		name string
+		want bool
+	}{
+		{linux, "file.go", true},
+		{linux, "linux.go", true},
+		{linux, "windows.go", true},
+		{linux, "file_linux.go", true},
+		{linux, "file_windows.go", false},
+		{linux, "file_amd64.go", true},
+		{linux, "file_arm64.go", false},
+		{linux, "file_linux_amd64.go", true},
+		{linux, "file_linux_arm64.go", false},
+		{linux, "file_windows_amd64.go", false},
+		{linux, "file_linux_test.go", true},
+		{linux, "file_windows_test.go", false},
+		{linux, "file_linux_amd64_test.go", true},
+		{linux, "file_darwin_amd64_test.go", false},
+		{linux, "file_unknown.go", true},
+		{linux, "file_test.go", true},
+		// Removed ports are still recognized.
+		{linux, "file_nacl.go", false},
+		{android, "file_linux.go", true},
+		{android, "file_android_arm64.go", true},
+		{android, "file_linux_amd64.go", false},
+	}
+	for _, test := range tests {
+		if got := test.ctxt.goodOSArchFile(test.name, nil); got != test.want {
+			t.Errorf("goodOSArchFile(%s) on %s/%s = %v, want %v", test.name, test.ctxt.GOOS, test.ctxt.GOARCH, got, test.want)
+		}
+	}
+}
+
+func TestGoMinorVersion(t *testing.T) {
+	goversion := t.TempDir()
+	writeTree(t, goversion, map[string]string{
+		"src/internal/goversion/goversion.go": "package goversion\n\nconst Version = 21\n",
+		"VERSION":                             "go1.19.3\ntime 2023-01-01\n",
+	})
+	version := t.TempDir()
+	writeTree(t, version, map[string]string{"VERSION": "go1.19.3\ntime 2023-01-01\n"})
+	devel := t.TempDir()
+	writeTree(t, devel, map[string]string{"VERSION": "devel +abcdef\n"})
+
+	var tests = [...]struct {
+		goroot string
+		want   int
+	}{
+		{goversion, 21}, // goversion.go wins over VERSION
+		{version, 19},
+		{devel, 0},
+		{filepath.Join(devel, "missing"), 0},
+		{"", 0},
+	}
+	for _, test := range tests {
+		if got := goMinorVersion(test.goroot); got != test.want {
+			t.Errorf("goMinorVersion(%q) = %d, want %d", test.goroot, got, test.want)
+		}
+	}
+
+	// The version is read once per GOROOT.
+	if err := os.Remove(filepath.Join(version, "VERSION")); err != nil {
+		t.Fatal(err)
+	}
+	if got := goMinorVersion(version); got != 19 {
+		t.Errorf("goMinorVersion(%q) = %d after removing VERSION, want the cached 19", version, got)
+	}
+}
+
+func TestReleaseTags(t *testing.T) {
+	goroot := t.TempDir()
+	writeTree(t, goroot, map[string]string{"VERSION": "go1.3\n"})
+	unknown := t.TempDir()
+
+	var tests = [...]struct {
+		ctx  gbimporter.PackedContext
+		want []string
+	}{
+		// The release in GOROOT wins over the client's.
+		{gbimporter.PackedContext{GOROOT: goroot, ReleaseTags: []string{"go1.1"}}, []string{"go1.1", "go1.2", "go1.3"}},
+		{gbimporter.PackedContext{GOROOT: unknown, ReleaseTags: []string{"go1.1"}}, []string{"go1.1"}},
+		{gbimporter.PackedContext{GOROOT: unknown}, defBuildContext.ReleaseTags},
+	}
+	for _, test := range tests {
+		if got := ReleaseTags(&test.ctx); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ReleaseTags(GOROOT=%s, ReleaseTags=%v) = %v, want %v", test.ctx.GOROOT, test.ctx.ReleaseTags, got, test.want)
+		}
+		if got := buildContext(&test.ctx).ReleaseTags; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("buildContext(GOROOT=%s, ReleaseTags=%v) has release tags %v, want %v", test.ctx.GOROOT, test.ctx.ReleaseTags, got, test.want)
+		}
+	}
+}
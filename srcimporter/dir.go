@@ -1,14 +1,20 @@
 package srcimporter
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/mdempsky/gocode/pkgfiles"
 )
 
 // filePeek remembers basic file information.
@@ -22,7 +28,10 @@ type filePeek struct {
 type dir struct {
 	cache *pkgCache
 	path  string
-	// packages contains only packages that have been imported.
+
+	mu sync.Mutex // protects the fields below; held while parsing
+	// packages contains only packages that have been imported, by
+	// variant.
 	packages  map[string]*pkgInfo
 	filePeeks map[string]*filePeek
 	peekTime  time.Time // time when updatePeek was called
@@ -64,6 +73,8 @@ func filterPkgFile(path os.FileInfo) bool {
 	return !strings.HasSuffix(path.Name(), "_test.go")
 }
 
+// updatePeek refreshes the file peeks, which describe the files on disk.
+// d.mu must be held.
 func (d *dir) updatePeek() (changed bool, err error) {
 	d.peekTime = time.Now()
 	fd, err := os.Open(d.path)
@@ -91,7 +102,7 @@ func (d *dir) updatePeek() (changed bool, err error) {
 			d.filePeeks[fileName].modTime = mt
 			changed = true
 			filename := filepath.Join(d.path, fileName)
-			pkgName, importName, err := pkgNameFor(d.cache.ext, filename)
+			pkgName, importName, err := pkgNameFor(d.cache, filename, nil)
 			peek.modTime = mt
 			peek.pkgName = pkgName
 			peek.importName = importName
@@ -102,66 +113,225 @@ func (d *dir) updatePeek() (changed bool, err error) {
 	}
 	return changed, nil
 }
+
+// modifiedPackages adds packages with files modified since they were
+// parsed to mods. d.mu must be held.
 func (d *dir) modifiedPackages(mods map[*pkgInfo]bool) {
-	for _, peek := range d.filePeeks {
-		if pkg := d.packages[peek.importName]; pkg != nil {
-			if pkg.updateTime.Before(peek.modTime) {
+	for _, pkg := range d.packages {
+		for _, peek := range d.filePeeks {
+			if peek.importName == pkg.importName && pkg.updateTime.Before(peek.modTime) {
 				mods[pkg] = true
 			}
 		}
 	}
 }
-func (d *dir) getPackage(importName, pkgPath string) *pkgInfo {
+
+// packageList returns the packages imported so far.
+func (d *dir) packageList() []*pkgInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pkgs := make([]*pkgInfo, 0, len(d.packages))
+	for _, pkg := range d.packages {
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs
+}
+
+// lookupPackage returns the package as read from disk if it has been
+// imported already.
+func (d *dir) lookupPackage(importName string) *pkgInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.packages[importName]
+}
+
+// holds reports whether pkg is still cached.
+func (d *dir) holds(pkg *pkgInfo) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.packages[pkg.variant] == pkg
+}
+
+// getPackage returns the package as a request with overlay ov sees it,
+// parsed up to its imports. Only the imports are needed until the types
+// are computed, and they may come from the export cache. Packages read
+// from disk are cached; the variant of a package with overlaid files is
+// only cached once its imports are resolved, by variant.
+func (d *dir) getPackage(importName, pkgPath string, ov *requestOverlay) *pkgInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ov.fingerprint(d.path) != "" {
+		return d.parsePackage(importName, pkgPath, ov, parser.ImportsOnly)
+	}
 	if p := d.packages[importName]; p != nil {
 		return p
 	}
-	d.parsePackage(importName, pkgPath, 0)
-	return d.packages[importName]
+	p := d.parsePackage(importName, pkgPath, nil, parser.ImportsOnly)
+	if p != nil {
+		p.variant = importName
+		d.packages[importName] = p
+	}
+	return p
+}
+
+// maxOverlayVariants is how many variants with overlaid files are kept
+// per package. Editing a file creates a new variant of its package and
+// of the packages depending on it for every change.
+const maxOverlayVariants = 4
+
+// variant returns the cached package that has the files of base and is
+// type-checked against deps, the packages its imports resolve to. It is
+// base itself if neither base nor deps have overlaid files, and a variant
+// keyed by the contents of the overlaid files otherwise.
+func (d *dir) variant(base *pkgInfo, deps map[string]*pkgInfo, fingerprint string) *pkgInfo {
+	overlaid := fingerprint != ""
+	for _, dep := range deps {
+		overlaid = overlaid || dep.overlaid
+	}
+	key := base.importName
+	if overlaid {
+		h := sha256.New()
+		fmt.Fprintf(h, "files %s\n", fingerprint)
+		paths := make([]string, 0, len(deps))
+		for path := range deps {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			fmt.Fprintf(h, "import %s %s\n", path, deps[path].variant)
+		}
+		key += fmt.Sprintf("@%x", h.Sum(nil)[:16])
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if p := d.packages[key]; p != nil && (p.deps == nil || sameDeps(p.deps, deps)) {
+		if p.deps == nil {
+			p.deps = deps
+		}
+		p.lastUse = now
+		return p
+	}
+	// Either the variant is new, or its imports were reloaded since it
+	// was type-checked.
+	p := &pkgInfo{
+		Package:    base.Package,
+		path:       base.path,
+		importName: base.importName,
+		variant:    key,
+		overlaid:   overlaid,
+		fset:       base.fset,
+		dir:        d,
+		updateTime: base.updateTime,
+		deps:       deps,
+		lastUse:    now,
+	}
+	d.packages[key] = p
+	if overlaid {
+		d.evictVariants(base.importName)
+	}
+	return p
+}
+
+// evictVariants drops the least recently used variants with overlaid
+// files of the package importName beyond maxOverlayVariants. Requests
+// using them keep them until they are done. d.mu must be held.
+func (d *dir) evictVariants(importName string) {
+	var variants []*pkgInfo
+	for _, p := range d.packages {
+		if p.overlaid && p.importName == importName {
+			variants = append(variants, p)
+		}
+	}
+	if len(variants) <= maxOverlayVariants {
+		return
+	}
+	sort.Slice(variants, func(i, j int) bool { return variants[i].lastUse.After(variants[j].lastUse) })
+	for _, p := range variants[maxOverlayVariants:] {
+		delete(d.packages, p.variant)
+	}
+}
+
+func sameDeps(a, b map[string]*pkgInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, p := range a {
+		if b[path] != p {
+			return false
+		}
+	}
+	return true
 }
-func (d *dir) parsePackage(importName, pkgPath string, mode parser.Mode) {
+
+// parsePackage parses the files of a package, replacing the files on
+// disk by those in ov. d.mu must be held.
+func (d *dir) parsePackage(importName, pkgPath string, ov *requestOverlay, mode parser.Mode) *pkgInfo {
 	if time.Since(d.peekTime) > time.Second {
 		d.updatePeek()
 	}
 	var packageFiles []string
 	var pkgName string
 	for fname, p := range d.filePeeks {
-		if p.importName == importName {
+		if p.importName == importName && !ov.overlays(filepath.Join(d.path, fname)) {
 			packageFiles = append(packageFiles, fname)
 			pkgName = p.pkgName
 		}
 	}
+	// Unsaved files may belong to another package than on disk, or
+	// not exist on disk at all.
+	for filename := range ov.fileSet() {
+		fname := filepath.Base(filename)
+		if filepath.Dir(filename) != d.path || !isPackageFile(fname) {
+			continue
+		}
+		name, impName, err := pkgNameFor(d.cache, filename, ov.files)
+		if err != nil {
+			log.Printf("pkgNameFor err=%v", err)
+		}
+		if impName == importName {
+			packageFiles = append(packageFiles, fname)
+			pkgName = name
+		}
+	}
 	if len(packageFiles) == 0 {
-		return
+		return nil
 	}
 	pkg := &pkgInfo{
 		Package: &ast.Package{
 			Name:  pkgName,
 			Files: make(map[string]*ast.File),
 		},
-		path: pkgPath,
-		fset: &token.FileSet{},
-		dir:  d,
+		path:       pkgPath,
+		importName: importName,
+		fset:       &token.FileSet{},
+		dir:        d,
 	}
-	d.packages[importName] = pkg
 	for _, fname := range packageFiles {
 		filename := filepath.Join(d.path, fname)
-		if src, err := parser.ParseFile(pkg.fset, filename, nil, mode); err == nil {
+		if src, err := parser.ParseFile(pkg.fset, filename, ov.fileSet().Source(filename), mode); err == nil {
 			pkg.Files[filename] = src
 		} else {
 			log.Printf("ParseFile: %v", err)
 		}
 		pkg.updateTime = time.Now()
 	}
+	return pkg
 }
 
 func (d *dir) unlink() {
-	delete(d.cache.dirs, d.path)
+	d.cache.mu.Lock()
+	defer d.cache.mu.Unlock()
+	if d.cache.dirs[d.path] == d {
+		delete(d.cache.dirs, d.path)
+	}
 }
 
-func pkgNameFor(ext extension, filename string) (pkgName, impName string, err error) {
-	pkgName, err = scanPkg(filename)
+func pkgNameFor(cache *pkgCache, filename string, overlay pkgfiles.Overlay) (pkgName, impName string, err error) {
+	pkgName, err = scanPkg(filename, overlay, &cache.ctxt)
 	if err != nil || pkgName == "" {
 		return "", "", err
 	}
-	return pkgName, ext.ImportName(pkgName, filename), nil
+	return pkgName, cache.ext.ImportName(pkgName, filename), nil
 }
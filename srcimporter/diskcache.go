@@ -0,0 +1,187 @@
+package srcimporter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The export cache saves type-checked packages on disk, so that a new
+// daemon, or gocode in -oneshot mode, need not type-check them from
+// source again. An entry is named by a hash of everything the package
+// depends on: the contents of its files, the build context and the
+// entries of the packages it imports. Stale entries are never found, so
+// they are simply deleted once they have not been used for a while.
+
+var exportCache struct {
+	sync.Mutex
+	dir     string
+	trimmed bool
+}
+
+// exportCacheExpiry is how long unused entries stay in the export cache.
+const exportCacheExpiry = 7 * 24 * time.Hour
+
+// SetExportCache sets the directory of the export cache. The empty
+// string disables the cache.
+func SetExportCache(dir string) {
+	exportCache.Lock()
+	defer exportCache.Unlock()
+	exportCache.dir = dir
+}
+
+func exportCacheDir() string {
+	exportCache.Lock()
+	defer exportCache.Unlock()
+	return exportCache.dir
+}
+
+// exportKey returns the name of the export cache entry of the package
+// made of the given files, or "" if the package cannot be cached because
+// an import failed. It must be called after the imports were loaded.
+func (p *pkgInfo) exportKey(filenames []string, contents [][]byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "gocode export %d %s\n", exportVersion, runtime.Version())
+	fmt.Fprintf(h, "context %s\n", p.dir.cache.key)
+	fmt.Fprintf(h, "package %s %s %s\n", p.path, p.Package.Name, p.dir.path)
+	for i, filename := range filenames {
+		fmt.Fprintf(h, "file %s %x\n", filepath.Base(filename), sha256.Sum256(contents[i]))
+	}
+	// Hash the packages p is type-checked against, which need not be
+	// those the cache holds now if they were reloaded since.
+	p.dir.mu.Lock()
+	deps := p.deps
+	p.dir.mu.Unlock()
+	c := p.PkgCache()
+	imports := packageImports(p.Package)
+	sort.Strings(imports)
+	for _, path := range imports {
+		if path == "unsafe" || path == "C" {
+			continue
+		}
+		dep := deps[path]
+		if dep == nil {
+			return ""
+		}
+		c.loadMu.Lock()
+		key := dep.key
+		c.loadMu.Unlock()
+		if key == "" {
+			return ""
+		}
+		fmt.Fprintf(h, "import %s %s\n", path, key)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func exportPath(dir, key string) string {
+	return filepath.Join(dir, key[:2], key+"-export")
+}
+
+// loadExport returns the package saved under key, or nil if there is
+// none. files are the token.Files for filenames, used for positions.
+func loadExport(key string, files []*token.File, deps map[string]*types.Package) (tpkg *types.Package) {
+	dir := exportCacheDir()
+	if dir == "" {
+		return nil
+	}
+	path := exportPath(dir, key)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		// A corrupt entry is only a cache miss.
+		if err := recover(); err != nil {
+			log.Printf("export cache: %s: %v", path, err)
+			tpkg = nil
+		}
+	}()
+	var in exportPackage
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&in); err != nil {
+		log.Printf("export cache: %s: %v", path, err)
+		return nil
+	}
+	tpkg = importTypes(&in, files, deps)
+	// Keep used entries from expiring.
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return tpkg
+}
+
+// saveExport saves the package under key.
+func saveExport(key string, fset *token.FileSet, tpkg *types.Package, filenames []string) {
+	dir := exportCacheDir()
+	if dir == "" {
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(exportTypes(fset, tpkg, filenames)); err != nil {
+		log.Printf("export cache: %v", err)
+		return
+	}
+	path := exportPath(dir, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Printf("export cache: %v", err)
+		return
+	}
+	// Write atomically, since other gocode processes may read the
+	// entry at the same time.
+	f, err := ioutil.TempFile(filepath.Dir(path), "tmp-")
+	if err != nil {
+		log.Printf("export cache: %v", err)
+		return
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf("export cache: %v", err)
+		return
+	}
+	trimExportCache(dir)
+}
+
+// trimExportCache deletes entries that have not been used for a while.
+// It runs at most once per process and day.
+func trimExportCache(dir string) {
+	exportCache.Lock()
+	if exportCache.trimmed {
+		exportCache.Unlock()
+		return
+	}
+	exportCache.trimmed = true
+	exportCache.Unlock()
+
+	marker := filepath.Join(dir, "trim.txt")
+	if fi, err := os.Stat(marker); err == nil && time.Since(fi.ModTime()) < 24*time.Hour {
+		return
+	}
+	if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+		return
+	}
+	go func() {
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() && path != marker && time.Since(fi.ModTime()) > exportCacheExpiry {
+				os.Remove(path)
+			}
+			return nil
+		})
+	}()
+}
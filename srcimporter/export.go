@@ -0,0 +1,654 @@
+package srcimporter
+
+import (
+	"go/constant"
+	"go/token"
+	"go/types"
+)
+
+// Type-checked packages are saved to the export cache in a format of our
+// own, since go/types offers no way to write export data. The format is
+// a gob of exportPackage: types are stored in a table and refer to each
+// other by index, so that recursive types can be encoded.
+
+// exportVersion must be incremented whenever the format changes.
+const exportVersion = 1
+
+type exportPackage struct {
+	Path    string
+	Name    string
+	Files   []string      // names of the files positions refer to
+	Imports []string      // paths of the imported packages
+	Pkgs    []exportPkg   // packages objects belong to; Pkgs[0] is this package
+	Types   []exportType  // referred to by index
+	Objects []exportField // package scope
+}
+
+type exportPkg struct {
+	Path, Name string
+}
+
+type typeKind int
+
+const (
+	tInvalid   typeKind = iota
+	tBasic              // Name, Index is the kind
+	tUniverse           // predeclared named type or alias, eg error or any
+	tForeign            // type declared in another package: Pkg, Name
+	tNamed              // type declared in this package
+	tAlias              // alias declared in this package
+	tInstance           // Elem is the generic type, Types the type arguments
+	tTypeParam          // Index, Elem is the constraint
+	tPointer            // Elem
+	tSlice              // Elem
+	tArray              // Len, Elem
+	tMap                // Key, Elem
+	tChan               // Dir, Elem
+	tStruct             // Fields, Tags
+	tSignature          // Recv, RecvTypeParams, TypeParams, Params, Results, Variadic
+	tInterface          // Methods, Types are the embedded types, Implicit
+	tUnion              // Types, Tilde
+)
+
+type exportType struct {
+	Kind  typeKind
+	Name  string
+	Pkg   int
+	Pos   exportPos
+	Index int
+	Elem  int
+	Key   int
+	Len   int64
+	Dir   types.ChanDir
+
+	Fields   []exportField
+	Tags     []string
+	Methods  []exportField // of interfaces, and of named types
+	Types    []int
+	Tilde    []bool
+	Implicit bool
+
+	Recv           []exportField // at most one
+	RecvTypeParams []int
+	TypeParams     []int // also of named types and aliases
+	Params         []exportField
+	Results        []exportField
+	Variadic       bool
+}
+
+type objKind int
+
+const (
+	oVar objKind = iota
+	oConst
+	oTypeName
+	oFunc
+)
+
+// exportField is an object: a package-level object, a field, a method or
+// a parameter.
+type exportField struct {
+	Kind     objKind
+	Name     string
+	Pkg      int
+	Pos      exportPos
+	Type     int
+	Embedded bool
+	Val      exportConst
+}
+
+type exportPos struct {
+	File   int // index in Files plus one; 0 means no position
+	Offset int
+}
+
+type exportConst struct {
+	Kind  constant.Kind
+	Parts []string
+}
+
+// exporter encodes a package.
+type exporter struct {
+	fset  *token.FileSet
+	pkg   *types.Package
+	out   exportPackage
+	files map[string]int
+	pkgs  map[*types.Package]int
+	types map[types.Type]int
+}
+
+func exportTypes(fset *token.FileSet, pkg *types.Package, filenames []string) *exportPackage {
+	e := &exporter{
+		fset:  fset,
+		pkg:   pkg,
+		files: make(map[string]int),
+		pkgs:  map[*types.Package]int{pkg: 0},
+		types: make(map[types.Type]int),
+	}
+	e.out.Path = pkg.Path()
+	e.out.Name = pkg.Name()
+	e.out.Pkgs = []exportPkg{{pkg.Path(), pkg.Name()}}
+	for i, filename := range filenames {
+		e.files[filename] = i + 1
+	}
+	e.out.Files = filenames
+	for _, imp := range pkg.Imports() {
+		e.out.Imports = append(e.out.Imports, imp.Path())
+	}
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		e.out.Objects = append(e.out.Objects, e.object(scope.Lookup(name)))
+	}
+	return &e.out
+}
+
+func (e *exporter) pos(pos token.Pos) exportPos {
+	tf := e.fset.File(pos)
+	if tf == nil {
+		return exportPos{}
+	}
+	if i, ok := e.files[tf.Name()]; ok {
+		return exportPos{i, tf.Offset(pos)}
+	}
+	return exportPos{}
+}
+
+func (e *exporter) pkgIndex(pkg *types.Package) int {
+	if pkg == nil {
+		return -1
+	}
+	if i, ok := e.pkgs[pkg]; ok {
+		return i
+	}
+	i := len(e.out.Pkgs)
+	e.out.Pkgs = append(e.out.Pkgs, exportPkg{pkg.Path(), pkg.Name()})
+	e.pkgs[pkg] = i
+	return i
+}
+
+func (e *exporter) object(obj types.Object) exportField {
+	f := exportField{
+		Name: obj.Name(),
+		Pkg:  e.pkgIndex(obj.Pkg()),
+		Pos:  e.pos(obj.Pos()),
+		Type: e.typ(obj.Type()),
+	}
+	switch obj := obj.(type) {
+	case *types.Const:
+		f.Kind = oConst
+		f.Val = exportConstant(obj.Val())
+	case *types.TypeName:
+		f.Kind = oTypeName
+	case *types.Func:
+		f.Kind = oFunc
+	case *types.Var:
+		f.Kind = oVar
+		f.Embedded = obj.Embedded()
+	}
+	return f
+}
+
+func (e *exporter) vars(t *types.Tuple) []exportField {
+	var fields []exportField
+	for i := 0; i < t.Len(); i++ {
+		fields = append(fields, e.object(t.At(i)))
+	}
+	return fields
+}
+
+func (e *exporter) typeParams(list *types.TypeParamList) []int {
+	var tparams []int
+	for i := 0; i < list.Len(); i++ {
+		tparams = append(tparams, e.typ(list.At(i)))
+	}
+	return tparams
+}
+
+func (e *exporter) typeList(list *types.TypeList) []int {
+	var targs []int
+	for i := 0; i < list.Len(); i++ {
+		targs = append(targs, e.typ(list.At(i)))
+	}
+	return targs
+}
+
+// typ returns the index of t in the type table, adding it if necessary.
+func (e *exporter) typ(t types.Type) int {
+	if i, ok := e.types[t]; ok {
+		return i
+	}
+	// Reserve the index first, so that recursive references to t
+	// find it.
+	i := len(e.out.Types)
+	e.out.Types = append(e.out.Types, exportType{})
+	e.types[t] = i
+
+	var et exportType
+	switch t := t.(type) {
+	case *types.Basic:
+		et = exportType{Kind: tBasic, Name: t.Name(), Index: int(t.Kind())}
+	case *types.Alias:
+		et = e.alias(t)
+	case *types.Named:
+		et = e.named(t)
+	case *types.TypeParam:
+		et = exportType{Kind: tTypeParam, Name: t.Obj().Name(), Pkg: e.pkgIndex(t.Obj().Pkg()), Pos: e.pos(t.Obj().Pos()), Index: t.Index()}
+		et.Elem = e.typ(t.Constraint())
+	case *types.Pointer:
+		et = exportType{Kind: tPointer, Elem: e.typ(t.Elem())}
+	case *types.Slice:
+		et = exportType{Kind: tSlice, Elem: e.typ(t.Elem())}
+	case *types.Array:
+		et = exportType{Kind: tArray, Len: t.Len(), Elem: e.typ(t.Elem())}
+	case *types.Map:
+		et = exportType{Kind: tMap, Key: e.typ(t.Key()), Elem: e.typ(t.Elem())}
+	case *types.Chan:
+		et = exportType{Kind: tChan, Dir: t.Dir(), Elem: e.typ(t.Elem())}
+	case *types.Struct:
+		et.Kind = tStruct
+		for i := 0; i < t.NumFields(); i++ {
+			et.Fields = append(et.Fields, e.object(t.Field(i)))
+			et.Tags = append(et.Tags, t.Tag(i))
+		}
+	case *types.Signature:
+		et.Kind = tSignature
+		if t.Recv() != nil {
+			et.Recv = []exportField{e.object(t.Recv())}
+		}
+		et.RecvTypeParams = e.typeParams(t.RecvTypeParams())
+		et.TypeParams = e.typeParams(t.TypeParams())
+		et.Params = e.vars(t.Params())
+		et.Results = e.vars(t.Results())
+		et.Variadic = t.Variadic()
+	case *types.Interface:
+		et = exportType{Kind: tInterface, Implicit: t.IsImplicit()}
+		for i := 0; i < t.NumExplicitMethods(); i++ {
+			m := t.ExplicitMethod(i)
+			// The receiver is set again when the interface is
+			// created.
+			sig := m.Type().(*types.Signature)
+			sig = types.NewSignatureType(nil, nil, nil, sig.Params(), sig.Results(), sig.Variadic())
+			et.Methods = append(et.Methods, exportField{Kind: oFunc, Name: m.Name(), Pkg: e.pkgIndex(m.Pkg()), Pos: e.pos(m.Pos()), Type: e.typ(sig)})
+		}
+		for i := 0; i < t.NumEmbeddeds(); i++ {
+			et.Types = append(et.Types, e.typ(t.EmbeddedType(i)))
+		}
+	case *types.Union:
+		et.Kind = tUnion
+		for i := 0; i < t.Len(); i++ {
+			et.Types = append(et.Types, e.typ(t.Term(i).Type()))
+			et.Tilde = append(et.Tilde, t.Term(i).Tilde())
+		}
+	default:
+		et.Kind = tInvalid
+	}
+	e.out.Types[i] = et
+	return i
+}
+
+// declared reports whether obj is declared at package scope of this
+// package.
+func (e *exporter) declared(obj *types.TypeName) bool {
+	return obj.Pkg() == e.pkg && e.pkg.Scope().Lookup(obj.Name()) == obj
+}
+
+func (e *exporter) named(t *types.Named) exportType {
+	obj := t.Obj()
+	switch {
+	case obj.Pkg() == nil:
+		return exportType{Kind: tUniverse, Name: obj.Name()}
+	case t.Origin() != t:
+		return exportType{Kind: tInstance, Elem: e.typ(t.Origin()), Types: e.typeList(t.TypeArgs())}
+	case obj.Pkg() != e.pkg:
+		return exportType{Kind: tForeign, Name: obj.Name(), Pkg: e.pkgIndex(obj.Pkg())}
+	case !e.declared(obj):
+		// Types declared in functions are not needed by importers.
+		return exportType{Kind: tInvalid}
+	}
+	et := exportType{Kind: tNamed, Name: obj.Name(), Pkg: 0, Pos: e.pos(obj.Pos())}
+	et.TypeParams = e.typeParams(t.TypeParams())
+	et.Elem = e.typ(t.Underlying())
+	for i := 0; i < t.NumMethods(); i++ {
+		et.Methods = append(et.Methods, e.object(t.Method(i)))
+	}
+	return et
+}
+
+func (e *exporter) alias(t *types.Alias) exportType {
+	obj := t.Obj()
+	switch {
+	case obj.Pkg() == nil:
+		return exportType{Kind: tUniverse, Name: obj.Name()}
+	case t.Origin() != t:
+		return exportType{Kind: tInstance, Elem: e.typ(t.Origin()), Types: e.typeList(t.TypeArgs())}
+	case obj.Pkg() != e.pkg:
+		return exportType{Kind: tForeign, Name: obj.Name(), Pkg: e.pkgIndex(obj.Pkg())}
+	case !e.declared(obj):
+		return exportType{Kind: tInvalid}
+	}
+	et := exportType{Kind: tAlias, Name: obj.Name(), Pkg: 0, Pos: e.pos(obj.Pos())}
+	et.TypeParams = e.typeParams(t.TypeParams())
+	et.Elem = e.typ(t.Rhs())
+	return et
+}
+
+func exportConstant(v constant.Value) exportConst {
+	c := exportConst{Kind: v.Kind()}
+	switch v.Kind() {
+	case constant.Bool:
+		c.Parts = []string{v.ExactString()}
+	case constant.String:
+		c.Parts = []string{constant.StringVal(v)}
+	case constant.Int:
+		c.Parts = []string{v.ExactString()}
+	case constant.Float:
+		c.Parts = exportFloat(v)
+	case constant.Complex:
+		c.Parts = append(exportFloat(constant.Real(v)), exportFloat(constant.Imag(v))...)
+	}
+	return c
+}
+
+// exportFloat returns the numerator and denominator of v, or its decimal
+// approximation if it cannot be represented as a fraction.
+func exportFloat(v constant.Value) []string {
+	num, denom := constant.Num(v), constant.Denom(v)
+	if num.Kind() == constant.Unknown || denom.Kind() == constant.Unknown {
+		return []string{v.String(), "1"}
+	}
+	return []string{num.ExactString(), denom.ExactString()}
+}
+
+// importer decodes a package exported by exporter.
+type importer struct {
+	in      *exportPackage
+	pkg     *types.Package
+	files   []*token.File // indexed like in.Files
+	deps    map[string]*types.Package
+	pkgs    []*types.Package
+	types   []types.Type
+	started []bool // decoding of types[i] has started
+	ctxt    *types.Context
+	ifaces  []*types.Interface
+}
+
+// importTypes creates the package described by in. files holds the
+// token.Files for in.Files, and deps the packages it may refer to.
+func importTypes(in *exportPackage, files []*token.File, deps map[string]*types.Package) *types.Package {
+	d := &importer{
+		in:      in,
+		pkg:     types.NewPackage(in.Path, in.Name),
+		files:   files,
+		deps:    deps,
+		types:   make([]types.Type, len(in.Types)),
+		started: make([]bool, len(in.Types)),
+		ctxt:    types.NewContext(),
+	}
+	for i, p := range in.Pkgs {
+		switch {
+		case i == 0:
+			d.pkgs = append(d.pkgs, d.pkg)
+		case deps[p.Path] != nil:
+			d.pkgs = append(d.pkgs, deps[p.Path])
+		default:
+			d.pkgs = append(d.pkgs, types.NewPackage(p.Path, p.Name))
+		}
+	}
+
+	scope := d.pkg.Scope()
+	for _, f := range in.Objects {
+		if obj := d.object(f); obj != nil {
+			scope.Insert(obj)
+		}
+	}
+	// Interfaces can only be completed once the types they embed are
+	// complete.
+	for _, iface := range d.ifaces {
+		iface.Complete()
+	}
+
+	var imports []*types.Package
+	for _, path := range in.Imports {
+		if p := deps[path]; p != nil {
+			imports = append(imports, p)
+		}
+	}
+	d.pkg.SetImports(imports)
+	d.pkg.MarkComplete()
+	return d.pkg
+}
+
+func (d *importer) pos(p exportPos) token.Pos {
+	if p.File <= 0 || p.File > len(d.files) {
+		return token.NoPos
+	}
+	tf := d.files[p.File-1]
+	if tf == nil || p.Offset > tf.Size() {
+		return token.NoPos
+	}
+	return tf.Pos(p.Offset)
+}
+
+func (d *importer) pkgAt(i int) *types.Package {
+	if i < 0 || i >= len(d.pkgs) {
+		return nil
+	}
+	return d.pkgs[i]
+}
+
+func (d *importer) object(f exportField) types.Object {
+	pos, pkg := d.pos(f.Pos), d.pkgAt(f.Pkg)
+	switch f.Kind {
+	case oConst:
+		return types.NewConst(pos, pkg, f.Name, d.typ(f.Type), importConstant(f.Val))
+	case oTypeName:
+		// Declared types and aliases come with their object.
+		t := d.typ(f.Type)
+		switch t := t.(type) {
+		case *types.Named:
+			if t.Obj().Pkg() == pkg && t.Obj().Name() == f.Name {
+				return t.Obj()
+			}
+		case *types.Alias:
+			if t.Obj().Pkg() == pkg && t.Obj().Name() == f.Name {
+				return t.Obj()
+			}
+		}
+		return types.NewTypeName(pos, pkg, f.Name, t)
+	case oFunc:
+		sig, ok := d.typ(f.Type).(*types.Signature)
+		if !ok {
+			return nil
+		}
+		return types.NewFunc(pos, pkg, f.Name, sig)
+	}
+	return types.NewVar(pos, pkg, f.Name, d.typ(f.Type))
+}
+
+func (d *importer) vars(fields []exportField) []*types.Var {
+	var vars []*types.Var
+	for _, f := range fields {
+		vars = append(vars, types.NewParam(d.pos(f.Pos), d.pkgAt(f.Pkg), f.Name, d.typ(f.Type)))
+	}
+	return vars
+}
+
+func (d *importer) typeParams(list []int) []*types.TypeParam {
+	var tparams []*types.TypeParam
+	for _, i := range list {
+		if tp, ok := d.typ(i).(*types.TypeParam); ok {
+			tparams = append(tparams, tp)
+		}
+	}
+	return tparams
+}
+
+// typ returns the type at index i of the type table.
+func (d *importer) typ(i int) types.Type {
+	if i < 0 || i >= len(d.types) {
+		return types.Typ[types.Invalid]
+	}
+	if t := d.types[i]; t != nil {
+		return t
+	}
+	if d.started[i] {
+		// Only a cycle through an alias, which cannot be created
+		// before its right-hand side, gets here.
+		return types.Typ[types.Invalid]
+	}
+	d.started[i] = true
+	t := d.decode(&d.in.Types[i], i)
+	d.types[i] = t
+	return t
+}
+
+func (d *importer) decode(et *exportType, i int) types.Type {
+	switch et.Kind {
+	case tBasic:
+		if obj, ok := types.Universe.Lookup(et.Name).(*types.TypeName); ok {
+			if b, ok := obj.Type().(*types.Basic); ok && int(b.Kind()) == et.Index {
+				return b
+			}
+		}
+		if et.Index >= 0 && et.Index < len(types.Typ) {
+			return types.Typ[et.Index]
+		}
+	case tUniverse:
+		if obj, ok := types.Universe.Lookup(et.Name).(*types.TypeName); ok {
+			return obj.Type()
+		}
+	case tForeign:
+		if pkg := d.pkgAt(et.Pkg); pkg != nil {
+			if obj, ok := pkg.Scope().Lookup(et.Name).(*types.TypeName); ok {
+				return obj.Type()
+			}
+		}
+	case tNamed:
+		obj := types.NewTypeName(d.pos(et.Pos), d.pkg, et.Name, nil)
+		// Register the type before decoding its parts, which may
+		// refer to it. Until its underlying type is decoded, it is
+		// invalid rather than nil, which go/types does not expect
+		// of types in use.
+		named := types.NewNamed(obj, types.Typ[types.Invalid], nil)
+		d.types[i] = named
+		named.SetTypeParams(d.typeParams(et.TypeParams))
+		if u := d.typ(et.Elem).Underlying(); u != nil {
+			named.SetUnderlying(u)
+		}
+		for _, m := range et.Methods {
+			if sig, ok := d.typ(m.Type).(*types.Signature); ok {
+				named.AddMethod(types.NewFunc(d.pos(m.Pos), d.pkgAt(m.Pkg), m.Name, sig))
+			}
+		}
+		return named
+	case tAlias:
+		obj := types.NewTypeName(d.pos(et.Pos), d.pkg, et.Name, nil)
+		tparams := d.typeParams(et.TypeParams)
+		alias := types.NewAlias(obj, d.typ(et.Elem))
+		if len(tparams) > 0 {
+			alias.SetTypeParams(tparams)
+		}
+		return alias
+	case tInstance:
+		orig := d.typ(et.Elem)
+		var targs []types.Type
+		for _, j := range et.Types {
+			targs = append(targs, d.typ(j))
+		}
+		if t, err := types.Instantiate(d.ctxt, orig, targs, false); err == nil {
+			return t
+		}
+	case tTypeParam:
+		obj := types.NewTypeName(d.pos(et.Pos), d.pkgAt(et.Pkg), et.Name, nil)
+		tp := types.NewTypeParam(obj, nil)
+		d.types[i] = tp
+		tp.SetConstraint(d.typ(et.Elem))
+		return tp
+	case tPointer:
+		return types.NewPointer(d.typ(et.Elem))
+	case tSlice:
+		return types.NewSlice(d.typ(et.Elem))
+	case tArray:
+		return types.NewArray(d.typ(et.Elem), et.Len)
+	case tMap:
+		return types.NewMap(d.typ(et.Key), d.typ(et.Elem))
+	case tChan:
+		return types.NewChan(et.Dir, d.typ(et.Elem))
+	case tStruct:
+		var fields []*types.Var
+		for _, f := range et.Fields {
+			fields = append(fields, types.NewField(d.pos(f.Pos), d.pkgAt(f.Pkg), f.Name, d.typ(f.Type), f.Embedded))
+		}
+		return types.NewStruct(fields, et.Tags)
+	case tSignature:
+		var recv *types.Var
+		if len(et.Recv) > 0 {
+			recv = d.vars(et.Recv)[0]
+		}
+		rtparams := d.typeParams(et.RecvTypeParams)
+		tparams := d.typeParams(et.TypeParams)
+		params := types.NewTuple(d.vars(et.Params)...)
+		results := types.NewTuple(d.vars(et.Results)...)
+		return types.NewSignatureType(recv, rtparams, tparams, params, results, et.Variadic)
+	case tInterface:
+		var methods []*types.Func
+		for _, m := range et.Methods {
+			if sig, ok := d.typ(m.Type).(*types.Signature); ok {
+				methods = append(methods, types.NewFunc(d.pos(m.Pos), d.pkgAt(m.Pkg), m.Name, sig))
+			}
+		}
+		var embeddeds []types.Type
+		for _, j := range et.Types {
+			embeddeds = append(embeddeds, d.typ(j))
+		}
+		iface := types.NewInterfaceType(methods, embeddeds)
+		if et.Implicit {
+			iface.MarkImplicit()
+		}
+		d.ifaces = append(d.ifaces, iface)
+		return iface
+	case tUnion:
+		var terms []*types.Term
+		for j, k := range et.Types {
+			terms = append(terms, types.NewTerm(j < len(et.Tilde) && et.Tilde[j], d.typ(k)))
+		}
+		return types.NewUnion(terms)
+	}
+	return types.Typ[types.Invalid]
+}
+
+func importConstant(c exportConst) constant.Value {
+	switch c.Kind {
+	case constant.Bool:
+		if len(c.Parts) == 1 {
+			return constant.MakeBool(c.Parts[0] == "true")
+		}
+	case constant.String:
+		if len(c.Parts) == 1 {
+			return constant.MakeString(c.Parts[0])
+		}
+	case constant.Int:
+		if len(c.Parts) == 1 {
+			return constant.MakeFromLiteral(c.Parts[0], token.INT, 0)
+		}
+	case constant.Float:
+		if len(c.Parts) == 2 {
+			return importFloat(c.Parts)
+		}
+	case constant.Complex:
+		if len(c.Parts) == 4 {
+			re, im := importFloat(c.Parts[:2]), importFloat(c.Parts[2:])
+			return constant.BinaryOp(re, token.ADD, constant.MakeImag(im))
+		}
+	}
+	return constant.MakeUnknown()
+}
+
+func importFloat(parts []string) constant.Value {
+	num := constant.MakeFromLiteral(parts[0], token.FLOAT, 0)
+	denom := constant.MakeFromLiteral(parts[1], token.FLOAT, 0)
+	if num.Kind() == constant.Unknown || denom.Kind() == constant.Unknown || constant.Sign(denom) == 0 {
+		return constant.MakeUnknown()
+	}
+	return constant.BinaryOp(num, token.QUO, denom)
+}
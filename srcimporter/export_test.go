@@ -0,0 +1,285 @@
+package srcimporter
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+)
+
+const exportDepSrc = `package dep
+
+type Closer interface{ Close() error }
+
+type T struct{ X int }
+
+func (T) Dep() {}
+`
+
+const exportSrc = `package p
+
+import "dep"
+
+// Cyclic and generic types.
+type (
+	Node struct {
+		Next *Node
+		Val  int
+	}
+	List[T any] struct {
+		next *List[T]
+		v    T
+	}
+	Pair[K comparable, V any] struct {
+		Key K
+		Val V
+	}
+	A B
+	B []A
+	C interface{ M() C }
+)
+
+// Interfaces with embedded types.
+type (
+	Reader     interface{ Read(p []byte) (int, error) }
+	ReadCloser interface {
+		Reader
+		dep.Closer
+		Flush()
+	}
+	Number interface{ ~int | ~float64 }
+	Embed  struct {
+		*Node
+		dep.T
+		Pair[string, int]
+	}
+)
+
+// Aliases.
+type (
+	NodeAlias    = Node
+	IntList      = List[int]
+	GList[T any] = List[T]
+	Closer       = dep.Closer
+)
+
+type Kind int
+
+const (
+	K1 Kind = iota
+	K2
+)
+
+const (
+	Big     = 1 << 100
+	Str     = "s\x00"
+	Float   = 1.5
+	Third   = 1.0 / 3
+	Complex = 1 + 2i
+	Bool    = Big > 0
+)
+
+var (
+	V  Pair[string, Node]
+	VL IntList
+)
+
+func (n *Node) Len() int { return 0 }
+
+func (l List[T]) Push(v T) List[T] { return l }
+
+func (e Embed) Close() error { return nil }
+
+func Map[S ~[]E, E any, R any](s S, f func(E) R) []R { return nil }
+
+func Sum[N Number](ns ...N) (sum N) { return }
+`
+
+// checkSource type-checks the package in src, importing the packages in
+// deps.
+func checkSource(t *testing.T, fset *token.FileSet, filename, src string, deps map[string]*types.Package) (*types.Package, *ast.File) {
+	t.Helper()
+	f, err := parser.ParseFile(fset, filename, src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := types.Config{Importer: importerFunc(func(path string) (*types.Package, error) {
+		return deps[path], nil
+	})}
+	pkg, err := conf.Check(f.Name.Name, fset, []*ast.File{f}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg, f
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+// TestExportRoundTrip saves a package to the export cache and loads it
+// again, comparing the objects and method sets of the two.
+func TestExportRoundTrip(t *testing.T) {
+	SetExportCache(t.TempDir())
+	defer SetExportCache("")
+
+	fset := token.NewFileSet()
+	dep, _ := checkSource(t, fset, "/src/dep/dep.go", exportDepSrc, nil)
+	deps := map[string]*types.Package{"dep": dep}
+	pkg, _ := checkSource(t, fset, "/src/p/p.go", exportSrc, deps)
+
+	const key = "0123456789abcdef"
+	saveExport(key, fset, pkg, []string{"/src/p/p.go"})
+	tf := fset.File(pkg.Scope().Lookup("Node").Pos())
+	got := loadExport(key, []*token.File{tf}, deps)
+	if got == nil {
+		t.Fatal("loadExport found no package")
+	}
+
+	if got.Path() != pkg.Path() || got.Name() != pkg.Name() {
+		t.Errorf("got package %s %s, want %s %s", got.Name(), got.Path(), pkg.Name(), pkg.Path())
+	}
+	if len(got.Imports()) != 1 || got.Imports()[0] != dep {
+		t.Errorf("got imports %v, want [dep]", got.Imports())
+	}
+	wantNames, gotNames := pkg.Scope().Names(), got.Scope().Names()
+	if len(gotNames) != len(wantNames) {
+		t.Errorf("got objects %v, want %v", gotNames, wantNames)
+	}
+	for _, name := range wantNames {
+		want, obj := pkg.Scope().Lookup(name), got.Scope().Lookup(name)
+		if obj == nil {
+			t.Errorf("%s: missing", name)
+			continue
+		}
+		if g, w := types.ObjectString(obj, nil), types.ObjectString(want, nil); g != w {
+			t.Errorf("%s: got %s, want %s", name, g, w)
+		}
+		if obj.Pos() != want.Pos() {
+			t.Errorf("%s: got position %v, want %v", name, fset.Position(obj.Pos()), fset.Position(want.Pos()))
+		}
+		if _, ok := obj.(*types.TypeName); !ok {
+			continue
+		}
+		if u := obj.Type().Underlying(); u == nil {
+			t.Errorf("%s: nil underlying type", name)
+			continue
+		}
+		if g, w := obj.Type().Underlying().String(), want.Type().Underlying().String(); g != w {
+			t.Errorf("%s: got underlying %s, want %s", name, g, w)
+		}
+		for _, typ := range [][2]types.Type{
+			{obj.Type(), want.Type()},
+			{types.NewPointer(obj.Type()), types.NewPointer(want.Type())},
+		} {
+			if g, w := types.NewMethodSet(typ[0]).String(), types.NewMethodSet(typ[1]).String(); g != w {
+				t.Errorf("method set of %s: got %s, want %s", typ[1], g, w)
+			}
+		}
+	}
+
+	// The decoded types are usable by the type checker.
+	const useSrc = `package use
+
+import (
+	"dep"
+	"p"
+)
+
+var (
+	_ int = p.V.Val.Next.Len()
+	_     = p.VL.Push(1).Push(2)
+	_     = p.Sum(1.5, 2)
+	_ dep.Closer   = p.Embed{}
+	_ p.Closer     = p.Embed{}
+	_ float64 = p.Third
+)
+`
+	f, err := parser.ParseFile(fset, "/src/use/use.go", useSrc, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errs []error
+	conf := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			return map[string]*types.Package{"dep": dep, "p": got}[path], nil
+		}),
+		Error: func(err error) { errs = append(errs, err) },
+	}
+	conf.Check("use", fset, []*ast.File{f}, nil)
+	if len(errs) != 0 {
+		t.Errorf("type-checking against the loaded package: %v", errs)
+	}
+}
+
+// TestExportNamedUnderlying checks that the underlying type of a named
+// type is never nil, even while the types it refers to are decoded.
+func TestExportNamedUnderlying(t *testing.T) {
+	// Decoding starts at B, whose underlying type refers to A, whose
+	// underlying type is B's, which is not decoded yet. The exporter
+	// never writes a named underlying type, but a corrupt entry may.
+	in := &exportPackage{
+		Path: "p",
+		Name: "p",
+		Pkgs: []exportPkg{{"p", "p"}},
+		Types: []exportType{
+			{Kind: tNamed, Name: "B", Elem: 1},
+			{Kind: tSlice, Elem: 2},
+			{Kind: tNamed, Name: "A", Elem: 0},
+		},
+		Objects: []exportField{
+			{Kind: oTypeName, Name: "B", Type: 0},
+			{Kind: oTypeName, Name: "A", Type: 2},
+		},
+	}
+	pkg := importTypes(in, nil, nil)
+	for _, name := range []string{"A", "B"} {
+		obj := pkg.Scope().Lookup(name)
+		if obj == nil {
+			t.Fatalf("%s: missing", name)
+		}
+		if obj.Type().Underlying() == nil {
+			t.Errorf("%s: nil underlying type", name)
+		}
+	}
+}
+
+// TestExportKeyDeps checks that the export cache entry of a package is
+// named by the entries of the packages it is type-checked against.
+func TestExportKeyDeps(t *testing.T) {
+	fset := token.NewFileSet()
+	const filename = "/src/p/p.go"
+	f, err := parser.ParseFile(fset, filename, "package p\n\nimport _ \"dep\"\n", parser.ImportsOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dep := &pkgInfo{path: "dep", key: "dep1"}
+	p := &pkgInfo{
+		path:    "p",
+		Package: &ast.Package{Name: "p", Files: map[string]*ast.File{filename: f}},
+		dir:     newDir(&pkgCache{key: "ctx"}, "/src/p"),
+		deps:    map[string]*pkgInfo{"dep": dep},
+	}
+	filenames, contents := []string{filename}, [][]byte{[]byte("package p\n")}
+
+	key := p.exportKey(filenames, contents)
+	if key == "" {
+		t.Fatal("no key")
+	}
+	if again := p.exportKey(filenames, contents); again != key {
+		t.Errorf("key changed from %s to %s", key, again)
+	}
+	dep.key = "dep2"
+	if changed := p.exportKey(filenames, contents); changed == key || changed == "" {
+		t.Errorf("key %s did not change with the entry of dep", changed)
+	}
+	dep.key = ""
+	if uncached := p.exportKey(filenames, contents); uncached != "" {
+		t.Errorf("got key %s although dep is not cacheable", uncached)
+	}
+	p.deps = nil
+	if missing := p.exportKey(filenames, contents); missing != "" {
+		t.Errorf("got key %s although dep is missing", missing)
+	}
+}
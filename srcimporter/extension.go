@@ -11,17 +11,24 @@ var makeExtension = func() extension { return &defaultExtension{} }
 
 // These functions exist to allow environment-specific customization.
 type extension interface {
-	// return true to indicate no change in context
-	SetContext(ctx *gbimporter.PackedContext, filename string) bool
+	SetContext(ctx *gbimporter.PackedContext, filename string)
+	// ContextKey identifies the context set by SetContext. Requests with
+	// the same key share a package cache.
+	ContextKey() string
 	LookupPaths(p *pkgCache, srcDir, pkgDir, pkgPath string) []string
+	// IndexRoots returns the directory trees holding the packages
+	// that a file in srcDir can import, in search order.
+	IndexRoots(p *pkgCache, srcDir string) []indexRoot
 	ImportName(pkgName, fileName string) string
 }
 
 type defaultExtension struct {
 	gopath []string
+	goroot string         // GOROOT/src
+	mod    *moduleContext // main module, or nil in GOPATH mode
 }
 
-func (e *defaultExtension) SetContext(ctx *gbimporter.PackedContext, filename string) bool {
+func (e *defaultExtension) SetContext(ctx *gbimporter.PackedContext, filename string) {
 	var paths []string
 	for _, p := range append([]string{ctx.GOROOT}, filepath.SplitList(ctx.GOPATH)...) {
 		if p != "" {
@@ -31,14 +38,23 @@ func (e *defaultExtension) SetContext(ctx *gbimporter.PackedContext, filename st
 			}
 		}
 	}
-	if strings.Join(paths, ";") != strings.Join(e.gopath, ";") {
-		e.gopath = paths
-		return false
+	e.gopath = paths
+	e.goroot = filepath.Join(ctx.GOROOT, "src")
+	e.mod = findModule(ctx, filename)
+}
+
+func (e *defaultExtension) ContextKey() string {
+	key := strings.Join(e.gopath, ";")
+	if e.mod != nil {
+		key += ";module=" + e.mod.key
 	}
-	return true
+	return key
 }
 
 func (e *defaultExtension) LookupPaths(p *pkgCache, srcDir, pkgDir, pkgPath string) []string {
+	if e.mod != nil {
+		return e.moduleLookupPaths(p, srcDir, pkgPath)
+	}
 	var paths []string
 	if EnableVendoring {
 		for _, d := range p.getVendorPaths(srcDir) {
@@ -51,6 +67,38 @@ func (e *defaultExtension) LookupPaths(p *pkgCache, srcDir, pkgDir, pkgPath stri
 	return paths
 }
 
+// moduleLookupPaths returns the lookup paths in module mode. Vendor
+// directories are only used by the standard library; the main module's
+// vendor directory is handled by e.mod.
+func (e *defaultExtension) moduleLookupPaths(p *pkgCache, srcDir, pkgPath string) []string {
+	var paths []string
+	if EnableVendoring && isSubdir(srcDir, e.goroot) {
+		for _, d := range p.getVendorPaths(srcDir) {
+			paths = append(paths, filepath.Join(d, pkgPath))
+		}
+	}
+	paths = append(paths, e.mod.lookupPaths(pkgPath)...)
+	return append(paths, filepath.Join(e.goroot, pkgPath))
+}
+
+func (e *defaultExtension) IndexRoots(p *pkgCache, srcDir string) []indexRoot {
+	var roots []indexRoot
+	if EnableVendoring && (e.mod == nil || isSubdir(srcDir, e.goroot)) {
+		for _, d := range p.getVendorPaths(srcDir) {
+			roots = append(roots, indexRoot{dir: d, fixed: isSubdir(d, e.goroot)})
+		}
+	}
+	if e.mod == nil {
+		for _, d := range e.gopath {
+			roots = append(roots, indexRoot{dir: d, fixed: d == e.goroot})
+		}
+		return roots
+	}
+	roots = append(roots, e.mod.indexRoots()...)
+	// GOROOT only changes when Go is upgraded.
+	return append(roots, indexRoot{dir: e.goroot, fixed: true})
+}
+
 func (d *defaultExtension) ImportName(pkgName, fileName string) string {
 	return filepath.Base(filepath.Dir(fileName))
 }
@@ -0,0 +1,330 @@
+package srcimporter
+
+import (
+	"go/types"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexTTL is how long the packages found under a directory tree that
+// may change are reused before the tree is scanned again. Trees in GOROOT
+// and the module cache never change and are scanned only once.
+const indexTTL = time.Minute
+
+// A PackageRef names a package that can be imported.
+type PackageRef struct {
+	Path string // import path
+	Name string // package name
+}
+
+// indexRoot is a directory tree of importable packages.
+type indexRoot struct {
+	dir    string
+	prefix string // import path of dir, or "" for a GOPATH src directory
+	fixed  bool   // the tree never changes, eg in the module cache
+}
+
+// rootIndex lists the packages found under an indexRoot. Trees are
+// scanned in the background. Until a tree was scanned completely, the
+// scan runs for the requests waiting for it: it stops once all of them
+// are done, and the next request continues it where it stopped. Later
+// scans refresh the list while the cache is in use.
+type rootIndex struct {
+	pkgs     []PackageRef // found by the last complete scan
+	complete bool         // a scan completed
+	scanTime time.Time    // start of the last complete scan
+
+	scanning  bool
+	walked    chan struct{}     // closed when the scan in progress ends
+	waiters   []<-chan struct{} // done channels of the requests scanned for
+	next      []PackageRef      // found by the scan in progress so far
+	nextStart time.Time         // start of the scan in progress
+	resume    string            // last directory scanned by an interrupted scan
+}
+
+// packageIndex caches the packages found under the roots of a pkgCache.
+type packageIndex struct {
+	mu    sync.Mutex
+	roots map[indexRoot]*rootIndex
+}
+
+// Packages returns the packages that a file in srcDir can import, sorted
+// by path. If packages with the same path are found under several roots,
+// the first one in the search order is returned, as it would be
+// imported. If a tree has not been scanned completely yet, Packages
+// waits for the scan until the request of imp is done, and then returns
+// the packages found so far. Packages returns nil unless imp was returned
+// by New.
+func Packages(imp types.Importer, srcDir string) []PackageRef {
+	c := toPkgCache(imp)
+	if c == nil {
+		return nil
+	}
+	var done <-chan struct{}
+	if p, ok := imp.(*sharedCache); ok {
+		done = p.loader.cancel
+	}
+	roots := c.ext.IndexRoots(c, srcDir)
+	var walks []chan struct{}
+	for _, root := range roots {
+		if walked := c.index.scan(c, root, done); walked != nil {
+			walks = append(walks, walked)
+		}
+	}
+	for _, walked := range walks {
+		select {
+		case <-walked:
+		case <-done:
+		}
+	}
+	var pkgs []PackageRef
+	seen := make(map[string]bool)
+	for _, root := range roots {
+		for _, pkg := range c.index.packages(root) {
+			if seen[pkg.Path] || !canImport(pkg.Path, root, srcDir) {
+				continue
+			}
+			seen[pkg.Path] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].Path < pkgs[j].Path })
+	return pkgs
+}
+
+// scan starts scanning root in the background unless it was scanned
+// recently. If root has not been scanned completely yet, the scan goes on
+// until done and the done channels of the other requests waiting for it
+// are closed, and scan returns a channel closed when the scan ends.
+func (x *packageIndex) scan(c *pkgCache, root indexRoot, done <-chan struct{}) chan struct{} {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.roots == nil {
+		x.roots = make(map[indexRoot]*rootIndex)
+	}
+	ri := x.roots[root]
+	if ri == nil {
+		ri = &rootIndex{}
+		x.roots[root] = ri
+	}
+	stale := !ri.complete || ri.resume != "" || !root.fixed && time.Since(ri.scanTime) >= indexTTL
+	if !stale || isDone(done) {
+		return nil
+	}
+	if ri.complete {
+		// Refresh the list while the cache is in use, and serve the
+		// old one meanwhile.
+		done = c.done
+	}
+	ri.waiters = append(ri.waiters, done)
+	if !ri.scanning {
+		if ri.resume == "" {
+			ri.next = nil
+			ri.nextStart = time.Now()
+		}
+		ri.scanning = true
+		ri.walked = make(chan struct{})
+		go x.walk(c, root, ri)
+	}
+	if ri.complete {
+		return nil
+	}
+	return ri.walked
+}
+
+// packages returns the packages found under root: those of the last
+// complete scan, or those found so far.
+func (x *packageIndex) packages(root indexRoot) []PackageRef {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	ri := x.roots[root]
+	if ri == nil {
+		return nil
+	}
+	if ri.complete {
+		return ri.pkgs
+	}
+	return ri.next
+}
+
+// walk scans root for packages, starting after ri.resume, until the
+// requests waiting for it are done or the cache is closed.
+func (x *packageIndex) walk(c *pkgCache, root indexRoot, ri *rootIndex) {
+	x.mu.Lock()
+	resume := ri.resume
+	x.mu.Unlock()
+	stopped := false
+	filepath.WalkDir(root.dir, func(dir string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if !x.wanted(ri) || isDone(c.done) {
+			stopped = true
+			return filepath.SkipAll
+		}
+		if resume != "" {
+			// Directories up to resume, in the order of
+			// WalkDir, were scanned already; descend only into
+			// those on the way to it.
+			switch {
+			case compareWalkOrder(dir, resume) > 0:
+				resume = ""
+			case isSubdir(resume, dir):
+				return nil
+			default:
+				return filepath.SkipDir
+			}
+		}
+		if dir != root.dir {
+			name := d.Name()
+			if name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+			// Nested modules have import paths of their own.
+			if root.prefix != "" && isFile(filepath.Join(dir, "go.mod")) {
+				return filepath.SkipDir
+			}
+		}
+		rel := filepath.ToSlash(strings.TrimPrefix(dir, root.dir))
+		pkgPath := strings.Trim(path.Join(root.prefix, rel), "/")
+		switch {
+		case pkgPath == "cmd" && root.prefix == "":
+			// Only importable by the commands themselves.
+			return filepath.SkipDir
+		case pkgPath == "builtin" && root.prefix == "":
+			// Documentation of the predeclared identifiers.
+			return filepath.SkipDir
+		}
+		var pkg PackageRef
+		if pkgPath != "" {
+			pkg = PackageRef{Path: pkgPath, Name: c.dirPackageName(dir)}
+		}
+		x.mu.Lock()
+		if pkg.Name != "" {
+			ri.next = append(ri.next, pkg)
+		}
+		ri.resume = dir
+		x.mu.Unlock()
+		return nil
+	})
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if stopped {
+		if ri.pruneWaiters() && !isDone(c.done) {
+			// A request started waiting while the scan stopped.
+			go x.walk(c, root, ri)
+			return
+		}
+		ri.scanning = false
+		close(ri.walked)
+		return
+	}
+	ri.scanning = false
+	close(ri.walked)
+	ri.waiters = nil
+	ri.pkgs, ri.next = ri.next, nil
+	ri.complete = true
+	ri.scanTime = ri.nextStart
+	ri.resume = ""
+}
+
+// wanted reports whether any request waiting for the scan of ri is not
+// done yet.
+func (x *packageIndex) wanted(ri *rootIndex) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return ri.pruneWaiters()
+}
+
+// pruneWaiters forgets the requests waiting for the scan that are done,
+// and reports whether any are left. The index must be locked.
+func (ri *rootIndex) pruneWaiters() bool {
+	waiters := ri.waiters[:0]
+	for _, done := range ri.waiters {
+		if !isDone(done) {
+			waiters = append(waiters, done)
+		}
+	}
+	ri.waiters = waiters
+	return len(waiters) > 0
+}
+
+// compareWalkOrder compares the order in which filepath.WalkDir visits
+// the directories a and b, returning -1, 0 or +1.
+func compareWalkOrder(a, b string) int {
+	as := strings.Split(a, string(filepath.Separator))
+	bs := strings.Split(b, string(filepath.Separator))
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(as) - len(bs))
+}
+
+// dirPackageName returns the name of the package in dir, or "" if it
+// has no buildable files.
+func (c *pkgCache) dirPackageName(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if !c.ctxt.UseAllFiles && !c.ctxt.goodOSArchFile(name, nil) {
+			continue
+		}
+		if pkgName, err := scanPkg(filepath.Join(dir, name), nil, &c.ctxt); err == nil && pkgName != "" {
+			return pkgName
+		}
+	}
+	return ""
+}
+
+// importPath returns the path by which a file in dir imports the package
+// in dir, or "" if dir is not under any of the roots of the cache.
+func (c *pkgCache) importPath(dir string) string {
+	for _, root := range c.ext.IndexRoots(c, dir) {
+		if !isSubdir(dir, root.dir) || dir == root.dir && root.prefix == "" {
+			continue
+		}
+		if root.prefix != "" && inNestedModule(dir, root.dir) {
+			continue
+		}
+		rel := filepath.ToSlash(strings.TrimPrefix(dir, root.dir))
+		return strings.Trim(path.Join(root.prefix, rel), "/")
+	}
+	return ""
+}
+
+// inNestedModule reports whether dir, below root, belongs to a module
+// of its own.
+func inNestedModule(dir, root string) bool {
+	for ; dir != root && isSubdir(dir, root); dir = filepath.Dir(dir) {
+		if isFile(filepath.Join(dir, "go.mod")) {
+			return true
+		}
+	}
+	return false
+}
+
+// canImport reports whether a file in srcDir may import pkgPath found
+// under root: internal packages may only be imported from within the
+// tree rooted at the parent of the internal directory.
+func canImport(pkgPath string, root indexRoot, srcDir string) bool {
+	i := strings.LastIndex("/"+pkgPath+"/", "/internal/")
+	if i < 0 {
+		return true
+	}
+	parent := strings.TrimPrefix(pkgPath[:max(i-1, 0)], root.prefix)
+	return isSubdir(srcDir, filepath.Join(root.dir, filepath.FromSlash(parent)))
+}
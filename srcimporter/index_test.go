@@ -0,0 +1,95 @@
+package srcimporter
+
+import (
+	"go/build"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mdempsky/gocode/gbimporter"
+)
+
+func TestCompareWalkOrder(t *testing.T) {
+	var tests = [...]struct {
+		a, b string
+		want int
+	}{
+		{"/src/a", "/src/a", 0},
+		{"/src/a", "/src/a/b", -1},
+		{"/src/a/z", "/src/b", -1},
+		{"/src/a-b", "/src/a/b", +1}, // even though '-' < '/'
+		{"/src/ab", "/src/a/b", +1},
+	}
+	for _, test := range tests {
+		a, b := filepath.FromSlash(test.a), filepath.FromSlash(test.b)
+		if got := compareWalkOrder(a, b); got != test.want {
+			t.Errorf("compareWalkOrder(%s, %s) = %d, want %d", a, b, got, test.want)
+		}
+	}
+}
+
+func indexTestContext(t *testing.T) (gbimporter.PackedContext, string) {
+	gopath := t.TempDir()
+	writeTree(t, gopath, map[string]string{
+		"src/a/a.go":          "package a\n",
+		"src/a/b/b.go":        "package b\n",
+		"src/a/b/c/c.go":      "package c\n",
+		"src/a/testdata/t.go": "package t\n",
+		"src/d/d.go":          "package d\n",
+		"src/e/main.go":       "package main\n",
+		"src/f/f.go":          "package f\n",
+	})
+	ctx := gbimporter.PackContext(&build.Default)
+	ctx.GOROOT = filepath.Join(gopath, "goroot")
+	ctx.GOPATH = gopath
+	ctx.GO111MODULE = "off"
+	return ctx, filepath.Join(gopath, "src", "main", "main.go")
+}
+
+func packagePaths(refs []PackageRef) []string {
+	var paths []string
+	for _, ref := range refs {
+		paths = append(paths, ref.Path)
+	}
+	return paths
+}
+
+func TestPackagesIndex(t *testing.T) {
+	ctx, filename := indexTestContext(t)
+	want := []string{"a", "a/b", "a/b/c", "d", "f"}
+
+	// A canceled request does not scan.
+	done := make(chan struct{})
+	close(done)
+	if got := Packages(New(&ctx, filename, nil, done), filepath.Dir(filename)); len(got) != 0 {
+		t.Errorf("Packages of a canceled request = %v, want none", got)
+	}
+
+	// Requests that are never done wait for the whole scan.
+	if got := packagePaths(Packages(New(&ctx, filename, nil, nil), filepath.Dir(filename))); !reflect.DeepEqual(got, want) {
+		t.Errorf("Packages = %v, want %v", got, want)
+	}
+}
+
+// TestIndexResume checks that a scan continues after the last directory
+// scanned by an interrupted one.
+func TestIndexResume(t *testing.T) {
+	ctx, filename := indexTestContext(t)
+	c := toPkgCache(New(&ctx, filename, nil, nil))
+	root := indexRoot{dir: filepath.Join(ctx.GOPATH, "src")}
+	ri := &rootIndex{
+		walked:  make(chan struct{}),
+		waiters: []<-chan struct{}{make(chan struct{})},
+		next:    []PackageRef{{Path: "a", Name: "a"}, {Path: "a/b", Name: "b"}},
+		resume:  filepath.Join(root.dir, "a", "b"),
+	}
+	var x packageIndex
+	x.walk(c, root, ri)
+	<-ri.walked
+	if !ri.complete || ri.resume != "" {
+		t.Errorf("scan not complete: resume=%q", ri.resume)
+	}
+	if got, want := packagePaths(ri.pkgs), []string{"a", "a/b", "a/b/c", "d", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed scan found %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,574 @@
+package srcimporter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/mdempsky/gocode/gbimporter"
+)
+
+// In module mode, imports are resolved the way the go command resolves
+// them, but only from the local module cache: a package belongs to the
+// module with the longest path that is a prefix of its import path, and
+// the version of the module is the one required by go.mod, falling back
+// to the highest version in go.sum for modules go.mod does not list.
+// Nothing is ever downloaded.
+//
+// In a workspace, every module listed in go.work is a main module, and
+// the version of a dependency is the highest one any of them requires.
+//
+// The settings of the go command that affect this, GO111MODULE,
+// GOMODCACHE, GOWORK and the -mod flag in GOFLAGS, are those of the
+// client, carried by the request's context, not those of the daemon.
+
+// modFile holds the parts of a go.mod or go.work file needed to resolve
+// imports.
+type modFile struct {
+	path     string            // module path
+	requires map[string]string // module path -> version
+	replaces []modReplace
+	uses     []string // module directories listed in go.work
+}
+
+// modReplace is a replace directive. If newVersion is empty, new is a
+// directory, relative to the module root unless absolute.
+type modReplace struct {
+	old, oldVersion string // oldVersion is empty if all versions are replaced
+	new, newVersion string
+}
+
+// moduleContext resolves imports for files in a main module or workspace.
+type moduleContext struct {
+	root     string            // directory containing go.work, or go.mod outside workspaces
+	mains    map[string]string // main module path -> directory
+	requires map[string]string // module path -> highest version required
+	replaces []modReplace      // replacement directories are absolute
+	sumFiles []string
+	modCache string // GOMODCACHE
+	modFlag  string // -mod flag: "", "mod", "readonly" or "vendor"
+	vendor   string // vendor directory of the main module or workspace, if any
+	key      string // identifies the settings, root and the contents of go.work, go.mod and go.sum files
+
+	// Read on first use. A change to the go.sum files changes the
+	// key, so they are read again for the new cache.
+	sumOnce sync.Once
+	sum     map[string]string // module path -> highest version in go.sum files
+}
+
+// findModule returns the module context of the file, or nil if it is not
+// in a module or modules are disabled in ctx.
+func findModule(ctx *gbimporter.PackedContext, filename string) *moduleContext {
+	if filename == "" || ctx.GO111MODULE == "off" {
+		return nil
+	}
+	root := findEnclosing(filepath.Dir(filename), "go.mod")
+	if work := findWorkspace(ctx.GOWORK, filename); work != "" {
+		// Like the go command, ignore the workspace for modules it
+		// does not use.
+		if m := newWorkspaceContext(ctx, work); m != nil && (root == "" || m.hasMain(root)) {
+			return m
+		}
+	}
+	if root == "" {
+		return nil
+	}
+	return newModuleContext(ctx, root)
+}
+
+// newContext returns a context for the main modules or workspace in root
+// with the settings of ctx.
+func newContext(ctx *gbimporter.PackedContext, root string) *moduleContext {
+	return &moduleContext{
+		root:     root,
+		mains:    make(map[string]string),
+		requires: make(map[string]string),
+		modCache: modCacheDir(ctx),
+		modFlag:  goFlag(ctx.GOFLAGS, "mod"),
+	}
+}
+
+// setKey sets m.key from the settings of m, its root and h, the hash of
+// the contents of its go.work and go.mod files, to which it adds those
+// of its go.sum files.
+func (m *moduleContext) setKey(h hash.Hash) {
+	for _, filename := range m.sumFiles {
+		if data, err := ioutil.ReadFile(filename); err == nil {
+			h.Write(data)
+		}
+	}
+	m.key = fmt.Sprintf("%s@%x", m.root, h.Sum(nil)[:6])
+	if m.vendor != "" {
+		m.key += ";vendor"
+	} else {
+		m.key += ";modcache=" + m.modCache
+	}
+}
+
+// findEnclosing returns the nearest directory at or above dir containing
+// the file name, or "" if there is none.
+func findEnclosing(dir, name string) string {
+	for !isFile(filepath.Join(dir, name)) {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+	return dir
+}
+
+// findWorkspace returns the go.work file for the file, as chosen by the
+// GOWORK setting or found in an enclosing directory, or "" if there is
+// none.
+func findWorkspace(work, filename string) string {
+	switch work {
+	case "off":
+		return ""
+	case "":
+		if dir := findEnclosing(filepath.Dir(filename), "go.work"); dir != "" {
+			return filepath.Join(dir, "go.work")
+		}
+		return ""
+	default:
+		return work
+	}
+}
+
+// readModFile reads and parses a go.mod or go.work file. It returns nil
+// if the file cannot be read.
+func readModFile(filename string) (*modFile, []byte) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil
+	}
+	return parseModFile(data), data
+}
+
+// newModuleContext returns the context of the module in root, or nil if
+// its go.mod is unusable.
+func newModuleContext(ctx *gbimporter.PackedContext, root string) *moduleContext {
+	mod, data := readModFile(filepath.Join(root, "go.mod"))
+	if mod == nil || mod.path == "" {
+		return nil
+	}
+	m := newContext(ctx, root)
+	m.mains[mod.path] = root
+	m.requires = mod.requires
+	m.sumFiles = []string{filepath.Join(root, "go.sum")}
+	m.addReplaces(root, mod.replaces)
+	m.findVendor()
+	h := sha256.New()
+	h.Write(data)
+	m.setKey(h)
+	return m
+}
+
+// newWorkspaceContext returns the context of the workspace described by
+// the go.work file, or nil if it is unusable.
+func newWorkspaceContext(ctx *gbimporter.PackedContext, work string) *moduleContext {
+	wf, data := readModFile(work)
+	if wf == nil {
+		return nil
+	}
+	root := filepath.Dir(work)
+	m := newContext(ctx, root)
+	m.sumFiles = []string{filepath.Join(root, "go.work.sum")}
+	// Replacements in go.work override those of the modules.
+	m.addReplaces(root, wf.replaces)
+	h := sha256.New()
+	h.Write(data)
+	for _, use := range wf.uses {
+		dir := use
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(root, dir)
+		}
+		mod, data := readModFile(filepath.Join(dir, "go.mod"))
+		if mod == nil || mod.path == "" {
+			continue
+		}
+		h.Write(data)
+		m.mains[mod.path] = dir
+		for path, version := range mod.requires {
+			if v := m.requires[path]; v == "" || compareVersions(version, v) > 0 {
+				m.requires[path] = version
+			}
+		}
+		m.addReplaces(dir, mod.replaces)
+		m.sumFiles = append(m.sumFiles, filepath.Join(dir, "go.sum"))
+	}
+	if len(m.mains) == 0 {
+		return nil
+	}
+	m.findVendor()
+	m.setKey(h)
+	return m
+}
+
+// addReplaces adds replace directives of a go.mod or go.work file in dir.
+func (m *moduleContext) addReplaces(dir string, replaces []modReplace) {
+	for _, r := range replaces {
+		if r.newVersion == "" && !filepath.IsAbs(r.new) {
+			r.new = filepath.Join(dir, r.new)
+		}
+		m.replaces = append(m.replaces, r)
+	}
+}
+
+// findVendor sets m.vendor if the go command uses a vendor directory
+// instead of the module cache: if -mod=vendor is set, or by default if
+// go mod vendor or go work vendor created one.
+func (m *moduleContext) findVendor() {
+	vendor := filepath.Join(m.root, "vendor")
+	switch m.modFlag {
+	case "vendor":
+		m.vendor = vendor
+	case "":
+		if isFile(filepath.Join(vendor, "modules.txt")) {
+			m.vendor = vendor
+		}
+	}
+}
+
+// hasMain reports whether dir holds one of the main modules.
+func (m *moduleContext) hasMain(dir string) bool {
+	for _, d := range m.mains {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// modCacheDir returns the module cache directory of ctx.
+func modCacheDir(ctx *gbimporter.PackedContext) string {
+	if ctx.GOMODCACHE != "" {
+		return ctx.GOMODCACHE
+	}
+	for _, p := range filepath.SplitList(ctx.GOPATH) {
+		if p != "" {
+			return filepath.Join(p, "pkg", "mod")
+		}
+	}
+	return ""
+}
+
+// goFlag returns the value of the flag with the given name in goflags, a
+// GOFLAGS setting, or "" if it is not set there.
+func goFlag(goflags, name string) string {
+	var value string
+	for _, f := range strings.Fields(goflags) {
+		f = strings.TrimPrefix(strings.TrimPrefix(f, "-"), "-")
+		if v, ok := strings.CutPrefix(f, name+"="); ok {
+			value = v
+		}
+	}
+	return value
+}
+
+// lookupPaths returns the directories that may contain the package with
+// the given import path, best first.
+func (m *moduleContext) lookupPaths(pkgPath string) []string {
+	var paths []string
+	for prefix := pkgPath; ; {
+		if dir := m.moduleDir(prefix); dir != "" {
+			paths = append(paths, filepath.Join(dir, strings.TrimPrefix(pkgPath, prefix)))
+		}
+		i := strings.LastIndex(prefix, "/")
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+	return paths
+}
+
+// indexRoots returns the directories of the main modules and the
+// modules they require, sorted by module path.
+func (m *moduleContext) indexRoots() []indexRoot {
+	var roots []indexRoot
+	for path, dir := range m.mains {
+		roots = append(roots, indexRoot{dir: dir, prefix: path})
+	}
+	for path := range m.requires {
+		if m.mains[path] != "" {
+			continue
+		}
+		if dir := m.moduleDir(path); dir != "" {
+			roots = append(roots, indexRoot{dir: dir, prefix: path, fixed: isSubdir(dir, m.modCache)})
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].prefix < roots[j].prefix })
+	return roots
+}
+
+// moduleDir returns the directory of the module with the given path, or
+// "" if it is not in the build list.
+func (m *moduleContext) moduleDir(modPath string) string {
+	if dir := m.mains[modPath]; dir != "" {
+		return dir
+	}
+	version := m.requires[modPath]
+	if m.vendor != "" {
+		// Vendored modules are stored under their original paths,
+		// even if they are replaced.
+		if version == "" {
+			return ""
+		}
+		return filepath.Join(m.vendor, modPath)
+	}
+	if version == "" {
+		version = m.sumVersion(modPath)
+	}
+	for _, r := range m.replaces {
+		if r.old != modPath || (r.oldVersion != "" && r.oldVersion != version) {
+			continue
+		}
+		if r.newVersion == "" {
+			return r.new
+		}
+		return m.cachedModuleDir(r.new, r.newVersion)
+	}
+	if version == "" {
+		return ""
+	}
+	return m.cachedModuleDir(modPath, version)
+}
+
+// cachedModuleDir returns the directory of a module version in the module
+// cache.
+func (m *moduleContext) cachedModuleDir(modPath, version string) string {
+	if m.modCache == "" {
+		return ""
+	}
+	return filepath.Join(m.modCache, escapeModPath(modPath)+"@"+escapeModPath(version))
+}
+
+// sumVersion returns the highest version of the module whose contents are
+// listed in the go.sum files, or "" if there is none. Modules written
+// before Go 1.17 only require their direct dependencies in go.mod.
+func (m *moduleContext) sumVersion(modPath string) string {
+	m.sumOnce.Do(func() {
+		m.sum = make(map[string]string)
+		for _, filename := range m.sumFiles {
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				continue
+			}
+			s := bufio.NewScanner(bytes.NewReader(data))
+			for s.Scan() {
+				f := strings.Fields(s.Text())
+				// Lines for go.mod files only have versions ending
+				// in "/go.mod"; the module itself may not be
+				// downloaded.
+				if len(f) != 3 || strings.HasSuffix(f[1], "/go.mod") {
+					continue
+				}
+				if v := m.sum[f[0]]; v == "" || compareVersions(f[1], v) > 0 {
+					m.sum[f[0]] = f[1]
+				}
+			}
+		}
+	})
+	return m.sum[modPath]
+}
+
+// parseModFile parses the module, require, replace and use directives of
+// a go.mod or go.work file, ignoring anything it does not understand.
+func parseModFile(data []byte) *modFile {
+	mod := &modFile{requires: make(map[string]string)}
+	var block string // directive of the enclosing block, if any
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		f := modFields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if block != "" {
+			if f[0] == ")" {
+				block = ""
+				continue
+			}
+			f = append([]string{block}, f...)
+		} else if len(f) == 2 && f[1] == "(" {
+			block = f[0]
+			continue
+		}
+		switch f[0] {
+		case "module":
+			if len(f) == 2 {
+				mod.path = f[1]
+			}
+		case "require":
+			if len(f) == 3 {
+				mod.requires[f[1]] = f[2]
+			}
+		case "use":
+			if len(f) == 2 {
+				mod.uses = append(mod.uses, f[1])
+			}
+		case "replace":
+			if r, ok := parseReplace(f[1:]); ok {
+				mod.replaces = append(mod.replaces, r)
+			}
+		}
+	}
+	// Replacements of specific versions take precedence.
+	var replaces []modReplace
+	for _, r := range mod.replaces {
+		if r.oldVersion != "" {
+			replaces = append(replaces, r)
+		}
+	}
+	for _, r := range mod.replaces {
+		if r.oldVersion == "" {
+			replaces = append(replaces, r)
+		}
+	}
+	mod.replaces = replaces
+	return mod
+}
+
+// parseReplace parses the arguments of a replace directive:
+// old [version] => new [version].
+func parseReplace(f []string) (r modReplace, ok bool) {
+	arrow := -1
+	for i, s := range f {
+		if s == "=>" {
+			arrow = i
+		}
+	}
+	if arrow < 1 {
+		return r, false
+	}
+	old, new := f[:arrow], f[arrow+1:]
+	if len(old) > 2 || len(new) < 1 || len(new) > 2 {
+		return r, false
+	}
+	r.old = old[0]
+	if len(old) == 2 {
+		r.oldVersion = old[1]
+	}
+	r.new = new[0]
+	if len(new) == 2 {
+		r.newVersion = new[1]
+	}
+	return r, true
+}
+
+// modFields splits a go.mod line into fields, unquoting quoted strings.
+func modFields(line string) []string {
+	var fields []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] == '"' || line[0] == '`' {
+			prefix, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil
+			}
+			s, _ := strconv.Unquote(prefix)
+			fields = append(fields, s)
+			line = line[len(prefix):]
+			continue
+		}
+		i := strings.IndexFunc(line, unicode.IsSpace)
+		if i < 0 {
+			i = len(line)
+		}
+		fields = append(fields, line[:i])
+		line = line[i:]
+	}
+	return fields
+}
+
+// escapeModPath escapes a module path or version for use in the module
+// cache, which replaces upper-case letters by "!" and their lower-case
+// forms to work on case-insensitive file systems.
+func escapeModPath(s string) string {
+	var buf strings.Builder
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			buf.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// compareVersions compares two semantic versions such as v1.2.3-pre, and
+// returns -1, 0 or +1.
+func compareVersions(a, b string) int {
+	a, _, _ = strings.Cut(strings.TrimPrefix(a, "v"), "+")
+	b, _, _ = strings.Cut(strings.TrimPrefix(b, "v"), "+")
+	a, apre, _ := strings.Cut(a, "-")
+	b, bpre, _ := strings.Cut(b, "-")
+	if c := compareDotted(a, b); c != 0 {
+		return c
+	}
+	// A version without prerelease is higher than one with.
+	switch {
+	case apre == bpre:
+		return 0
+	case apre == "":
+		return +1
+	case bpre == "":
+		return -1
+	}
+	return compareDotted(apre, bpre)
+}
+
+// compareDotted compares dot-separated identifiers, numerically if both
+// are numbers.
+func compareDotted(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, y := as[i], bs[i]
+		xnum, ynum := isNumber(x), isNumber(y)
+		switch {
+		case xnum && ynum && len(x) != len(y):
+			return sign(len(x) - len(y))
+		case xnum != ynum:
+			// Numbers are lower than other identifiers.
+			if xnum {
+				return -1
+			}
+			return +1
+		case x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return sign(len(as) - len(bs))
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return +1
+	}
+	return 0
+}
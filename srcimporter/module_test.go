@@ -0,0 +1,220 @@
+package srcimporter
+
+import (
+	"go/build"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/mdempsky/gocode/gbimporter"
+)
+
+// TestModuleImports imports packages from the modules in testdata/mod,
+// whose module cache is testdata/mod/modcache.
+func TestModuleImports(t *testing.T) {
+	root, err := filepath.Abs(filepath.Join("testdata", "mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = [...]struct {
+		file    string // file importing the package, relative to root
+		goflags string
+		gowork  string
+		path    string // package to import
+		want    string // its constant V, or "" if it cannot be imported
+	}{
+		// Versions required by go.mod.
+		{file: "main/main.go", path: "example.com/dep", want: "v1.1.0"},
+		// Escaped upper-case letters in module paths and versions.
+		{file: "main/main.go", path: "example.com/Upper/sub", want: "upper"},
+		// Replaced by a directory.
+		{file: "main/main.go", path: "example.com/old", want: "replaced"},
+		// Not in go.mod: the highest version with contents in go.sum.
+		{file: "main/main.go", path: "example.com/sumonly", want: "v1.2.0"},
+		{file: "main/main.go", path: "example.com/main/internal/x", want: "main"},
+		{file: "main/main.go", path: "example.com/missing", want: ""},
+
+		// The main modules of a workspace import each other, and
+		// the highest version any of them requires is used.
+		{file: "work/a/a.go", path: "example.com/b", want: "b"},
+		{file: "work/a/a.go", path: "example.com/dep", want: "v1.1.0"},
+		{file: "work/a/a.go", gowork: "off", path: "example.com/dep", want: "v1.0.0"},
+		{file: "work/a/a.go", gowork: "off", path: "example.com/b", want: ""},
+		{file: "main/main.go", gowork: "work/go.work", path: "example.com/b", want: ""},
+
+		// The vendor directory is used unless -mod says otherwise.
+		{file: "vendored/vendored.go", path: "example.com/dep", want: "vendored"},
+		{file: "vendored/vendored.go", goflags: "-mod=vendor", path: "example.com/dep", want: "vendored"},
+		{file: "vendored/vendored.go", goflags: "-trimpath -mod=mod", path: "example.com/dep", want: "v1.0.0"},
+		{file: "vendored/vendored.go", goflags: "--mod=readonly", path: "example.com/dep", want: "v1.0.0"},
+	}
+	for _, test := range tests {
+		ctx := gbimporter.PackContext(&build.Default)
+		ctx.GOPATH = filepath.Join(root, "gopath")
+		ctx.GO111MODULE = "on"
+		ctx.GOMODCACHE = filepath.Join(root, "modcache")
+		ctx.GOFLAGS = test.goflags
+		ctx.GOWORK = test.gowork
+		if ctx.GOWORK != "" && ctx.GOWORK != "off" {
+			ctx.GOWORK = filepath.Join(root, filepath.FromSlash(ctx.GOWORK))
+		}
+		filename := filepath.Join(root, filepath.FromSlash(test.file))
+		imp := New(&ctx, filename, nil, nil)
+		got := ""
+		if pkg, err := imp.ImportFrom(test.path, filepath.Dir(filename), 0); err == nil {
+			got = constValue(pkg, "V")
+		}
+		want := ""
+		if test.want != "" {
+			want = strconv.Quote(test.want)
+		}
+		if got != want {
+			t.Errorf("%s (GOFLAGS=%q GOWORK=%q): import %s: V = %s, want %s", test.file, test.goflags, test.gowork, test.path, got, want)
+		}
+	}
+}
+
+func TestFindModuleSettings(t *testing.T) {
+	root, err := filepath.Abs(filepath.Join("testdata", "mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(root, "main", "main.go")
+	ctx := gbimporter.PackedContext{GOPATH: filepath.Join(root, "gopath")}
+	m := findModule(&ctx, filename)
+	if m == nil {
+		t.Fatal("no module found")
+	}
+	if want := filepath.Join(root, "gopath", "pkg", "mod"); m.modCache != want {
+		t.Errorf("module cache %s, want %s", m.modCache, want)
+	}
+	ctx.GOMODCACHE = filepath.Join(root, "modcache")
+	if m2 := findModule(&ctx, filename); m2.modCache != ctx.GOMODCACHE || m2.key == m.key {
+		t.Errorf("with GOMODCACHE: module cache %s, key %s; want %s and a key other than %s", m2.modCache, m2.key, ctx.GOMODCACHE, m.key)
+	}
+	ctx.GO111MODULE = "off"
+	if m := findModule(&ctx, filename); m != nil {
+		t.Errorf("found module %s with GO111MODULE=off", m.root)
+	}
+}
+
+// TestModuleSumKey checks that a change to go.sum, which can change the
+// versions of modules go.mod does not list, changes the key.
+func TestModuleSumKey(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"go.mod": "module example.com/m\n",
+		"go.sum": "example.com/dep v1.0.0 h1:x=\n",
+	})
+	filename := filepath.Join(root, "m.go")
+	ctx := gbimporter.PackedContext{GOPATH: filepath.Join(root, "gopath")}
+	m := findModule(&ctx, filename)
+	if v := m.sumVersion("example.com/dep"); v != "v1.0.0" {
+		t.Errorf("sumVersion = %s, want v1.0.0", v)
+	}
+	if again := findModule(&ctx, filename); again.key != m.key {
+		t.Errorf("key changed from %s to %s without changes", m.key, again.key)
+	}
+
+	writeTree(t, root, map[string]string{"go.sum": "example.com/dep v1.0.0 h1:x=\nexample.com/dep v1.1.0 h1:y=\n"})
+	m2 := findModule(&ctx, filename)
+	if m2.key == m.key {
+		t.Errorf("key %s did not change with go.sum", m.key)
+	}
+	if v := m2.sumVersion("example.com/dep"); v != "v1.1.0" {
+		t.Errorf("sumVersion after go get = %s, want v1.1.0", v)
+	}
+}
+
+func TestEscapeModPath(t *testing.T) {
+	var tests = [...]struct {
+		path, escaped string
+	}{
+		{"example.com/foo", "example.com/foo"},
+		{"github.com/Azure/azure-sdk", "github.com/!azure/azure-sdk"},
+		{"github.com/BurntSushi/TOML", "github.com/!burnt!sushi/!t!o!m!l"},
+		{"v1.0.0-RC1", "v1.0.0-!r!c1"},
+	}
+	for _, test := range tests {
+		if got := escapeModPath(test.path); got != test.escaped {
+			t.Errorf("escapeModPath(%q) = %q, want %q", test.path, got, test.escaped)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	// In increasing order; versions on the same line are equal.
+	var order = [...][]string{
+		{"v0.0.1"},
+		{"v1.0.0-alpha"},
+		{"v1.0.0-alpha.1"},
+		{"v1.0.0-alpha.beta"},
+		{"v1.0.0-beta"},
+		{"v1.0.0-beta.2"},
+		{"v1.0.0-beta.11"},
+		{"v1.0.0-rc.1"},
+		{"v1.0.0", "v1.0.0+incompatible", "v1.0.0+meta"},
+		{"v1.2.0"},
+		{"v1.10.0"},
+		{"v2.0.0-20190101000000-abcdef012345"},
+		{"v2.0.0+incompatible"},
+	}
+	for i, a := range order {
+		for j, b := range order {
+			for _, x := range a {
+				for _, y := range b {
+					if got, want := compareVersions(x, y), sign(i-j); got != want {
+						t.Errorf("compareVersions(%s, %s) = %d, want %d", x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGoFlag(t *testing.T) {
+	var tests = [...]struct {
+		goflags, mod string
+	}{
+		{"", ""},
+		{"-mod=vendor", "vendor"},
+		{"-trimpath --mod=mod", "mod"},
+		{"-mod=mod -mod=readonly", "readonly"},
+		{"-modfile=x.mod", ""},
+	}
+	for _, test := range tests {
+		if got := goFlag(test.goflags, "mod"); got != test.mod {
+			t.Errorf("goFlag(%q, mod) = %q, want %q", test.goflags, got, test.mod)
+		}
+	}
+}
+
+func TestParseModFile(t *testing.T) {
+	mod := parseModFile([]byte(`module "example.com/m" // comment
+
+require (
+	example.com/a v1.0.0
+	example.com/b v1.2.3 // indirect
+)
+require example.com/c v0.1.0
+
+replace example.com/a => ../a
+replace (
+	example.com/b v1.2.3 => example.com/fork v1.2.4
+)
+`))
+	if mod.path != "example.com/m" {
+		t.Errorf("module path %q", mod.path)
+	}
+	if len(mod.requires) != 3 || mod.requires["example.com/b"] != "v1.2.3" || mod.requires["example.com/c"] != "v0.1.0" {
+		t.Errorf("requires %v", mod.requires)
+	}
+	// Replacements of specific versions come first.
+	want := []modReplace{
+		{old: "example.com/b", oldVersion: "v1.2.3", new: "example.com/fork", newVersion: "v1.2.4"},
+		{old: "example.com/a", new: "../a"},
+	}
+	if len(mod.replaces) != len(want) || mod.replaces[0] != want[0] || mod.replaces[1] != want[1] {
+		t.Errorf("replaces %+v, want %+v", mod.replaces, want)
+	}
+}
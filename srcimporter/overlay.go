@@ -0,0 +1,72 @@
+package srcimporter
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mdempsky/gocode/pkgfiles"
+)
+
+// requestOverlay is the overlay of a single request. Packages are cached
+// by the contents of the overlaid files they were parsed from, directly
+// or through their imports, so that requests with different overlays can
+// share a cache without seeing each other's unsaved buffers.
+type requestOverlay struct {
+	files pkgfiles.Overlay
+	dirs  map[string]string // directory -> fingerprint of its overlaid files
+}
+
+func newRequestOverlay(files pkgfiles.Overlay) *requestOverlay {
+	byDir := make(map[string][]string)
+	for filename := range files {
+		if isPackageFile(filepath.Base(filename)) {
+			dir := filepath.Dir(filename)
+			byDir[dir] = append(byDir[dir], filename)
+		}
+	}
+	o := &requestOverlay{files: files, dirs: make(map[string]string, len(byDir))}
+	for dir, filenames := range byDir {
+		sort.Strings(filenames)
+		h := sha256.New()
+		for _, filename := range filenames {
+			fmt.Fprintf(h, "%s %x\n", filepath.Base(filename), sha256.Sum256(files[filename]))
+		}
+		o.dirs[dir] = fmt.Sprintf("%x", h.Sum(nil)[:16])
+	}
+	return o
+}
+
+// fingerprint identifies the contents of the overlaid package files in
+// dir. It is "" if there are none. A nil overlay is empty.
+func (o *requestOverlay) fingerprint(dir string) string {
+	if o == nil {
+		return ""
+	}
+	return o.dirs[dir]
+}
+
+// overlays reports whether the overlay replaces filename.
+func (o *requestOverlay) overlays(filename string) bool {
+	if o == nil {
+		return false
+	}
+	_, ok := o.files[filename]
+	return ok
+}
+
+// fileSet returns the overlay's files, or nil.
+func (o *requestOverlay) fileSet() pkgfiles.Overlay {
+	if o == nil {
+		return nil
+	}
+	return o.files
+}
+
+// isPackageFile reports whether the file name may belong to the package
+// of a directory, as opposed to its tests.
+func isPackageFile(name string) bool {
+	return strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go")
+}
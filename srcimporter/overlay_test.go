@@ -0,0 +1,138 @@
+package srcimporter
+
+import (
+	"fmt"
+	"go/build"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mdempsky/gocode/gbimporter"
+	"github.com/mdempsky/gocode/pkgfiles"
+)
+
+// writeTree creates the files in dir, by slash-separated relative path.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestOverlayIsolation imports a package through importers with different
+// overlays of one of its dependencies, concurrently and sharing a cache.
+func TestOverlayIsolation(t *testing.T) {
+	gopath := t.TempDir()
+	writeTree(t, gopath, map[string]string{
+		"src/a/a.go": "package a\n\nconst X = 1\n",
+		"src/b/b.go": "package b\n\nimport \"a\"\n\nconst Y = a.X\n",
+	})
+	ctx := gbimporter.PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	filename := filepath.Join(gopath, "src", "main", "main.go")
+	aFile := filepath.Join(gopath, "src", "a", "a.go")
+	overlays := []pkgfiles.Overlay{
+		nil,
+		{aFile: []byte("package a\n\nconst X = 2\n")},
+		{aFile: []byte("package a\n\nconst X = 3\n")},
+		// A file that only exists in the overlay.
+		{filepath.Join(gopath, "src", "a", "z.go"): []byte("package a\n\nconst Z = 4\n")},
+	}
+	want := []string{"1", "2", "3", "1"}
+
+	var wg sync.WaitGroup
+	for round := 0; round < 5; round++ {
+		for i, overlay := range overlays {
+			wg.Add(1)
+			go func(i int, overlay pkgfiles.Overlay) {
+				defer wg.Done()
+				imp := New(&ctx, filename, overlay, nil)
+				pkg, err := imp.ImportFrom("b", filepath.Dir(filename), 0)
+				if err != nil {
+					t.Errorf("overlay %d: %v", i, err)
+					return
+				}
+				if got := constValue(pkg, "Y"); got != want[i] {
+					t.Errorf("overlay %d: b.Y = %s, want %s", i, got, want[i])
+				}
+				a, err := imp.ImportFrom("a", filepath.Dir(filename), 0)
+				if err != nil {
+					t.Errorf("overlay %d: %v", i, err)
+					return
+				}
+				if got, want := constValue(a, "Z"), map[bool]string{true: "4", false: "<nil>"}[i == 3]; got != want {
+					t.Errorf("overlay %d: a.Z = %s, want %s", i, got, want)
+				}
+			}(i, overlay)
+		}
+	}
+	wg.Wait()
+
+	// The imports of one request stay consistent while another request
+	// with a different overlay imports the same packages.
+	imp1 := New(&ctx, filename, overlays[1], nil)
+	imp2 := New(&ctx, filename, overlays[2], nil)
+	b, err := imp1.ImportFrom("b", filepath.Dir(filename), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := imp2.ImportFrom("b", filepath.Dir(filename), 0); err != nil {
+		t.Fatal(err)
+	}
+	a, err := imp1.ImportFrom("a", filepath.Dir(filename), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := constValue(a, "X"); got != "2" {
+		t.Errorf("a.X = %s after an import with another overlay, want 2", got)
+	}
+	if imports := b.Imports(); len(imports) != 1 || imports[0] != a {
+		t.Errorf("b imports %v, not the package a imported by the same request", imports)
+	}
+}
+
+func constValue(pkg *types.Package, name string) string {
+	c, ok := pkg.Scope().Lookup(name).(*types.Const)
+	if !ok {
+		return "<nil>"
+	}
+	return fmt.Sprint(c.Val())
+}
+
+func TestDirImports(t *testing.T) {
+	gopath := t.TempDir()
+	writeTree(t, gopath, map[string]string{
+		"src/p/p.go":           "package p\n\nimport \"a\"\n",
+		"src/p/p_other.go":     "//go:build ignore\n\npackage p\n\nimport \"b\"\n",
+		"src/p/p_plan9.go":     "package p\n\nimport \"c\"\n",
+		"src/p/p_test.go":      "package p_test\n\nimport \"d\"\n",
+		"src/p/_p.go":          "package p\n\nimport \"e\"\n",
+		"src/cmd/main/main.go": "package main\n\nimport \"f\"\n",
+	})
+	ctx := gbimporter.PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	ctx.GOOS = "linux"
+	dir := filepath.Join(gopath, "src", "p")
+	overlay := pkgfiles.Overlay{
+		filepath.Join(dir, "p.go"): []byte("package p\n\nimport \"g\"\n"),
+		filepath.Join(dir, "z.go"): []byte("package p\n\nimport \"h\"\n"),
+	}
+	imp := New(&ctx, filepath.Join(dir, "p.go"), overlay, nil)
+	pkgPath, imports := DirImports(imp, dir)
+	if got, want := fmt.Sprintf("%q %v", pkgPath, imports), `"p" [d g h]`; got != want {
+		t.Errorf("DirImports(%s) = %s, want %s", dir, got, want)
+	}
+	main := filepath.Join(gopath, "src", "cmd", "main")
+	pkgPath, imports = DirImports(imp, main)
+	if got, want := fmt.Sprintf("%q %v", pkgPath, imports), `"" [f]`; got != want {
+		t.Errorf("DirImports(%s) = %s, want %s", main, got, want)
+	}
+}
@@ -3,35 +3,47 @@ package srcimporter
 import (
 	"errors"
 	"go/ast"
+	"go/parser"
 	"go/token"
 	"go/types"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/mdempsky/gocode/gbimporter"
 )
 
 type pkgInfo struct {
 	*ast.Package
-	path        string // path on which package was imported; eg go/types
-	fset        *token.FileSet
-	dir         *dir
+	path       string // path on which package was imported; eg go/types
+	importName string // identifies the package in its directory
+	variant    string // key in dir.packages
+	overlaid   bool   // depends on overlaid files, directly or indirectly
+	fset       *token.FileSet
+	dir        *dir
+	updateTime time.Time
+
+	// Guarded by dir.mu.
+	deps    map[string]*pkgInfo // import path -> imported package
+	lastUse time.Time
+
+	// Guarded by pkgCache.loadMu.
 	tpkg        *types.Package
-	typesCached bool // have types been computed
-	updateTime  time.Time
+	key         string        // export cache entry, if the types are cacheable
+	typesCached bool          // have types been computed
+	loader      *loader       // request currently computing types
+	loaded      chan struct{} // closed when loader is done
 }
 
+// Imports returns the packages p is type-checked against.
 func (p *pkgInfo) Imports() []*pkgInfo {
-	var imppkg []*pkgInfo
-	for _, ip := range packageImports(p.Package) {
-		ipp := p.PkgCache().findPackage(ip, p.dir.path)
-		if ipp != nil {
-			imppkg = append(imppkg, ipp)
-		}
+	p.dir.mu.Lock()
+	defer p.dir.mu.Unlock()
+	imppkg := make([]*pkgInfo, 0, len(p.deps))
+	for _, dep := range p.deps {
+		imppkg = append(imppkg, dep)
 	}
 	return imppkg
 }
@@ -40,73 +52,186 @@ func (p *pkgInfo) PkgCache() *pkgCache {
 	return p.dir.cache
 }
 
-func (p *pkgInfo) Types() *types.Package {
-	if p.typesCached {
-		return p.tpkg
+// Types returns the type-checked package, computing it on behalf of l if
+// necessary. If another request is computing it already, Types waits for
+// that request instead of duplicating its work.
+func (p *pkgInfo) Types(l *loader) (*types.Package, error) {
+	c := p.PkgCache()
+	c.loadMu.Lock()
+	for !p.typesCached {
+		if p.loader == nil {
+			p.loader = l
+			p.loaded = make(chan struct{})
+			c.loadMu.Unlock()
+			return p.computeTypes(l), nil
+		}
+		if l.waitsFor(p) {
+			c.loadMu.Unlock()
+			return nil, errImportCycle
+		}
+		loaded := p.loaded
+		l.waitingFor = p
+		c.loadMu.Unlock()
+		select {
+		case <-loaded:
+		case <-l.cancel:
+		}
+		c.loadMu.Lock()
+		l.waitingFor = nil
+		if l.canceled() {
+			c.loadMu.Unlock()
+			return nil, errCanceled
+		}
+		// Either the types are cached now, or the other request
+		// was canceled and we have to compute them ourselves.
 	}
-	p.typesCached = true
+	tpkg := p.tpkg
+	c.loadMu.Unlock()
+	return tpkg, nil
+}
+
+func (p *pkgInfo) computeTypes(l *loader) (tpkg *types.Package) {
+	defer func() {
+		c := p.PkgCache()
+		c.loadMu.Lock()
+		// If imports failed early, the package is incomplete.
+		if tpkg != nil && !l.canceled() {
+			p.tpkg = tpkg
+			p.typesCached = true
+		}
+		p.loader = nil
+		close(p.loaded)
+		c.loadMu.Unlock()
+	}()
+
 	// Import all dep packages or types will be missing.
-	for _, impPath := range packageImports(p.Package) {
-		p.PkgCache().Import(impPath)
+	for _, dep := range p.Imports() {
+		dep.Types(l)
+	}
+
+	var filenames []string
+	for filename := range p.Package.Files {
+		if ctxt := &p.dir.cache.ctxt; ctxt.UseAllFiles || ctxt.goodOSArchFile(filepath.Base(filename), nil) {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+	contents := make([][]byte, len(filenames))
+	for i, filename := range filenames {
+		data, err := l.overlay.fileSet().ReadFile(filename)
+		if err != nil {
+			log.Printf("ReadFile: %v", err)
+		}
+		contents[i] = data
 	}
+
+	// The files were only parsed up to their imports; see whether the
+	// types are in the export cache before parsing them completely.
+	// Unsaved files change too often to be worth saving.
+	var key string
+	if exportCacheDir() != "" && !p.overlaid {
+		key = p.exportKey(filenames, contents)
+	}
+	if key != "" {
+		files := make([]*token.File, len(filenames))
+		for i, filename := range filenames {
+			if tf := p.fset.File(p.Package.Files[filename].Pos()); tf != nil {
+				tf.SetLinesForContent(contents[i])
+				files[i] = tf
+			}
+		}
+		if tpkg := loadExport(key, files, l.imported(p)); tpkg != nil {
+			p.setKey(key)
+			return tpkg
+		}
+	}
+
 	cfg := types.Config{
 		Error:                    func(err error) {}, // don't stop after error
 		IgnoreFuncBodies:         true,
 		DisableUnusedImportCheck: true,
 		FakeImportC:              true,
-		Importer:                 p.PkgCache(),
+		Importer:                 l,
 	}
-	p.tpkg = types.NewPackage(p.path, p.Package.Name)
+	pkg := types.NewPackage(p.path, p.Package.Name)
 
-	ch := types.NewChecker(&cfg, p.fset, p.tpkg, nil)
+	ch := types.NewChecker(&cfg, p.fset, pkg, nil)
 	var files []*ast.File
-	for name, f := range p.Package.Files {
-		if i := strings.LastIndex(name, "/"); i != -1 {
-			name = name[i+1:]
-		}
-		if defBuildContext.goodOSArchFile(name, nil) {
+	for i, filename := range filenames {
+		if f, err := parser.ParseFile(p.fset, filename, contents[i], 0); err == nil {
 			files = append(files, f)
+		} else {
+			log.Printf("ParseFile: %v", err)
 		}
 	}
 	ch.Files(files)
-	return p.tpkg
+	if key != "" && !l.canceled() {
+		saveExport(key, p.fset, pkg, filenames)
+		p.setKey(key)
+	}
+	return pkg
+}
+
+func (p *pkgInfo) setKey(key string) {
+	c := p.PkgCache()
+	c.loadMu.Lock()
+	p.key = key
+	c.loadMu.Unlock()
 }
 
 // pkgCache implements types.ImporterFrom by parsing go files. pkgCache is
 // designed to be reused repeatedly. Modified source files are detected in
 // the background to force package reloading.
+//
+// pkgCache may be used by several requests at once. Packages are loaded in
+// parallel; a package is only loaded once, and requests needing a package
+// that another request is loading wait for it.
 type pkgCache struct {
-	// mu is acquired by the background updater goroutine before mutating
-	// pkgCache. Callers should lock mu before calling pkgCache methods.
-	mu          sync.Mutex
+	// stateMu is held for reading while importing, and for writing
+	// while packages are invalidated, so that no package gets
+	// type-checked against a dependency that is being dropped.
+	stateMu sync.RWMutex
+
+	mu          sync.Mutex          // protects the fields below
 	dirs        map[string]*dir     // absolute path -> dir
 	vendorPaths map[string][]string // path -> vendor dir list
-	ext         extension
-	lastUse     time.Time // last time Import was called
-	done        chan struct{}
+	failed      map[string]bool     // package paths that failed to import
+	lastUse     time.Time           // last time Import was called
+	staleCheck  time.Duration       // duration of the last removeStalePackages
+
+	loadMu sync.Mutex // protects loading state of pkgInfos and loaders
+
+	index packageIndex // packages that can be imported
+
+	ext  extension
+	ctxt Context // selects the files of packages
+	key  string  // identifies ext's context and ctxt
+	done chan struct{}
 }
 
-func newPkgCache(ctx *gbimporter.PackedContext) *pkgCache {
+func newPkgCache(ext extension, ctxt Context, key string) *pkgCache {
 	cache := &pkgCache{
 		dirs:        make(map[string]*dir),
 		vendorPaths: make(map[string][]string),
+		failed:      make(map[string]bool),
 		done:        make(chan struct{}),
-		ext:         makeExtension(),
+		ext:         ext,
+		ctxt:        ctxt,
+		key:         key,
 	}
 	return cache
 }
 
-func (p *pkgCache) setContext(ctx *gbimporter.PackedContext, filename string) {
-	if !p.ext.SetContext(ctx, filename) {
-		p.dirs = make(map[string]*dir)
-		p.vendorPaths = make(map[string][]string)
-	}
-}
-
 // Returns a list of vendor paths accessible from sources in srcDir.
 // Caches information, so adding a vendor directory later will not be
 // correctly handled.
 func (p *pkgCache) getVendorPaths(srcDir string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.getVendorPathsLocked(srcDir)
+}
+
+func (p *pkgCache) getVendorPathsLocked(srcDir string) []string {
 	if vp, ok := p.vendorPaths[srcDir]; ok {
 		return vp
 	}
@@ -116,7 +241,7 @@ func (p *pkgCache) getVendorPaths(srcDir string) []string {
 	}
 	vendor := filepath.Join(srcDir, "vendor")
 	fi, err := os.Stat(vendor)
-	baseVendor := p.getVendorPaths(srcDir[:idx])
+	baseVendor := p.getVendorPathsLocked(srcDir[:idx])
 	if err == nil && fi.IsDir() {
 		p.vendorPaths[srcDir] = append([]string{vendor}, baseVendor...)
 	} else {
@@ -125,59 +250,56 @@ func (p *pkgCache) getVendorPaths(srcDir string) []string {
 	return p.vendorPaths[srcDir]
 }
 
-// removeStalePackages checks for stale packages and removes them.
-func (p *pkgCache) removeStalePackages() {
-	if Debug {
-		t0 := time.Now()
-		defer func() {
-			log.Printf("removeStalePackages took %v", time.Since(t0))
-		}()
-	}
-	lastCheckpoint := time.Now()
-	// Frequently unlock mutex to prevent blocking for too long.
-	checkpoint := func() {
-		if time.Since(lastCheckpoint) > time.Millisecond {
-			p.mu.Unlock()
-			lastCheckpoint = time.Now()
-			time.Sleep(time.Microsecond)
-			p.mu.Lock()
-		}
-	}
-	// Copy dir paths locally.
+// dirList returns a snapshot of the cached directories.
+func (p *pkgCache) dirList() []*dir {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	var paths []string
-	for path := range p.dirs {
-		paths = append(paths, path)
+	dirs := make([]*dir, 0, len(p.dirs))
+	for _, d := range p.dirs {
+		dirs = append(dirs, d)
 	}
+	return dirs
+}
+
+// removeStalePackages checks for stale packages and removes them.
+// Requests only have to wait while stale packages are removed, not while
+// they are searched for.
+func (p *pkgCache) removeStalePackages() {
+	t0 := time.Now()
+	defer func() {
+		elapsed := time.Since(t0)
+		p.mu.Lock()
+		p.staleCheck = elapsed
+		p.mu.Unlock()
+		if Debug {
+			log.Printf("removeStalePackages took %v", elapsed)
+		}
+	}()
+	p.stateMu.RLock()
+	dirs := p.dirList()
 
 	// TODO: This is fairly long and inefficient. This entire routine
 	// can take over a second even if nothing changes. Reloads due to packages
 	// that once failed to import is ugly.
 
-	// Gather all imported paths.
-	allImports := map[string]bool{}
-	for _, path := range paths {
-		d := p.dirs[path]
-		if d == nil {
-			continue
-		}
-		checkpoint()
-		for _, pkg := range d.packages {
-			for _, imp := range packageImports(pkg.Package) {
-				allImports[imp] = true
-			}
-		}
+	// Packages that previously failed to import need special attention
+	// if they show up later. Requests may be loading packages right
+	// now, so only look at imports that failed, not at all imports
+	// missing from the cache.
+	p.mu.Lock()
+	failed := make([]string, 0, len(p.failed))
+	for path := range p.failed {
+		failed = append(failed, path)
 	}
-	delete(allImports, "unsafe") // unsafe isn't loaded from disk
-	// Gather missing imports. Packages that previously failed to import
-	// need special attention if they show up later.
+	p.mu.Unlock()
 	newPackages := map[string]bool{}
-	for path := range allImports {
-		checkpoint()
+	for _, path := range failed {
 		if p.findPackage(path, "") == nil {
 			if pkg := p.getPackage(path, ""); pkg != nil {
 				newPackages[path] = true
+				p.mu.Lock()
+				delete(p.failed, path)
+				p.mu.Unlock()
 			}
 		}
 	}
@@ -185,13 +307,8 @@ func (p *pkgCache) removeStalePackages() {
 	// If any previously-failed-to-import packages import now, mark dependencies as modified.
 	modifiedPackages := map[*pkgInfo]bool{}
 	if len(newPackages) > 0 {
-		for _, path := range paths {
-			d := p.dirs[path]
-			if d == nil {
-				continue
-			}
-			checkpoint()
-			for _, pkg := range d.packages {
+		for _, d := range dirs {
+			for _, pkg := range d.packageList() {
 				for _, imp := range packageImports(pkg.Package) {
 					if newPackages[imp] {
 						modifiedPackages[pkg] = true
@@ -202,27 +319,34 @@ func (p *pkgCache) removeStalePackages() {
 	}
 
 	// Detect modified packages.
-	for _, path := range paths {
-		d := p.dirs[path]
-		if d == nil {
-			continue
-		}
-		checkpoint()
+	for _, d := range dirs {
+		d.mu.Lock()
 		d.updatePeek()
 		d.modifiedPackages(modifiedPackages)
+		d.mu.Unlock()
 	}
+	p.stateMu.RUnlock()
 
+	if len(modifiedPackages) == 0 {
+		return
+	}
+	p.stateMu.Lock()
+	dropped := p.invalidate(modifiedPackages)
+	p.stateMu.Unlock()
+	notifyStale(dropped)
+}
+
+// invalidate removes the modified packages and all packages depending on
+// them, directly or indirectly, from the cache, and returns the
+// directories of the removed packages. stateMu must be held for writing.
+func (p *pkgCache) invalidate(modifiedPackages map[*pkgInfo]bool) (dropped []string) {
+	dirs := p.dirList()
 	// There is no back-link between dependencies. Instead, loop over all
 	// packages to determine if they use the modified packages directly.
 	dependentPackages := map[*pkgInfo]bool{}
 	for len(modifiedPackages) > 0 {
-		for _, path := range paths {
-			checkpoint()
-			d := p.dirs[path]
-			if d == nil {
-				continue
-			}
-			for _, pkg := range d.packages {
+		for _, d := range dirs {
+			for _, pkg := range d.packageList() {
 				for _, imp := range pkg.Imports() {
 					if modifiedPackages[imp] {
 						dependentPackages[pkg] = true
@@ -231,14 +355,16 @@ func (p *pkgCache) removeStalePackages() {
 			}
 		}
 		for pkg := range modifiedPackages {
-			if pkg.dir.packages[pkg.Name] != nil {
+			if pkg.dir.holds(pkg) {
 				pkg.dir.unlink()
+				dropped = append(dropped, pkg.dir.path)
 			}
 		}
 		// Repeat. dependentPackages are indirectly modified.
 		modifiedPackages = dependentPackages
 		dependentPackages = map[*pkgInfo]bool{}
 	}
+	return dropped
 }
 
 // BackgroundUpdater begins a background goroutine to refresh stale packages.
@@ -250,10 +376,7 @@ func (p *pkgCache) BackgroundUpdater() {
 				return
 			default:
 				// If not idle, remove stale packages.
-				p.mu.Lock()
-				active := time.Since(p.lastUse) < 10*time.Minute
-				p.mu.Unlock()
-				if active {
+				if !p.idle(10 * time.Minute) {
 					p.removeStalePackages()
 				}
 			}
@@ -262,48 +385,223 @@ func (p *pkgCache) BackgroundUpdater() {
 	}()
 }
 
+// stats returns a snapshot of the cache state.
+func (p *pkgCache) stats() CacheStats {
+	var st CacheStats
+	for _, d := range p.dirList() {
+		st.Dirs++
+		st.Packages += len(d.packageList())
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for path := range p.failed {
+		st.FailedPackages = append(st.FailedPackages, path)
+	}
+	sort.Strings(st.FailedPackages)
+	st.LastStaleCheck = p.staleCheck
+	st.LastUse = p.lastUse
+	return st
+}
+
 func (p *pkgCache) Close() error {
 	close(p.done)
 	return nil
 }
 
+// idle reports whether the cache has not been used for the duration d.
+func (p *pkgCache) idle(d time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Since(p.lastUse) >= d
+}
+
+var (
+	errCanceled    = errors.New("import canceled")
+	errImportCycle = errors.New("import cycle")
+)
+
+// loader imports packages on behalf of one request. Imports made through
+// a loader are nested in an import of the request's sharedCache, which
+// holds pkgCache.stateMu for reading.
+type loader struct {
+	cache      *pkgCache
+	overlay    *requestOverlay
+	cancel     <-chan struct{} // closed when the request is canceled
+	waitingFor *pkgInfo        // guarded by cache.loadMu
+
+	mu       sync.Mutex
+	resolved map[[2]string]*pkgInfo // import path and srcDir -> package
+	pending  map[[2]string]bool     // being resolved
+}
+
+func newLoader(cache *pkgCache, overlay *requestOverlay, cancel <-chan struct{}) *loader {
+	return &loader{
+		cache:    cache,
+		overlay:  overlay,
+		cancel:   cancel,
+		resolved: make(map[[2]string]*pkgInfo),
+		pending:  make(map[[2]string]bool),
+	}
+}
+
 // Import implements types.Importer
-func (p *pkgCache) Import(path string) (*types.Package, error) {
-	return p.ImportFrom(path, "", 0)
+func (l *loader) Import(path string) (*types.Package, error) {
+	return l.ImportFrom(path, "", 0)
 }
 
 // Import implements types.ImporterFrom
-func (p *pkgCache) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+func (l *loader) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	if l.canceled() {
+		return nil, errCanceled
+	}
+	p := l.cache
+	p.mu.Lock()
 	p.lastUse = time.Now()
+	p.mu.Unlock()
 	if path == "unsafe" {
 		return types.Unsafe, nil
 	}
-	pkg := p.getPackage(path, srcDir)
+	pkg := l.resolve(path, srcDir)
 	if pkg == nil {
 		return nil, errors.New("no package")
 	}
-	return pkg.Types(), nil
+	return pkg.Types(l)
+}
+
+// resolve returns the package that path imported from srcDir refers to
+// for this request, resolving its imports first. Every request sees the
+// same package for the same path, srcDir and overlay.
+func (l *loader) resolve(path, srcDir string) *pkgInfo {
+	key := [2]string{path, srcDir}
+	l.mu.Lock()
+	if pkg, ok := l.resolved[key]; ok || l.pending[key] {
+		// A pending package is part of an import cycle, which
+		// the type checker reports.
+		l.mu.Unlock()
+		return pkg
+	}
+	l.pending[key] = true
+	l.mu.Unlock()
+
+	p := l.cache
+	var pkg *pkgInfo
+	name, paths := p.lookupPaths(path, srcDir)
+	for _, pp := range paths {
+		d := p.getDir(pp)
+		base := d.getPackage(p.importName(name, pp), path, l.overlay)
+		if base == nil {
+			continue
+		}
+		deps := make(map[string]*pkgInfo)
+		for _, imp := range packageImports(base.Package) {
+			if imp == "unsafe" || imp == "C" {
+				continue
+			}
+			if dep := l.resolve(imp, d.path); dep != nil {
+				deps[imp] = dep
+			}
+		}
+		pkg = d.variant(base, deps, l.overlay.fingerprint(d.path))
+		break
+	}
+	if pkg == nil {
+		p.importFailed(path, paths)
+	}
+
+	l.mu.Lock()
+	delete(l.pending, key)
+	l.resolved[key] = pkg
+	l.mu.Unlock()
+	return pkg
+}
+
+// lookup returns a package with the given path that the request
+// resolved, or nil.
+func (l *loader) lookup(path string) *pkgInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, pkg := range l.resolved {
+		if key[0] == path && pkg != nil {
+			return pkg
+		}
+	}
+	return nil
+}
+
+// imported returns the packages imported by pkg so far, directly or
+// indirectly, by path.
+func (l *loader) imported(pkg *pkgInfo) map[string]*types.Package {
+	deps := map[string]*types.Package{}
+	var add func(tpkg *types.Package)
+	add = func(tpkg *types.Package) {
+		if deps[tpkg.Path()] != nil {
+			return
+		}
+		deps[tpkg.Path()] = tpkg
+		for _, imp := range tpkg.Imports() {
+			add(imp)
+		}
+	}
+	c := l.cache
+	for _, path := range packageImports(pkg.Package) {
+		if path == "unsafe" {
+			add(types.Unsafe)
+		}
+	}
+	for _, dep := range pkg.Imports() {
+		c.loadMu.Lock()
+		tpkg := dep.tpkg
+		c.loadMu.Unlock()
+		if tpkg != nil {
+			add(tpkg)
+		}
+	}
+	return deps
+}
+
+func (l *loader) canceled() bool {
+	return isDone(l.cancel)
+}
+
+// waitsFor reports whether waiting for pkg would deadlock, because the
+// request loading pkg waits, possibly through other requests, for l.
+// cache.loadMu must be held.
+func (l *loader) waitsFor(pkg *pkgInfo) bool {
+	for owner := pkg.loader; owner != nil; owner = owner.waitingFor.loader {
+		if owner == l {
+			return true
+		}
+		if owner.waitingFor == nil {
+			break
+		}
+	}
+	return false
 }
 
 func (p *pkgCache) getDir(path string) *dir {
-	if d := p.findDir(path); d != nil {
+	p.mu.Lock()
+	if d, ok := p.dirs[path]; ok {
+		p.mu.Unlock()
 		return d
 	}
 	d := newDir(p, path)
-	d.updatePeek()
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	p.dirs[d.path] = d
+	p.mu.Unlock()
+	d.updatePeek()
 	return d
 }
 
 func (p *pkgCache) findDir(path string) *dir {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if d, ok := p.dirs[path]; ok {
 		return d
 	}
 	return nil
 }
 
-var failedPackages = map[string]bool{}
-
 func (p *pkgCache) lookupPaths(pkgPath, srcDir string) (name string, paths []string) {
 	name = pkgPath
 	pkgDir := ""
@@ -315,6 +613,15 @@ func (p *pkgCache) lookupPaths(pkgPath, srcDir string) (name string, paths []str
 	return name, paths
 }
 
+// importName returns the name under which the directory path caches the
+// package whose import path ends in name. The two differ for directories
+// that are named differently from the import path, such as modules in
+// the module cache ("foo@v1.2.3") or replacement directories.
+func (p *pkgCache) importName(name, path string) string {
+	return p.ext.ImportName(name, filepath.Join(path, name+".go"))
+}
+
+// findPackage returns the package as read from disk if it is cached.
 func (p *pkgCache) findPackage(pkgPath, srcDir string) *pkgInfo {
 	name, paths := p.lookupPaths(pkgPath, srcDir)
 	for _, pp := range paths {
@@ -322,12 +629,15 @@ func (p *pkgCache) findPackage(pkgPath, srcDir string) *pkgInfo {
 		if sd == nil {
 			continue
 		}
-		if pkg := sd.packages[name]; pkg != nil {
+		if pkg := sd.lookupPackage(p.importName(name, pp)); pkg != nil {
 			return pkg
 		}
 	}
 	return nil
 }
+
+// getPackage returns the package as read from disk, parsing it if
+// necessary.
 func (p *pkgCache) getPackage(pkgPath, srcDir string) *pkgInfo {
 	name, paths := p.lookupPaths(pkgPath, srcDir)
 	for _, pp := range paths {
@@ -335,15 +645,22 @@ func (p *pkgCache) getPackage(pkgPath, srcDir string) *pkgInfo {
 		if sd == nil {
 			continue
 		}
-		if pkg := sd.getPackage(name, pkgPath); pkg != nil {
+		if pkg := sd.getPackage(p.importName(name, pp), pkgPath, nil); pkg != nil {
 			return pkg
 		}
 	}
-	if !failedPackages[pkgPath] {
-		failedPackages[pkgPath] = true
+	p.importFailed(pkgPath, paths)
+	return nil
+}
+
+// importFailed records that pkgPath was not found in any of paths.
+func (p *pkgCache) importFailed(pkgPath string, paths []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.failed[pkgPath] {
+		p.failed[pkgPath] = true
 		if Debug {
 			log.Printf("GetPackage FAIL: %v\nPaths=%v", pkgPath, paths)
 		}
 	}
-	return nil
 }
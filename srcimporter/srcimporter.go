@@ -2,11 +2,19 @@ package srcimporter
 
 import (
 	"go/build"
+	"go/parser"
 	"go/token"
 	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/mdempsky/gocode/gbimporter"
+	"github.com/mdempsky/gocode/pkgfiles"
 )
 
 const (
@@ -14,30 +22,133 @@ const (
 	EnableVendoring = true
 )
 
+// idleCacheTimeout is how long a shared cache may go unused before it
+// is dropped in favor of caches for other contexts.
+const idleCacheTimeout = 10 * time.Minute
+
 var (
-	gSharedOnce sync.Once
-	gShared     *pkgCache
+	gSharedMu sync.Mutex
+	gShared   = map[string]*pkgCache{} // context key -> cache
 )
 
 // New returns a types.ImporterFrom that imports packages from source.
-func New(ctx *gbimporter.PackedContext, filename string) types.ImporterFrom {
+// Files in overlay are type-checked using their unsaved contents. The
+// overlay only applies to this importer: packages using overlaid files are
+// cached by the contents of those files, so importers with different
+// overlays never see each other's packages. Once done is closed, imports fail early and packages type-checked so far
+// are returned incomplete and not cached.
+//
+// Importers share one cache per build context and may be used
+// concurrently.
+func New(ctx *gbimporter.PackedContext, filename string, overlay pkgfiles.Overlay, done <-chan struct{}) types.ImporterFrom {
 	if ctx == nil {
 		c := gbimporter.PackContext(&build.Default)
 		ctx = &c
 	}
-	gSharedOnce.Do(func() {
-		gShared = newPkgCache(ctx)
-		gShared.BackgroundUpdater()
-	})
-	return &sharedCache{gShared, ctx, filename}
+	cache := sharedPkgCache(ctx, filename)
+	return &sharedCache{cache, newLoader(cache, newRequestOverlay(overlay), done)}
+}
+
+// sharedPkgCache returns the cache for the given context, creating it if
+// necessary. Caches for other contexts that have been idle for a while
+// are closed.
+func sharedPkgCache(ctx *gbimporter.PackedContext, filename string) *pkgCache {
+	ext := makeExtension()
+	ext.SetContext(ctx, filename)
+	// Build constraints select different files for different contexts.
+	bctxt := buildContext(ctx)
+	key := ext.ContextKey() + ";" + bctxt.key()
+
+	gSharedMu.Lock()
+	defer gSharedMu.Unlock()
+	if c := gShared[key]; c != nil {
+		return c
+	}
+	for k, c := range gShared {
+		if c.idle(idleCacheTimeout) {
+			c.Close()
+			delete(gShared, k)
+		}
+	}
+	c := newPkgCache(ext, bctxt, key)
+	c.BackgroundUpdater()
+	gShared[key] = c
+	return c
+}
+
+var (
+	gStaleMu    sync.Mutex
+	gStaleFuncs []func(dirs []string)
+)
+
+// OnStale registers f to be called whenever the background updater drops
+// packages from a cache because their files, or the files of packages
+// they depend on, changed on disk. f receives the directories of the
+// dropped packages and must not block.
+func OnStale(f func(dirs []string)) {
+	gStaleMu.Lock()
+	defer gStaleMu.Unlock()
+	gStaleFuncs = append(gStaleFuncs, f)
+}
+
+func notifyStale(dirs []string) {
+	if len(dirs) == 0 {
+		return
+	}
+	gStaleMu.Lock()
+	funcs := gStaleFuncs
+	gStaleMu.Unlock()
+	for _, f := range funcs {
+		f(dirs)
+	}
+}
+
+// KeepAlive marks the cache for the given context as used, so that it
+// keeps checking for modified files while no packages are imported.
+func KeepAlive(ctx *gbimporter.PackedContext, filename string) {
+	c := sharedPkgCache(ctx, filename)
+	c.mu.Lock()
+	c.lastUse = time.Now()
+	c.mu.Unlock()
+}
+
+// CacheStats describes the state of the package cache for one build
+// context.
+type CacheStats struct {
+	Context        string        // identifies the build context, eg its GOPATH
+	Dirs           int           // number of directories cached
+	Packages       int           // number of packages parsed
+	FailedPackages []string      // import paths that could not be found
+	LastStaleCheck time.Duration // time taken by the last check for modified files
+	LastUse        time.Time
+}
+
+// Stats returns the state of the caches shared by importers, sorted by
+// context.
+func Stats() []CacheStats {
+	gSharedMu.Lock()
+	caches := make(map[string]*pkgCache, len(gShared))
+	for key, c := range gShared {
+		caches[key] = c
+	}
+	gSharedMu.Unlock()
+
+	var stats []CacheStats
+	for key, c := range caches {
+		st := c.stats()
+		st.Context = key
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Context < stats[j].Context })
+	return stats
 }
 
 func toPkgCache(imp types.Importer) *pkgCache {
 	switch p := imp.(type) {
-	case *pkgCache:
-		return p
 	case *sharedCache:
 		return p.pkgCache
+	case *loader:
+		return p.cache
 	}
 	return nil
 }
@@ -47,18 +158,89 @@ func PkgFileSet(imp types.Importer, pkgPath, srcDir string) *token.FileSet {
 	if c == nil {
 		return nil
 	}
-	pkg := c.findPackage(pkgPath, srcDir)
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	var pkg *pkgInfo
+	if p, ok := imp.(*sharedCache); ok {
+		pkg = p.loader.lookup(pkgPath)
+	}
+	if pkg == nil {
+		pkg = c.findPackage(pkgPath, srcDir)
+	}
 	if pkg == nil {
 		return nil
 	}
 	return pkg.fset
 }
 
-// sharedCache wraps pkgCache for shared use. Only one Import call is allowed at a time.
+// DirImports returns the path by which a file in dir imports the package
+// in dir, or "" if it has none, such as for a main package, and the paths
+// imported by the files in dir, including tests. Like imports, it only
+// considers the files selected by the build context of imp and reads
+// those in the overlay of imp from it. DirImports returns "", nil unless
+// imp was returned by New.
+func DirImports(imp types.Importer, dir string) (pkgPath string, imports []string) {
+	p, ok := imp.(*sharedCache)
+	if !ok {
+		return "", nil
+	}
+	ov := p.loader.overlay
+	names := make(map[string]bool)
+	if list, err := ioutil.ReadDir(dir); err == nil {
+		for _, fi := range list {
+			if !fi.IsDir() {
+				names[fi.Name()] = true
+			}
+		}
+	}
+	for filename := range ov.fileSet() {
+		if filepath.Dir(filename) == dir {
+			names[filepath.Base(filename)] = true
+		}
+	}
+
+	hasPackage := false
+	seen := make(map[string]bool)
+	fset := token.NewFileSet()
+	for name := range names {
+		if !strings.HasSuffix(name, ".go") || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+			continue
+		}
+		if !p.ctxt.UseAllFiles && !p.ctxt.goodOSArchFile(name, nil) {
+			continue
+		}
+		filename := filepath.Join(dir, name)
+		src, err := ov.fileSet().ReadFile(filename)
+		if err != nil || !p.ctxt.UseAllFiles && !p.ctxt.shouldBuild(src, nil) {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filename, src, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		if isPackageFile(name) && f.Name.Name != "main" {
+			hasPackage = true
+		}
+		for _, spec := range f.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err == nil && !seen[path] {
+				seen[path] = true
+				imports = append(imports, path)
+			}
+		}
+	}
+	sort.Strings(imports)
+	if hasPackage {
+		pkgPath = p.importPath(dir)
+	}
+	return pkgPath, imports
+}
+
+// sharedCache wraps pkgCache for use by a single request. Requests using
+// the same pkgCache import packages concurrently.
 type sharedCache struct {
 	*pkgCache
-	ctx      *gbimporter.PackedContext
-	filename string
+	loader *loader
 }
 
 func (p *sharedCache) Import(path string) (*types.Package, error) {
@@ -66,8 +248,10 @@ func (p *sharedCache) Import(path string) (*types.Package, error) {
 }
 
 func (p *sharedCache) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
-	p.pkgCache.mu.Lock()
-	defer p.pkgCache.mu.Unlock()
-	p.setContext(p.ctx, p.filename)
-	return p.pkgCache.ImportFrom(path, srcDir, mode)
+	if p.loader.canceled() {
+		return nil, errCanceled
+	}
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+	return p.loader.ImportFrom(path, srcDir, mode)
 }
@@ -0,0 +1,11 @@
+module example.com/main
+
+go 1.21
+
+require (
+	example.com/dep v1.1.0
+	example.com/Upper v0.1.0-RC1 // indirect
+	example.com/old v1.0.0
+)
+
+replace example.com/old => ../old
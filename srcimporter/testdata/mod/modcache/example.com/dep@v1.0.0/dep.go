@@ -0,0 +1,3 @@
+package dep
+
+const V = "v1.0.0"
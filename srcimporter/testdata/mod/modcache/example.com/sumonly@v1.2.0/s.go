@@ -0,0 +1,3 @@
+package sumonly
+
+const V = "v1.2.0"
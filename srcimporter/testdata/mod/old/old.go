@@ -0,0 +1,3 @@
+package old
+
+const V = "replaced"
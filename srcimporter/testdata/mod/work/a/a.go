@@ -0,0 +1,5 @@
+package a
+
+import "example.com/b"
+
+const V = b.V
@@ -3,7 +3,10 @@ package srcimporter
 import (
 	"go/ast"
 	"os"
+	"path/filepath"
 	"strings"
+
+	"github.com/mdempsky/gocode/pkgfiles"
 )
 
 func isDir(path string) bool {
@@ -12,6 +15,29 @@ func isDir(path string) bool {
 	}
 	return false
 }
+
+// isSubdir reports whether dir is root or a directory below it.
+func isSubdir(dir, root string) bool {
+	return dir == root || strings.HasPrefix(dir, root+string(filepath.Separator))
+}
+
+func isFile(path string) bool {
+	if fi, err := os.Stat(path); err == nil {
+		return fi.Mode().IsRegular()
+	}
+	return false
+}
+
+// isDone reports whether done is closed. A nil channel is never done.
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
 func stringSliceEq(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -41,22 +67,28 @@ func packageImports(p *ast.Package) []string {
 	return ps
 }
 
-func scanPkg(filename string) (string, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return "", err
-	}
-	var chunk = make([]byte, 200000)
-	n, err := f.Read(chunk)
-	if err != nil {
-		return "", err
+func scanPkg(filename string, overlay pkgfiles.Overlay, ctxt *Context) (string, error) {
+	var chunk []byte
+	if data, ok := overlay[filename]; ok {
+		chunk = data
+	} else {
+		f, err := os.Open(filename)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		chunk = make([]byte, 200000)
+		n, err := f.Read(chunk)
+		if err != nil {
+			return "", err
+		}
+		chunk = chunk[:n]
 	}
-	chunk = chunk[:n]
 	pkgName := findPackageDecl(chunk)
 	if pkgName == "" || pkgName == "main" || strings.HasSuffix(pkgName, "_test") {
 		return "", nil
 	}
-	if !defBuildContext.shouldBuild(chunk, nil) {
+	if !ctxt.UseAllFiles && !ctxt.shouldBuild(chunk, nil) {
 		return "", nil
 	}
 	return pkgName, nil
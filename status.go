@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/mdempsky/gocode/gbimporter"
+	"github.com/mdempsky/gocode/srcimporter"
+)
+
+// version is the gocode version. Release builds may set it with
+// -ldflags "-X main.version=...".
+var version = ""
+
+// gocodeVersion returns the version of the running binary.
+func gocodeVersion() string {
+	if version != "" {
+		return version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	return "devel"
+}
+
+// binaryID identifies the gocode executable, so that a client can tell
+// whether the daemon was started from the binary the client runs.
+func binaryID() string {
+	path := get_executable_filename()
+	fi, err := os.Stat(path)
+	if err != nil {
+		return path
+	}
+	return fmt.Sprintf("%s (%d bytes, modified %v)", path, fi.Size(), fi.ModTime().UTC().Format(time.RFC3339Nano))
+}
+
+var startTime = time.Now()
+
+// lastContext is the build context of the most recent request.
+var lastContext struct {
+	sync.Mutex
+	ctx *gbimporter.PackedContext
+}
+
+func noteContext(ctx *gbimporter.PackedContext) {
+	lastContext.Lock()
+	lastContext.ctx = ctx
+	lastContext.Unlock()
+}
+
+type StatusRequest struct{}
+
+type StatusReply struct {
+	PID        int
+	Uptime     time.Duration
+	Executable string
+	Version    string
+	GoVersion  string
+	Context    *gbimporter.PackedContext // context of the last request, if any
+	Caches     []srcimporter.CacheStats
+	Requests   []RequestStats
+	Priming    []PrimeProgress // running prime jobs
+}
+
+func Status(req *StatusRequest, res *StatusReply) error {
+	res.PID = os.Getpid()
+	res.Uptime = time.Since(startTime)
+	res.Executable = get_executable_filename()
+	res.Version = gocodeVersion()
+	res.GoVersion = runtime.Version()
+	lastContext.Lock()
+	res.Context = lastContext.ctx
+	lastContext.Unlock()
+	res.Caches = srcimporter.Stats()
+	res.Requests = requestStats()
+	res.Priming = primeProgress()
+	return nil
+}
+
+func (s *Server) Status(req *StatusRequest, res *StatusReply) error {
+	return Status(req, res)
+}
@@ -97,23 +97,15 @@ def extract_arguments_and_returns(sig):
     return args, returns
 
 # takes gocode's candidate and returns sublime's hint and subj
-def hint_and_subj(cls, name, type, insertArgs):
+def hint_and_subj(cls, name, type, snippet, insertArgs):
     subj = name
+    if insertArgs and snippet:
+        subj = snippet
     if cls == "func":
         hint = cls + " " + name
         args, returns = extract_arguments_and_returns(type)
         if returns:
             hint += "\t" + ", ".join(returns)
-        if args:
-            sargs = []
-            for i, a in enumerate(args):
-                ea = a.replace("{", "\\{").replace("}", "\\}")
-                sargs.append("${{{0}:{1}}}".format(i+1, ea))
-            if insertArgs:
-                subj += "(" + ", ".join(sargs) + ")"
-        else:
-            if insertArgs:
-                subj += "()"
     else:
         hint = cls + " " + name + "\t" + type
     return hint, subj
@@ -163,7 +155,7 @@ class Gocode(sublime_plugin.EventListener):
         locline = view.line(loc)
         paren_index = view.substr(sublime.Region(loc, locline.b)).find("(")
         has_paren = paren_index >= 0 and paren_index < 3
-        gocode = subprocess.Popen(["gocode", "-f=csv", "-filtersuggestions=0", "autocomplete", filename, cloc],
+        gocode = subprocess.Popen(["gocode", "-f=csv", "-snippets", "-filtersuggestions=0", "autocomplete", filename, cloc],
             stdin=subprocess.PIPE, stdout=subprocess.PIPE, stderr=subprocess.PIPE)
         try:
             result = gocode.communicate(src.encode(), timeout=GOCODE_TIMEOUT)
@@ -174,8 +166,8 @@ class Gocode(sublime_plugin.EventListener):
         out = result[0].decode()
         result = []
         for line in filter(bool, out.split("\n")):
-            cls,name,type = line.split(",,")
-            hint, subj = hint_and_subj(cls, name, type, not has_paren)
+            cls,name,type,snippet = (line.split(",,") + [""])[:4]
+            hint, subj = hint_and_subj(cls, name, type, snippet, not has_paren)
             result.append([hint, subj])
 
         return (result, sublime.INHIBIT_WORD_COMPLETIONS|sublime.INHIBIT_EXPLICIT_COMPLETIONS)
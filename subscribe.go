@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mdempsky/gocode/gbimporter"
+	"github.com/mdempsky/gocode/pkgfiles"
+	"github.com/mdempsky/gocode/reporterrors"
+	"github.com/mdempsky/gocode/srcimporter"
+)
+
+// Clients subscribe to files to be told about new errors in them when
+// packages they import change on disk, eg after a git checkout. The
+// diagnostics are delivered by long-polling with Server.Diagnostics.
+
+type SubscribeRequest struct {
+	Subscriber string // from an earlier reply; empty to start a new subscriber
+	Filename   string
+	Data       []byte           // unsaved contents of the file; nil reads it from disk for every check
+	Overlay    pkgfiles.Overlay // unsaved contents of other files, in any package
+	Context    gbimporter.PackedContext
+}
+
+type SubscribeReply struct {
+	Subscriber string
+	Error      *RequestError // set if the request failed
+}
+
+type UnsubscribeRequest struct {
+	Subscriber string
+	Filename   string // empty drops the subscriber and all its files
+}
+
+type UnsubscribeReply struct{}
+
+type DiagnosticsRequest struct {
+	Subscriber string
+	Timeout    time.Duration // how long to wait for new diagnostics; 0 means 30s
+}
+
+type DiagnosticsReply struct {
+	Updates []FileErrors  // files whose errors changed; empty if the timeout passed
+	Error   *RequestError // set if the request failed
+}
+
+// FileErrors are the current errors in a subscribed file.
+type FileErrors struct {
+	Filename string
+	Errors   []reporterrors.Error
+}
+
+// subscriberTimeout is how long a subscriber may go without polling for
+// diagnostics before it is dropped.
+const subscriberTimeout = 5 * time.Minute
+
+var subscribers = struct {
+	sync.Mutex
+	byID map[string]*subscriber
+	next int
+}{
+	byID: make(map[string]*subscriber),
+}
+
+var startChecker sync.Once
+
+type subscriber struct {
+	// Guarded by subscribers.Mutex.
+	files    map[string]*subscription
+	pending  map[string][]reporterrors.Error // changed diagnostics not yet delivered
+	polls    int                             // number of running Diagnostics requests
+	lastPoll time.Time
+
+	// changed is closed, and replaced, when diagnostics become
+	// pending, waking all polls.
+	changed chan struct{}
+}
+
+type subscription struct {
+	req ReportErrorsRequest
+
+	mu   sync.Mutex // held while checking
+	last []reporterrors.Error
+}
+
+func Subscribe(req *SubscribeRequest, res *SubscribeReply) error {
+	startChecker.Do(func() {
+		stale := make(chan struct{}, 1)
+		srcimporter.OnStale(func(dirs []string) {
+			select {
+			case stale <- struct{}{}:
+			default:
+			}
+		})
+		go checkSubscriptions(stale)
+	})
+
+	sub := &subscription{req: ReportErrorsRequest{
+		Filename: req.Filename,
+		Data:     req.Data,
+		Overlay:  req.Overlay,
+		Context:  req.Context,
+	}}
+	subscribers.Lock()
+	id := req.Subscriber
+	s := subscribers.byID[id]
+	if s == nil && id != "" {
+		subscribers.Unlock()
+		res.Error = &RequestError{Code: ErrBadRequest, Message: fmt.Sprintf("unknown subscriber %q", id)}
+		return nil
+	}
+	if s == nil {
+		subscribers.next++
+		id = strconv.Itoa(subscribers.next)
+		s = &subscriber{
+			files:    make(map[string]*subscription),
+			pending:  make(map[string][]reporterrors.Error),
+			lastPoll: time.Now(),
+			changed:  make(chan struct{}),
+		}
+		subscribers.byID[id] = s
+	}
+	s.files[req.Filename] = sub
+	subscribers.Unlock()
+
+	res.Subscriber = id
+	// The first diagnostics are delivered even if there are no errors,
+	// so that clients learn the state of the file.
+	checkSubscription(s, sub, true)
+	return nil
+}
+
+func (s *Server) Subscribe(req *SubscribeRequest, res *SubscribeReply) error {
+	return Subscribe(req, res)
+}
+
+func Unsubscribe(req *UnsubscribeRequest, res *UnsubscribeReply) error {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	if req.Filename == "" {
+		delete(subscribers.byID, req.Subscriber)
+	} else if s := subscribers.byID[req.Subscriber]; s != nil {
+		delete(s.files, req.Filename)
+		delete(s.pending, req.Filename)
+	}
+	return nil
+}
+
+func (s *Server) Unsubscribe(req *UnsubscribeRequest, res *UnsubscribeReply) error {
+	return Unsubscribe(req, res)
+}
+
+// Diagnostics waits until the errors in some of the subscribed files
+// change, or the timeout passes. Concurrent polls of a subscriber are all
+// woken by a change, and the first one to return delivers it.
+func Diagnostics(req *DiagnosticsRequest, res *DiagnosticsReply) error {
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	// A waiting subscriber keeps the daemon from exiting when idle.
+	// Reaching the timeout is the normal outcome of a poll rather than
+	// a cancellation, so it is not the request's deadline.
+	ctx, done := beginRequest("diagnostics", "", "", time.Time{})
+	defer done()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	subscribers.Lock()
+	s := subscribers.byID[req.Subscriber]
+	if s == nil {
+		subscribers.Unlock()
+		res.Error = &RequestError{Code: ErrBadRequest, Message: fmt.Sprintf("unknown subscriber %q", req.Subscriber)}
+		return nil
+	}
+	s.polls++
+	timedOut := false
+	for len(s.pending) == 0 && !timedOut && ctx.Err() == nil {
+		changed := s.changed
+		subscribers.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			timedOut = true
+		case <-ctx.Done():
+		}
+		subscribers.Lock()
+	}
+	for filename, errs := range s.pending {
+		res.Updates = append(res.Updates, FileErrors{Filename: filename, Errors: errs})
+	}
+	s.pending = make(map[string][]reporterrors.Error)
+	s.polls--
+	s.lastPoll = time.Now()
+	subscribers.Unlock()
+	if timedOut && len(res.Updates) == 0 {
+		countTimeout("diagnostics")
+	}
+
+	sort.Slice(res.Updates, func(i, j int) bool { return res.Updates[i].Filename < res.Updates[j].Filename })
+	return nil
+}
+
+func (s *Server) Diagnostics(req *DiagnosticsRequest, res *DiagnosticsReply) error {
+	return Diagnostics(req, res)
+}
+
+// checkSubscriptions checks all subscribed files whenever packages are
+// dropped from the cache, and drops subscribers that stopped polling.
+func checkSubscriptions(stale <-chan struct{}) {
+	tick := time.NewTicker(time.Minute)
+	for {
+		select {
+		case <-stale:
+			// Finding out which files import the dropped packages
+			// takes a type-check too, so check all of them.
+			for _, s := range subscriberList() {
+				subscribers.Lock()
+				subs := make([]*subscription, 0, len(s.files))
+				for _, sub := range s.files {
+					subs = append(subs, sub)
+				}
+				subscribers.Unlock()
+				for _, sub := range subs {
+					checkSubscription(s, sub, false)
+				}
+			}
+		case <-tick.C:
+			subscribers.Lock()
+			for id, s := range subscribers.byID {
+				if s.polls == 0 && time.Since(s.lastPoll) > subscriberTimeout {
+					delete(subscribers.byID, id)
+					continue
+				}
+				// The caches must keep looking for modified
+				// files even if no requests are made.
+				for _, sub := range s.files {
+					srcimporter.KeepAlive(&sub.req.Context, sub.req.Filename)
+				}
+			}
+			subscribers.Unlock()
+		}
+	}
+}
+
+func subscriberList() []*subscriber {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	list := make([]*subscriber, 0, len(subscribers.byID))
+	for _, s := range subscribers.byID {
+		list = append(list, s)
+	}
+	return list
+}
+
+// checkSubscription reports the errors in the subscribed file, and queues
+// them for delivery if they changed since the last check or force is set.
+func checkSubscription(s *subscriber, sub *subscription, force bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	req := sub.req
+	if req.Data == nil {
+		data, err := ioutil.ReadFile(req.Filename)
+		if err != nil {
+			log.Printf("subscription: %v", err)
+			return
+		}
+		req.Data = data
+	}
+	var res ReportErrorsReply
+	reportErrors("subscription", &req, &res)
+	if res.Error != nil {
+		log.Printf("subscription: %s: %v", req.Filename, res.Error)
+		return
+	}
+	if res.Canceled || (!force && reflect.DeepEqual(res.Errors, sub.last)) {
+		return
+	}
+	sub.last = res.Errors
+
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	if s.files[req.Filename] != sub {
+		return // unsubscribed or replaced meanwhile
+	}
+	s.deliver(req.Filename, res.Errors)
+}
+
+// deliver queues errs for the next poll of s. subscribers must be locked.
+func (s *subscriber) deliver(filename string, errs []reporterrors.Error) {
+	s.pending[filename] = errs
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
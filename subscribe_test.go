@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gocode/reporterrors"
+)
+
+// TestDiagnosticsPolls runs two polls of one subscriber at once: the change
+// wakes both and is delivered once, and the other poll times out without
+// counting as canceled.
+func TestDiagnosticsPolls(t *testing.T) {
+	s := &subscriber{
+		files:    make(map[string]*subscription),
+		pending:  make(map[string][]reporterrors.Error),
+		lastPoll: time.Now(),
+		changed:  make(chan struct{}),
+	}
+	subscribers.Lock()
+	subscribers.byID["polls"] = s
+	subscribers.Unlock()
+	defer Unsubscribe(&UnsubscribeRequest{Subscriber: "polls"}, &UnsubscribeReply{})
+
+	// The stats are global, so only their change is checked.
+	before := kindStatsOf("diagnostics")
+
+	var wg sync.WaitGroup
+	replies := make([]DiagnosticsReply, 2)
+	for i := range replies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			Diagnostics(&DiagnosticsRequest{Subscriber: "polls", Timeout: time.Second}, &replies[i])
+		}(i)
+	}
+	// Wait for both polls to wait.
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		subscribers.Lock()
+		polls := s.polls
+		subscribers.Unlock()
+		if polls == 2 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("polls did not start")
+		}
+	}
+	subscribers.Lock()
+	s.deliver("a.go", []reporterrors.Error{{Line: 1, Col: 1, Msg: "oops"}})
+	subscribers.Unlock()
+	wg.Wait()
+
+	if n := len(replies[0].Updates) + len(replies[1].Updates); n != 1 {
+		t.Errorf("got %d updates in %+v, want 1", n, replies)
+	}
+	st := kindStatsOf("diagnostics")
+	count, canceled, timedOut := st.Count-before.Count, st.Canceled-before.Canceled, st.TimedOut-before.TimedOut
+	if count != 2 || canceled != 0 || timedOut != 1 {
+		t.Errorf("got %d polls, %d canceled, %d timed out; want 2, 0, 1", count, canceled, timedOut)
+	}
+}
+
+// kindStatsOf returns the stats of the requests of the given kind.
+func kindStatsOf(kind string) RequestStats {
+	for _, st := range requestStats() {
+		if st.Kind == kind {
+			return st
+		}
+	}
+	return RequestStats{Kind: kind}
+}
@@ -11,6 +11,31 @@ type Candidate struct {
 	Class string
 	Name  string
 	Type  string
+
+	// Score ranks how well Name matches the partial identifier
+	// being completed, and whether the candidate has the type
+	// expected at the cursor; higher is better.
+	Score int
+
+	// Matches holds the byte ranges [start, end) of Name that
+	// matched the partial identifier, for highlighting.
+	Matches [][2]int
+
+	// Import is the path of the package that must be imported to
+	// use the candidate, if the file does not import it yet, and
+	// AdditionalEdits holds the edit to the file that imports it.
+	Import          string
+	AdditionalEdits []TextEdit
+
+	// Snippet is the text to insert in the snippet format of LSP
+	// and TextMate, with a placeholder for each parameter of a
+	// function, eg "Fprintf(${1:w}, ${2:format}, ${3:a...})". It
+	// is only set if the Suggester was asked for snippets.
+	Snippet string
+
+	// Replace is the byte range [start, end) of the file that the
+	// candidate replaces.
+	Replace [2]int
 }
 
 func (c Candidate) Suggestion() string {
@@ -25,18 +50,28 @@ func (c Candidate) Suggestion() string {
 }
 
 func (c Candidate) String() string {
+	var s string
 	if c.Class == "func" {
-		return fmt.Sprintf("%s %s%s", c.Class, c.Name, strings.TrimPrefix(c.Type, "func"))
+		s = fmt.Sprintf("%s %s%s", c.Class, c.Name, strings.TrimPrefix(c.Type, "func"))
+	} else {
+		s = fmt.Sprintf("%s %s %s", c.Class, c.Name, c.Type)
 	}
-	return fmt.Sprintf("%s %s %s", c.Class, c.Name, c.Type)
+	if c.Import != "" && c.Class != "package" {
+		// Tell apart the members of packages with the same name.
+		s += fmt.Sprintf(" (import %q)", c.Import)
+	}
+	return s
 }
 
-type candidatesByClassAndName []Candidate
+type candidatesByScore []Candidate
 
-func (s candidatesByClassAndName) Len() int      { return len(s) }
-func (s candidatesByClassAndName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s candidatesByScore) Len() int      { return len(s) }
+func (s candidatesByScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 
-func (s candidatesByClassAndName) Less(i, j int) bool {
+func (s candidatesByScore) Less(i, j int) bool {
+	if s[i].Score != s[j].Score {
+		return s[i].Score > s[j].Score
+	}
 	if s[i].Class != s[j].Class {
 		return s[i].Class < s[j].Class
 	}
@@ -53,6 +88,16 @@ var objectFilters = map[string]objectFilter{
 	"var":     func(obj types.Object) bool { _, ok := obj.(*types.Var); return ok },
 }
 
+// isTypeOrPackage accepts the objects that can start a type expression,
+// such as a type argument.
+func isTypeOrPackage(obj types.Object) bool {
+	switch obj.(type) {
+	case *types.TypeName, *types.PkgName:
+		return true
+	}
+	return false
+}
+
 func classifyObject(obj types.Object) string {
 	switch obj.(type) {
 	case *types.Builtin:
@@ -75,24 +120,26 @@ func classifyObject(obj types.Object) string {
 
 type candidateCollector struct {
 	candidates []Candidate
-	exact      []types.Object
-	badcase    []types.Object
 	localpkg   *types.Package
 	partial    string
+	snippets   bool // compute Candidate.Snippet
 	filter     objectFilter
+	only       objectFilter // if set, other objects are never candidates
+
+	// universeTypes proposes predeclared types even though other
+	// predeclared objects are not, eg for type arguments.
+	universeTypes bool
+
+	// expected is the type of the value expected at the cursor, if
+	// known. Candidates that fit it are ranked first.
+	expected types.Type
+
+	importEdits map[string]TextEdit // import path -> edit importing it
 }
 
 func (b *candidateCollector) getCandidates() []Candidate {
-	objs := b.exact
-	if objs == nil {
-		objs = b.badcase
-	}
-
 	res := b.candidates
-	for _, obj := range objs {
-		res = append(res, b.asCandidate(obj))
-	}
-	sort.Sort(candidatesByClassAndName(res))
+	sort.Sort(candidatesByScore(res))
 	return res
 }
 
@@ -104,6 +151,11 @@ func (b *candidateCollector) asCandidate(obj types.Object) Candidate {
 		typ = obj.Type()
 	case "type":
 		typ = obj.Type().Underlying()
+		if tp, ok := obj.Type().(*types.TypeParam); ok {
+			// Show the constraint rather than its underlying
+			// interface.
+			typ = tp.Constraint()
+		}
 	}
 
 	var typStr string
@@ -120,13 +172,63 @@ func (b *candidateCollector) asCandidate(obj types.Object) Candidate {
 		}
 	}
 
-	return Candidate{
+	c := Candidate{
 		Class: objClass,
 		Name:  obj.Name(),
 		Type:  typStr,
 	}
+	if b.snippets {
+		c.Snippet = b.snippet(obj)
+	}
+	return c
 }
 
+// snippet returns the snippet inserting obj. Calls of functions get a
+// placeholder for each parameter, named like the parameter or else
+// after its type.
+func (b *candidateCollector) snippet(obj types.Object) string {
+	name := escapeSnippet(obj.Name())
+	switch obj := obj.(type) {
+	case *types.Builtin:
+		if strings.HasPrefix(builtinTypes[obj.Name()], "func()") {
+			return name + "()"
+		}
+		return name + "(${1})"
+	case *types.Func:
+		sig, ok := obj.Type().(*types.Signature)
+		if !ok {
+			break
+		}
+		var buf strings.Builder
+		buf.WriteString(name + "(")
+		params := sig.Params()
+		for i := 0; i < params.Len(); i++ {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			p := params.At(i)
+			text := p.Name()
+			if text == "" || text == "_" {
+				text = types.TypeString(p.Type(), b.qualify)
+			}
+			if sig.Variadic() && i == params.Len()-1 {
+				text += "..."
+			}
+			fmt.Fprintf(&buf, "${%d:%s}", i+1, escapeSnippet(text))
+		}
+		buf.WriteString(")")
+		return buf.String()
+	}
+	return name
+}
+
+// escapeSnippet escapes the characters that are special in snippets.
+func escapeSnippet(s string) string {
+	return snippetEscaper.Replace(s)
+}
+
+var snippetEscaper = strings.NewReplacer(`\`, `\\`, `$`, `\$`, `}`, `\}`)
+
 var builtinTypes = map[string]string{
 	// Universe.
 	"append":  "func(slice []Type, elems ..Type) []Type",
@@ -164,7 +266,8 @@ func (b *candidateCollector) appendObject(obj types.Object) {
 
 	if obj.Pkg() != b.localpkg {
 		if obj.Parent() == types.Universe {
-			if !proposeBuiltins {
+			_, isType := obj.(*types.TypeName)
+			if !proposeBuiltins && !(b.universeTypes && isType) {
 				return
 			}
 		} else if !obj.Exported() {
@@ -172,14 +275,28 @@ func (b *candidateCollector) appendObject(obj types.Object) {
 		}
 	}
 
+	if b.only != nil && !b.only(obj) {
+		return
+	}
+
 	// TODO(mdempsky): Reconsider this functionality.
 	if b.filter != nil && !b.filter(obj) {
 		return
 	}
 
-	if b.filter != nil || strings.HasPrefix(obj.Name(), b.partial) {
-		b.exact = append(b.exact, obj)
-	} else if strings.HasPrefix(strings.ToLower(obj.Name()), strings.ToLower(b.partial)) {
-		b.badcase = append(b.badcase, obj)
+	var c Candidate
+	if b.filter != nil {
+		c = b.asCandidate(obj)
+	} else {
+		score, matches, ok := fuzzyMatch(b.partial, obj.Name())
+		if !ok {
+			return
+		}
+		c = b.asCandidate(obj)
+		c.Score, c.Matches = score, matches
+	}
+	if b.fitsExpected(obj) {
+		c.Score += scoreExpectedType
 	}
+	b.candidates = append(b.candidates, c)
 }
@@ -229,6 +229,12 @@ loop:
 			switch prev {
 			case token.PERIOD, token.LBRACK, token.LPAREN:
 				// all ok
+			case token.LBRACE:
+				// Composite literal of an instantiated generic type:
+				//   List[int]{}.Len
+				if ti.token().tok != token.RBRACK {
+					break loop
+				}
 			default:
 				break loop
 			}
@@ -241,6 +247,68 @@ loop:
 	return joinTokens(ti.tokens[ti.pos+1 : orig])
 }
 
+// If the cursor is inside the square brackets of an index expression or
+// instantiation, typeArgOperand returns the expression before the
+// brackets, which the caller can check for being generic. Examples:
+//   List[#]             // returns "List"
+//   maps.Map[string, #] // returns "maps.Map"
+func (ti *tokenIterator) typeArgOperand() string {
+	// Find the innermost unclosed bracket.
+	for ti.token().tok != token.LBRACK {
+		switch ti.token().tok {
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			if !ti.skipToBalancedPair() {
+				return ""
+			}
+		case token.LPAREN, token.LBRACE, token.SEMICOLON:
+			return ""
+		}
+		if !ti.prev() {
+			return ""
+		}
+	}
+	if ti.pos == 0 || ti.tokens[ti.pos-1].tok != token.IDENT {
+		return ""
+	}
+	return ti.extractExpr()
+}
+
+// inStringLit reports whether offset off in the string literal lit is
+// inside the quotes. The literal may be unterminated.
+func inStringLit(lit string, off int) bool {
+	terminated := len(lit) >= 2 && lit[len(lit)-1] == lit[0] && (lit[0] == '`' || lit[len(lit)-2] != '\\')
+	return off > 0 && (off < len(lit) || off == len(lit) && !terminated)
+}
+
+// inImportDecl reports whether the string literal at the current token
+// is the path of an import spec, possibly named, in an import
+// declaration with or without parentheses.
+func (ti *tokenIterator) inImportDecl() bool {
+	if !ti.prev() {
+		return false
+	}
+	if tok := ti.token().tok; tok == token.IDENT || tok == token.PERIOD {
+		if !ti.prev() {
+			return false
+		}
+	}
+	for {
+		switch ti.token().tok {
+		case token.IMPORT:
+			return true
+		case token.LPAREN:
+			return ti.prev() && ti.token().tok == token.IMPORT
+		case token.SEMICOLON, token.STRING, token.IDENT, token.PERIOD:
+			// Other specs of the block.
+			if !ti.prev() {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+}
+
 // Given a slice of token_item, reassembles them into the original literal
 // expression.
 func joinTokens(tokens []tokenItem) string {
@@ -260,6 +328,8 @@ const (
 	unknownContext cursorContext = iota
 	selectContext
 	compositeLiteralContext
+	typeArgContext
+	importPathContext
 )
 
 func deduceCursorContext(file []byte, cursor int) (cursorContext, string, string) {
@@ -268,6 +338,15 @@ func deduceCursorContext(file []byte, cursor int) (cursorContext, string, string
 		return unknownContext, "", ""
 	}
 
+	// See if we are in the path of an import spec.
+	if tok := iter.token(); tok.tok == token.STRING && inStringLit(tok.lit, off) {
+		it := iter
+		if it.inImportDecl() {
+			return importPathContext, "", tok.lit[1:off]
+		}
+		return unknownContext, "", ""
+	}
+
 	// See if we have a partial identifier to work with.
 	var partial string
 	switch tok := iter.token(); tok.tok {
@@ -291,10 +370,21 @@ func deduceCursorContext(file []byte, cursor int) (cursorContext, string, string
 		}
 	}
 
-	switch iter.token().tok {
+	switch tok := iter.token().tok; tok {
 	case token.PERIOD:
 		return selectContext, iter.extractExpr(), partial
-	case token.COMMA, token.LBRACE:
+	case token.COMMA, token.LBRACK:
+		// This can happen for type arguments:
+		// Pair[string, Wor#] // (# - the cursor)
+		it := iter
+		if expr := it.typeArgOperand(); expr != "" {
+			return typeArgContext, expr, partial
+		}
+		if tok == token.LBRACK {
+			break
+		}
+		fallthrough
+	case token.LBRACE:
 		// This can happen for struct fields:
 		// &Struct{Hello: 1, Wor#} // (# - the cursor)
 		// Let's try to find the struct type
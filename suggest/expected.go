@@ -0,0 +1,263 @@
+package suggest
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"github.com/mdempsky/gocode/check"
+)
+
+// scoreExpectedType is added to the score of candidates whose value is
+// assignable to the type expected at the cursor, so that they are
+// listed before all others however well the rest match the input.
+const scoreExpectedType = 1000
+
+// expectedType returns the type of the value expected at pos, as the
+// right-hand side of an assignment, an argument of a call, a returned
+// value, an element of a composite literal, an operand of a comparison
+// or a value sent on a channel. It returns nil if nothing in particular
+// is expected.
+func expectedType(p *check.Package, pos token.Pos) types.Type {
+	info := p.Info
+	path := pathTo(p.Fset, p.File, pos)
+	for i := len(path) - 1; i >= 0; i-- {
+		switch n := path[i].(type) {
+		case *ast.Ident, *ast.BadExpr, *ast.ParenExpr:
+			// The operand being typed.
+			continue
+
+		case *ast.SelectorExpr:
+			if pos > n.X.End() {
+				continue
+			}
+
+		case *ast.AssignStmt:
+			if n.Tok == token.DEFINE || pos <= n.TokPos {
+				break
+			}
+			if j := indexAt(n.Rhs, pos); j < len(n.Lhs) {
+				return usefulType(info.TypeOf(n.Lhs[j]))
+			}
+
+		case *ast.ValueSpec:
+			if n.Type != nil && len(n.Names) > 0 && pos > n.Names[len(n.Names)-1].End() {
+				return usefulType(info.TypeOf(n.Type))
+			}
+
+		case *ast.CallExpr:
+			if pos <= n.Lparen {
+				break
+			}
+			tv := info.Types[n.Fun]
+			sig, ok := tv.Type.(*types.Signature)
+			if !ok || !tv.IsValue() {
+				break
+			}
+			return usefulType(paramType(sig, indexAt(n.Args, pos), n.Ellipsis.IsValid()))
+
+		case *ast.ReturnStmt:
+			sig := enclosingSignature(info, path[:i])
+			if j := indexAt(n.Results, pos); sig != nil && j < sig.Results().Len() {
+				return usefulType(sig.Results().At(j).Type())
+			}
+
+		case *ast.CompositeLit:
+			if pos <= n.Lbrace {
+				break
+			}
+			switch t := underlying(info.TypeOf(n)).(type) {
+			case *types.Struct:
+				if j := indexAt(n.Elts, pos); j < t.NumFields() {
+					return usefulType(t.Field(j).Type())
+				}
+			case *types.Slice:
+				return usefulType(t.Elem())
+			case *types.Array:
+				return usefulType(t.Elem())
+			case *types.Map:
+				return usefulType(t.Key())
+			}
+
+		case *ast.KeyValueExpr:
+			lit, ok := parentOf(path, i).(*ast.CompositeLit)
+			if !ok {
+				break
+			}
+			key := pos <= n.Colon
+			switch t := underlying(info.TypeOf(lit)).(type) {
+			case *types.Struct:
+				if id, ok := n.Key.(*ast.Ident); ok && !key {
+					for j := 0; j < t.NumFields(); j++ {
+						if f := t.Field(j); f.Name() == id.Name {
+							return usefulType(f.Type())
+						}
+					}
+				}
+			case *types.Slice:
+				if !key {
+					return usefulType(t.Elem())
+				}
+			case *types.Array:
+				if !key {
+					return usefulType(t.Elem())
+				}
+			case *types.Map:
+				if key {
+					return usefulType(t.Key())
+				}
+				return usefulType(t.Elem())
+			}
+
+		case *ast.BinaryExpr:
+			switch n.Op {
+			case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+				if pos > n.OpPos {
+					return usefulType(info.TypeOf(n.X))
+				}
+				return usefulType(info.TypeOf(n.Y))
+			}
+
+		case *ast.SendStmt:
+			if pos <= n.Arrow {
+				break
+			}
+			if ch, ok := underlying(info.TypeOf(n.Chan)).(*types.Chan); ok {
+				return usefulType(ch.Elem())
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// pathTo returns the nodes of file that enclose pos, outermost first.
+// Nodes left unclosed by syntax errors extend to the end of the file,
+// and a return statement extends to the end of its line, where its
+// results are being typed.
+func pathTo(fset *token.FileSet, file *ast.File, pos token.Pos) []ast.Node {
+	line := fset.Position(pos).Line
+	var path []ast.Node
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil || pos < n.Pos() {
+			return false
+		}
+		end := n.End()
+		if _, isReturn := n.(*ast.ReturnStmt); isReturn && fset.Position(end).Line == line {
+			end = pos
+		}
+		if n.Pos() <= end && end < pos {
+			return false
+		}
+		path = append(path, n)
+		return true
+	})
+	return path
+}
+
+// parentOf returns the parent of path[i], or nil.
+func parentOf(path []ast.Node, i int) ast.Node {
+	if i == 0 {
+		return nil
+	}
+	return path[i-1]
+}
+
+// indexAt returns the index of the list element at pos, counting the
+// elements that end before it.
+func indexAt(list []ast.Expr, pos token.Pos) int {
+	i := 0
+	for _, x := range list {
+		if x != nil && x.End() < pos {
+			i++
+		}
+	}
+	return i
+}
+
+// paramType returns the type of argument i of a call to sig.
+func paramType(sig *types.Signature, i int, ellipsis bool) types.Type {
+	params := sig.Params()
+	if sig.Variadic() && i >= params.Len()-1 {
+		last := params.At(params.Len() - 1).Type()
+		if ellipsis {
+			return last
+		}
+		if s, ok := last.Underlying().(*types.Slice); ok {
+			return s.Elem()
+		}
+		return nil
+	}
+	if i < params.Len() {
+		return params.At(i).Type()
+	}
+	return nil
+}
+
+// enclosingSignature returns the signature of the innermost function
+// on path.
+func enclosingSignature(info *types.Info, path []ast.Node) *types.Signature {
+	for i := len(path) - 1; i >= 0; i-- {
+		var t types.Type
+		switch n := path[i].(type) {
+		case *ast.FuncLit:
+			t = info.TypeOf(n)
+		case *ast.FuncDecl:
+			if obj := info.Defs[n.Name]; obj != nil {
+				t = obj.Type()
+			}
+		default:
+			continue
+		}
+		sig, _ := t.(*types.Signature)
+		return sig
+	}
+	return nil
+}
+
+// underlying returns the underlying type of t, or nil.
+func underlying(t types.Type) types.Type {
+	if t == nil {
+		return nil
+	}
+	return t.Underlying()
+}
+
+// usefulType returns t, or nil if t says nothing about which
+// candidates fit: it is unknown, untyped or the empty interface.
+func usefulType(t types.Type) types.Type {
+	if t == nil {
+		return nil
+	}
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		if u.Kind() == types.Invalid || u.Info()&types.IsUntyped != 0 {
+			return nil
+		}
+	case *types.Interface:
+		if u.Empty() {
+			return nil
+		}
+	}
+	return t
+}
+
+// fitsExpected reports whether obj is a value assignable to the
+// expected type, or a package declaring the expected named type,
+// through which such values can be reached.
+func (b *candidateCollector) fitsExpected(obj types.Object) bool {
+	if b.expected == nil {
+		return false
+	}
+	switch obj := obj.(type) {
+	case *types.Const, *types.Var:
+		return types.AssignableTo(obj.Type(), b.expected)
+	case *types.Nil:
+		return types.AssignableTo(types.Typ[types.UntypedNil], b.expected)
+	case *types.PkgName:
+		if named, ok := types.Unalias(b.expected).(*types.Named); ok {
+			return named.Obj().Pkg() == obj.Imported()
+		}
+	}
+	return false
+}
@@ -3,6 +3,7 @@ package suggest
 import (
 	"fmt"
 	"io"
+	"strconv"
 )
 
 type Formatter func(w io.Writer, candidates []Candidate, num int)
@@ -70,7 +71,17 @@ func emacsFormat(w io.Writer, candidates []Candidate, num int) {
 }
 
 func csvFormat(w io.Writer, candidates []Candidate, num int) {
+	// Snippets add a fourth field to every line, empty for candidates
+	// without one.
+	snippets := false
 	for _, c := range candidates {
+		snippets = snippets || c.Snippet != ""
+	}
+	for _, c := range candidates {
+		if snippets {
+			fmt.Fprintf(w, "%s,,%s,,%s,,%s\n", c.Class, c.Name, c.Type, c.Snippet)
+			continue
+		}
 		fmt.Fprintf(w, "%s,,%s,,%s\n", c.Class, c.Name, c.Type)
 	}
 }
@@ -86,8 +97,32 @@ func jsonFormat(w io.Writer, candidates []Candidate, num int) {
 		if i != 0 {
 			fmt.Fprintf(w, ", ")
 		}
-		fmt.Fprintf(w, `{"class": "%s", "name": "%s", "type": "%s"}`,
+		fmt.Fprintf(w, `{"class": "%s", "name": "%s", "type": "%s"`,
 			c.Class, c.Name, c.Type)
+		if c.Matches != nil {
+			fmt.Fprintf(w, `, "score": %d, "matches": [`, c.Score)
+			for j, m := range c.Matches {
+				if j != 0 {
+					fmt.Fprintf(w, ", ")
+				}
+				fmt.Fprintf(w, "[%d, %d]", m[0], m[1])
+			}
+			fmt.Fprint(w, "]")
+		}
+		if c.Import != "" {
+			fmt.Fprintf(w, `, "import": %s, "edits": [`, strconv.Quote(c.Import))
+			for j, e := range c.AdditionalEdits {
+				if j != 0 {
+					fmt.Fprintf(w, ", ")
+				}
+				fmt.Fprintf(w, `{"start": %d, "end": %d, "text": %s}`, e.Start, e.End, strconv.Quote(e.NewText))
+			}
+			fmt.Fprint(w, "]")
+		}
+		if c.Snippet != "" {
+			fmt.Fprintf(w, `, "snippet": %s, "replace": [%d, %d]`, strconv.Quote(c.Snippet), c.Replace[0], c.Replace[1])
+		}
+		fmt.Fprint(w, "}")
 	}
 	fmt.Fprint(w, "]]")
 }
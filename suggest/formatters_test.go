@@ -94,3 +94,68 @@ func,,client_status,,func(cli *rpc.Client, Arg0 int) string
 		}
 	}
 }
+
+func TestFormatJSONMatches(t *testing.T) {
+	candidates := []suggest.Candidate{{
+		Class:   "func",
+		Name:    "ReadAll",
+		Type:    "func(r io.Reader) ([]byte, error)",
+		Score:   21,
+		Matches: [][2]int{{0, 1}, {3, 7}},
+	}}
+	want := `[5, [{"class": "func", "name": "ReadAll", "type": "func(r io.Reader) ([]byte, error)", "score": 21, "matches": [[0, 1], [3, 7]]}]]`
+
+	var out bytes.Buffer
+	suggest.Formatters["json"](&out, candidates, len("rdall"))
+	if got := out.String(); got != want {
+		t.Errorf("Format json:\nGot:\n%s\nWant:\n%s\n", got, want)
+	}
+}
+
+func TestFormatSnippets(t *testing.T) {
+	candidates := []suggest.Candidate{{
+		Class:   "func",
+		Name:    "Fprintf",
+		Type:    "func(w io.Writer, format string, a ...any) (n int, err error)",
+		Snippet: "Fprintf(${1:w}, ${2:format}, ${3:a...})",
+		Replace: [2]int{46, 50},
+	}}
+
+	var tests = [...]struct {
+		name string
+		want string
+	}{
+		{"json", `[4, [{"class": "func", "name": "Fprintf", "type": "func(w io.Writer, format string, a ...any) (n int, err error)", "snippet": "Fprintf(${1:w}, ${2:format}, ${3:a...})", "replace": [46, 50]}]]`},
+		{"csv", "func,,Fprintf,,func(w io.Writer, format string, a ...any) (n int, err error),,Fprintf(${1:w}, ${2:format}, ${3:a...})\n"},
+		// Formatters without snippets insert the name as usual.
+		{"godit", "4,,1\nfunc Fprintf(w io.Writer, format string, a ...any) (n int, err error),,Fprintf(\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		suggest.Formatters[test.name](&out, candidates, len("Fpri"))
+		if got := out.String(); got != test.want {
+			t.Errorf("Format %s:\nGot:\n%s\nWant:\n%s\n", test.name, got, test.want)
+		}
+	}
+}
+
+// TestFormatCSVFields checks that csv lines have a fourth field, possibly
+// empty, exactly when there are snippets.
+func TestFormatCSVFields(t *testing.T) {
+	withSnippet := suggest.Candidate{Class: "func", Name: "F", Type: "func()", Snippet: "F()"}
+	noSnippet := suggest.Candidate{Class: "var", Name: "v", Type: "int"}
+	var tests = [...]struct {
+		candidates []suggest.Candidate
+		want       string
+	}{
+		{[]suggest.Candidate{noSnippet}, "var,,v,,int\n"},
+		{[]suggest.Candidate{withSnippet, noSnippet}, "func,,F,,func(),,F()\nvar,,v,,int,,\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		suggest.Formatters["csv"](&out, test.candidates, 0)
+		if got := out.String(); got != test.want {
+			t.Errorf("Format csv:\nGot:\n%s\nWant:\n%s\n", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package suggest
+
+import "unicode"
+
+// Scores awarded to each character of a fuzzy match. A match at the
+// start of the name always outranks one that starts inside it, and
+// runs of consecutive characters outrank scattered ones, so that an
+// exact prefix match gets the best score for its length.
+const (
+	scoreStart       = 10 // the first character of the name
+	scoreWordStart   = 8  // the first character of a camel-case or snake_case word
+	scoreConsecutive = 6  // immediately follows the previous matched character
+	scoreCase        = 1  // the case is the same as typed
+	scoreGap         = -1 // each character skipped between two matches
+	maxGapPenalty    = -3 // cap on the penalty for a single gap
+)
+
+// fuzzyMatch matches pattern against name, ignoring case. Every
+// character of pattern must appear in name in order, and the first one
+// must begin a word of name, so that "rdall" matches "ReadAll" and
+// "ra" matches "ReadAll", but "ead" does not.
+//
+// fuzzyMatch reports the score of the best alignment and the byte
+// ranges [start, end) of name that it matched. An empty pattern
+// matches every name with a score of 0.
+func fuzzyMatch(pattern, name string) (score int, matches [][2]int, ok bool) {
+	if pattern == "" {
+		return 0, nil, true
+	}
+
+	pat := []rune(pattern)
+	var runes []rune
+	var offsets []int
+	for i, r := range name {
+		runes = append(runes, r)
+		offsets = append(offsets, i)
+	}
+	offsets = append(offsets, len(name))
+	if len(pat) > len(runes) {
+		return 0, nil, false
+	}
+
+	// best[i][j] is the best score for pat[:i+1] with pat[i]
+	// matched at runes[j], and from[i][j] is where pat[i-1] was
+	// matched in that alignment. noMatch marks impossible cells.
+	const noMatch = -1 << 30
+	best := make([][]int, len(pat))
+	from := make([][]int, len(pat))
+	for i := range pat {
+		best[i] = make([]int, len(runes))
+		from[i] = make([]int, len(runes))
+		for j := range runes {
+			best[i][j] = noMatch
+			if !equalFold(pat[i], runes[j]) {
+				continue
+			}
+			if i == 0 {
+				if j == 0 {
+					best[i][j] = scoreStart + caseScore(pat[i], runes[j])
+				} else if wordStart(runes, j) {
+					best[i][j] = scoreWordStart + caseScore(pat[i], runes[j])
+				}
+				continue
+			}
+			for k := i - 1; k < j; k++ {
+				if best[i-1][k] == noMatch {
+					continue
+				}
+				s := best[i-1][k] + charScore(runes, k, j) + caseScore(pat[i], runes[j])
+				if s > best[i][j] {
+					best[i][j], from[i][j] = s, k
+				}
+			}
+		}
+	}
+
+	last := len(pat) - 1
+	end := -1
+	for j := range runes {
+		if best[last][j] != noMatch && (end < 0 || best[last][j] > best[last][end]) {
+			end = j
+		}
+	}
+	if end < 0 {
+		return 0, nil, false
+	}
+	score = best[last][end]
+
+	// Walk the alignment backwards, merging adjacent characters
+	// into ranges.
+	pos := make([]int, len(pat))
+	for i, j := last, end; i >= 0; i-- {
+		pos[i] = j
+		j = from[i][j]
+	}
+	for _, j := range pos {
+		if n := len(matches); n > 0 && matches[n-1][1] == offsets[j] {
+			matches[n-1][1] = offsets[j+1]
+			continue
+		}
+		matches = append(matches, [2]int{offsets[j], offsets[j+1]})
+	}
+	return score, matches, true
+}
+
+// charScore scores matching runes[j] after the previous match at
+// runes[k].
+func charScore(runes []rune, k, j int) int {
+	if j == k+1 {
+		return scoreConsecutive
+	}
+	gap := scoreGap * (j - k - 1)
+	if gap < maxGapPenalty {
+		gap = maxGapPenalty
+	}
+	if wordStart(runes, j) {
+		return scoreWordStart + gap
+	}
+	return gap
+}
+
+func caseScore(p, r rune) int {
+	if p == r {
+		return scoreCase
+	}
+	return 0
+}
+
+// wordStart reports whether runes[j] begins a word: it follows an
+// underscore, is an upper-case letter after a lower-case one or a
+// digit, or is a letter or digit after a run of the other kind.
+func wordStart(runes []rune, j int) bool {
+	if j == 0 {
+		return true
+	}
+	prev, r := runes[j-1], runes[j]
+	switch {
+	case r == '_':
+		return false
+	case prev == '_':
+		return true
+	case unicode.IsUpper(r):
+		if !unicode.IsUpper(prev) {
+			return true
+		}
+		// The last capital of an acronym followed by a
+		// lower-case letter, like the R in "HTTPRequest".
+		return j+1 < len(runes) && unicode.IsLower(runes[j+1])
+	case unicode.IsDigit(r) != unicode.IsDigit(prev):
+		return true
+	}
+	return false
+}
+
+func equalFold(a, b rune) bool {
+	return a == b || unicode.ToLower(a) == unicode.ToLower(b)
+}
@@ -0,0 +1,275 @@
+package suggest
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mdempsky/gocode/check"
+	"github.com/mdempsky/gocode/srcimporter"
+)
+
+// A TextEdit replaces the bytes [Start, End) of the edited file with
+// NewText.
+type TextEdit struct {
+	Start, End int
+	NewText    string
+}
+
+// unimportedPackages proposes the packages known to importer that the
+// file does not import yet, unless their name is taken by another
+// import or a package-level declaration.
+func (c *Suggester) unimportedPackages(importer types.Importer, p *check.Package, data []byte, b *candidateCollector) {
+	if b.partial == "" || b.filter != nil {
+		return
+	}
+	fileScope := p.Info.Scopes[p.File]
+	for _, ref := range c.importable(importer, p, token.NoPos) {
+		if _, _, ok := fuzzyMatch(b.partial, ref.Name); !ok {
+			continue
+		}
+		if fileScope != nil {
+			if _, obj := fileScope.LookupParent(ref.Name, token.NoPos); obj != nil {
+				continue
+			}
+		}
+		start := len(b.candidates)
+		b.appendObject(types.NewPkgName(token.NoPos, b.localpkg, ref.Name, types.NewPackage(ref.Path, ref.Name)))
+		for i := start; i < len(b.candidates); i++ {
+			b.candidates[i].Type = ref.Path
+			b.addImport(&b.candidates[i], p, data, ref.Path)
+		}
+	}
+}
+
+// unimportedMembers proposes the members of the packages named name
+// that the file does not import yet. If several packages have that
+// name, the members of all of them are proposed, each with its own
+// import path.
+func (c *Suggester) unimportedMembers(importer types.Importer, p *check.Package, data []byte, name string, b *candidateCollector) {
+	imp, ok := importer.(types.ImporterFrom)
+	if !ok {
+		return
+	}
+	srcDir := filepath.Dir(p.Filename)
+	for _, ref := range c.importable(importer, p, token.NoPos) {
+		if ref.Name != name {
+			continue
+		}
+		pkg, err := imp.ImportFrom(ref.Path, srcDir, 0)
+		if err != nil || pkg == nil {
+			continue
+		}
+		start := len(b.candidates)
+		c.packageCandidates(pkg, b)
+		for i := start; i < len(b.candidates); i++ {
+			b.addImport(&b.candidates[i], p, data, ref.Path)
+		}
+	}
+}
+
+// importPathCandidates proposes the paths of the packages known to
+// importer for the import spec at pos. The path typed so far is
+// completed one element at a time: its last element is matched against
+// the element of each path below the directory typed before it, so
+// that "net/h" proposes "net/http" and "net/http/httptest".
+func (c *Suggester) importPathCandidates(importer types.Importer, p *check.Package, pos token.Pos, b *candidateCollector) {
+	dir, elem := "", b.partial
+	if i := strings.LastIndex(b.partial, "/"); i >= 0 {
+		dir, elem = b.partial[:i+1], b.partial[i+1:]
+	}
+	for _, ref := range c.importable(importer, p, pos) {
+		if !strings.HasPrefix(ref.Path, dir) {
+			continue
+		}
+		first, _, _ := strings.Cut(ref.Path[len(dir):], "/")
+		score, matches, ok := fuzzyMatch(elem, first)
+		if !ok {
+			continue
+		}
+		for i := range matches {
+			matches[i][0] += len(dir)
+			matches[i][1] += len(dir)
+		}
+		c := Candidate{
+			Class:   "package",
+			Name:    ref.Path,
+			Type:    ref.Name,
+			Score:   score,
+			Matches: matches,
+		}
+		if b.snippets {
+			c.Snippet = escapeSnippet(ref.Path)
+		}
+		b.candidates = append(b.candidates, c)
+	}
+}
+
+// importable returns the packages known to importer that the file can
+// import and does not import already, not counting the import spec at
+// pos, if any.
+func (c *Suggester) importable(importer types.Importer, p *check.Package, pos token.Pos) []srcimporter.PackageRef {
+	imported := make(map[string]bool)
+	for _, spec := range p.File.Imports {
+		if spec.Path.Pos() < pos && pos <= spec.Path.End() {
+			continue
+		}
+		if path, err := strconv.Unquote(spec.Path.Value); err == nil {
+			imported[path] = true
+		}
+	}
+	var refs []srcimporter.PackageRef
+	for _, ref := range srcimporter.Packages(importer, filepath.Dir(p.Filename)) {
+		if !imported[ref.Path] && ref.Path != p.Pkg.Path() {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// addImport records that cand needs the package path imported.
+func (b *candidateCollector) addImport(cand *Candidate, p *check.Package, data []byte, path string) {
+	if b.importEdits == nil {
+		b.importEdits = make(map[string]TextEdit)
+	}
+	edit, ok := b.importEdits[path]
+	if !ok {
+		edit = importEdit(p, data, path)
+		b.importEdits[path] = edit
+	}
+	cand.Import = path
+	cand.AdditionalEdits = []TextEdit{edit}
+}
+
+// importEdit returns the edit that adds an import of path to the file
+// with the contents data.
+// Like goimports, it adds standard library packages to the group of
+// standard imports and other packages to the group of other imports,
+// keeping the group sorted, and starts a new group if there is none.
+func importEdit(p *check.Package, data []byte, path string) TextEdit {
+	fset, file := p.Fset, p.File
+	tf := fset.File(file.Pos())
+	offset := func(pos token.Pos) int { return tf.Offset(pos) }
+	quoted := strconv.Quote(path)
+
+	var decls []*ast.GenDecl
+	for _, decl := range file.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			decls = append(decls, d)
+		}
+	}
+	if len(decls) == 0 {
+		end := offset(file.Name.End())
+		return TextEdit{Start: end, End: end, NewText: "\n\nimport " + quoted}
+	}
+
+	// Split the specs of parenthesized declarations into groups
+	// separated by blank lines.
+	var groups [][]*ast.ImportSpec
+	var block *ast.GenDecl // last parenthesized declaration
+	for _, d := range decls {
+		if !d.Lparen.IsValid() {
+			continue
+		}
+		block = d
+		prevLine := -1
+		for _, s := range d.Specs {
+			spec := s.(*ast.ImportSpec)
+			line := tf.Line(spec.Pos())
+			if prevLine < 0 || line > prevLine+1 {
+				groups = append(groups, nil)
+			}
+			groups[len(groups)-1] = append(groups[len(groups)-1], spec)
+			prevLine = tf.Line(spec.End())
+		}
+	}
+	if block == nil {
+		last := decls[len(decls)-1]
+		start, end := offset(last.Pos()), offset(last.End())
+		if len(decls) > 1 || last.Doc != nil {
+			return TextEdit{Start: end, End: end, NewText: "\nimport " + quoted}
+		}
+		// Turn the only import into a block.
+		spec := last.Specs[0].(*ast.ImportSpec)
+		old := string(data[offset(spec.Pos()):end])
+		var specs string
+		switch {
+		case isStandardImport(path) != groupIsStandard([]*ast.ImportSpec{spec}):
+			if isStandardImport(path) {
+				specs = quoted + "\n\n\t" + old
+			} else {
+				specs = old + "\n\n\t" + quoted
+			}
+		case spec.Path.Value > quoted:
+			specs = quoted + "\n\t" + old
+		default:
+			specs = old + "\n\t" + quoted
+		}
+		return TextEdit{Start: start, End: end, NewText: "import (\n\t" + specs + "\n)"}
+	}
+	if len(groups) == 0 {
+		lparen := offset(block.Lparen) + 1
+		return TextEdit{Start: lparen, End: lparen, NewText: "\n\t" + quoted}
+	}
+
+	std := isStandardImport(path)
+	var group []*ast.ImportSpec
+	for _, g := range groups {
+		if groupIsStandard(g) == std {
+			group = g
+			if std {
+				break
+			}
+		}
+	}
+	if group == nil {
+		if std {
+			first := groups[0][0]
+			start := offset(first.Pos())
+			return TextEdit{Start: start, End: start, NewText: quoted + "\n\n" + indentOf(p, data, first)}
+		}
+		last := groups[len(groups)-1]
+		spec := last[len(last)-1]
+		end := offset(spec.End())
+		return TextEdit{Start: end, End: end, NewText: "\n\n" + indentOf(p, data, spec) + quoted}
+	}
+	for _, spec := range group {
+		if spec.Path.Value > quoted {
+			start := offset(spec.Pos())
+			return TextEdit{Start: start, End: start, NewText: quoted + "\n" + indentOf(p, data, spec)}
+		}
+	}
+	spec := group[len(group)-1]
+	end := offset(spec.End())
+	return TextEdit{Start: end, End: end, NewText: "\n" + indentOf(p, data, spec) + quoted}
+}
+
+// indentOf returns the white space before spec on its line.
+func indentOf(p *check.Package, data []byte, spec *ast.ImportSpec) string {
+	tf := p.Fset.File(spec.Pos())
+	start := tf.Offset(tf.LineStart(tf.Line(spec.Pos())))
+	src := data[start:tf.Offset(spec.Pos())]
+	if strings.TrimLeft(string(src), " \t") != "" {
+		return "\t"
+	}
+	return string(src)
+}
+
+// isStandardImport reports whether path names a standard library
+// package, whose first element has no dot.
+func isStandardImport(path string) bool {
+	first, _, _ := strings.Cut(path, "/")
+	return !strings.Contains(first, ".")
+}
+
+func groupIsStandard(group []*ast.ImportSpec) bool {
+	for _, spec := range group {
+		if path, err := strconv.Unquote(spec.Path.Value); err != nil || !isStandardImport(path) {
+			return false
+		}
+	}
+	return true
+}
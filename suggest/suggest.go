@@ -1,41 +1,59 @@
 package suggest
 
 import (
-	"bytes"
 	"go/ast"
-	"go/parser"
+	"go/build"
 	"go/scanner"
 	"go/token"
 	"go/types"
-	"io/ioutil"
 	"log"
-	"path/filepath"
 	"reflect"
-	"strings"
 	"unsafe"
 
+	"github.com/mdempsky/gocode/check"
 	"github.com/mdempsky/gocode/lookdot"
+	"github.com/mdempsky/gocode/pkgfiles"
 )
 
 type Suggester struct {
-	debug bool
+	debug    bool
+	snippets bool
 }
 
-func New(debug bool) *Suggester {
+// New returns a Suggester. If snippets is set, candidates come with the
+// snippets to insert them; see Candidate.Snippet.
+func New(debug, snippets bool) *Suggester {
 	return &Suggester{
-		debug: debug,
+		debug:    debug,
+		snippets: snippets,
 	}
 }
 
 // Suggest returns a list of suggestion candidates and the length of
-// the text that should be replaced, if any.
-func (c *Suggester) Suggest(importer types.Importer, filename string, data []byte, cursor int, filter bool) ([]Candidate, int) {
+// the text that should be replaced, if any. Other files of the package
+// are read from overlay if present there, and chosen by the build
+// constraints of ctxt; see check.Check.
+func (c *Suggester) Suggest(importer types.Importer, filename string, data []byte, cursor int, overlay pkgfiles.Overlay, ctxt *build.Context, filter bool) ([]Candidate, int) {
 	if cursor < 0 {
 		return nil, 0
 	}
+	return c.SuggestPackage(importer, check.Check(importer, filename, data, overlay, ctxt, true), data, cursor, filter)
+}
 
-	fset, pos, pkg := c.analyzePackage(importer, filename, data, cursor)
-	scope := pkg.Scope().Innermost(pos)
+// SuggestPackage is like Suggest, but uses the results of type-checking
+// the package of the file with the contents data. importer must be the
+// importer used for type-checking.
+func (c *Suggester) SuggestPackage(importer types.Importer, p *check.Package, data []byte, cursor int, filter bool) ([]Candidate, int) {
+	if cursor < 0 {
+		return nil, 0
+	}
+	if len(p.ParseErrors) != 0 && c.debug {
+		logParseError("Error parsing input file (outer block)", p.ParseErrors)
+	}
+	fset, pkg := p.Fset, p.Pkg
+	pos := fset.File(p.File.Pos()).Pos(cursor)
+	fixRangeScopes(p.Info)
+	scope := scopeAt(p, pos)
 
 	ctx, expr, partial := deduceCursorContext(data, cursor)
 	if !filter {
@@ -44,7 +62,9 @@ func (c *Suggester) Suggest(importer types.Importer, filename string, data []byt
 	b := candidateCollector{
 		localpkg: pkg,
 		partial:  partial,
+		snippets: c.snippets,
 		filter:   objectFilters[partial],
+		expected: expectedType(p, pos),
 	}
 
 	switch ctx {
@@ -59,13 +79,31 @@ func (c *Suggester) Suggest(importer types.Importer, filename string, data []byt
 			c.packageCandidates(pkgName.Imported(), &b)
 			break
 		}
+		if obj == nil && token.IsIdentifier(expr) {
+			c.unimportedMembers(importer, p, data, expr, &b)
+			break
+		}
 
 		return nil, 0
 
+	case importPathContext:
+		c.importPathCandidates(importer, p, pos, &b)
+
+	case typeArgContext:
+		tv, _ := types.Eval(fset, pkg, pos, expr)
+		if isGeneric(tv) {
+			b.only = isTypeOrPackage
+			b.universeTypes = true
+		}
+		c.scopeCandidates(scope, pos, &b)
+		c.unimportedPackages(importer, p, data, &b)
+
 	case compositeLiteralContext:
 		tv, _ := types.Eval(fset, pkg, pos, expr)
 		if tv.IsType() {
 			if _, isStruct := tv.Type.Underlying().(*types.Struct); isStruct {
+				// Field names are not values.
+				b.expected = nil
 				c.fieldNameCandidates(tv.Type, &b)
 				break
 			}
@@ -74,45 +112,75 @@ func (c *Suggester) Suggest(importer types.Importer, filename string, data []byt
 		fallthrough
 	default:
 		c.scopeCandidates(scope, pos, &b)
+		c.unimportedPackages(importer, p, data, &b)
 	}
 
 	res := b.getCandidates()
 	if len(res) == 0 {
 		return nil, 0
 	}
+	for i := range res {
+		res[i].Replace = [2]int{cursor - len(partial), cursor}
+	}
 	return res, len(partial)
 }
 
-func (c *Suggester) analyzePackage(importer types.Importer, filename string, data []byte, cursor int) (*token.FileSet, token.Pos, *types.Package) {
-	// If we're in trailing white space at the end of a scope,
-	// sometimes go/types doesn't recognize that variables should
-	// still be in scope there.
-	filesemi := bytes.Join([][]byte{data[:cursor], []byte(";"), data[cursor:]}, nil)
-
-	fset := token.NewFileSet()
-	fileAST, err := parser.ParseFile(fset, filename, filesemi, parser.AllErrors)
-	if err != nil && c.debug {
-		logParseError("Error parsing input file (outer block)", err)
+// isGeneric reports whether tv is a generic type or function that has not
+// been instantiated.
+func isGeneric(tv types.TypeAndValue) bool {
+	switch t := types.Unalias(tv.Type).(type) {
+	case *types.Named:
+		return tv.IsType() && t.TypeParams().Len() > t.TypeArgs().Len()
+	case *types.Signature:
+		return tv.IsValue() && t.TypeParams().Len() > 0
 	}
-	pos := fset.File(fileAST.Pos()).Pos(cursor)
+	return false
+}
 
-	var otherASTs []*ast.File
-	for _, otherName := range c.findOtherPackageFiles(filename, fileAST.Name.Name) {
-		ast, err := parser.ParseFile(fset, otherName, nil, 0)
-		if err != nil && c.debug {
-			logParseError("Error parsing other file", err)
+// scopeAt returns the innermost scope containing pos. Unlike
+// Scope.Innermost, it treats positions after the last statement of a
+// case clause, or at the end of the file, as inside the clause or file:
+// that is where the user is typing a new statement.
+func scopeAt(p *check.Package, pos token.Pos) *types.Scope {
+	scope := p.Pkg.Scope().Innermost(pos)
+	ast.Inspect(p.File, func(n ast.Node) bool {
+		if n == nil || pos < n.Pos() || n.End() < pos {
+			return false
+		}
+		body, ok := n.(*ast.BlockStmt)
+		if !ok {
+			return true
+		}
+		for i, stmt := range body.List {
+			var colon token.Pos
+			switch cl := stmt.(type) {
+			case *ast.CaseClause:
+				colon = cl.Colon
+			case *ast.CommClause:
+				colon = cl.Colon
+			default:
+				return true
+			}
+			end := body.Rbrace
+			if i+1 < len(body.List) {
+				end = body.List[i+1].Pos()
+			}
+			if colon < pos && stmt.End() <= pos && pos <= end {
+				if s := p.Info.Scopes[stmt]; s != nil {
+					scope = s
+				}
+			}
 		}
-		otherASTs = append(otherASTs, ast)
+		return true
+	})
+	if scope == nil {
+		scope = p.Info.Scopes[p.File]
 	}
+	return scope
+}
 
-	var cfg types.Config
-	cfg.Importer = importer
-	cfg.Error = func(err error) {}
-	var info types.Info
-	info.Scopes = make(map[ast.Node]*types.Scope)
-	pkg, _ := cfg.Check("", fset, append(otherASTs, fileAST), &info)
-
-	// Workaround golang.org/issue/15686.
+// fixRangeScopes works around golang.org/issue/15686.
+func fixRangeScopes(info *types.Info) {
 	for node, scope := range info.Scopes {
 		switch node := node.(type) {
 		case *ast.RangeStmt:
@@ -121,8 +189,6 @@ func (c *Suggester) analyzePackage(importer types.Importer, filename string, dat
 			}
 		}
 	}
-
-	return fset, pos, pkg
 }
 
 var varScopePosOffset = func() uintptr {
@@ -180,44 +246,3 @@ func logParseError(intro string, err error) {
 		log.Printf("%s: %s", intro, err)
 	}
 }
-
-func (c *Suggester) findOtherPackageFiles(filename, pkgName string) []string {
-	if filename == "" {
-		return nil
-	}
-
-	dir, file := filepath.Split(filename)
-	dents, err := ioutil.ReadDir(dir)
-	if err != nil {
-		panic(err)
-	}
-	isTestFile := strings.HasSuffix(file, "_test.go")
-
-	// TODO(mdempsky): Use go/build.(*Context).MatchFile or
-	// something to properly handle build tags?
-	var out []string
-	for _, dent := range dents {
-		name := dent.Name()
-		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
-			continue
-		}
-		if name == file || !strings.HasSuffix(name, ".go") {
-			continue
-		}
-		if !isTestFile && strings.HasSuffix(name, "_test.go") {
-			continue
-		}
-
-		abspath := filepath.Join(dir, name)
-		if pkgNameFor(abspath) == pkgName {
-			out = append(out, abspath)
-		}
-	}
-
-	return out
-}
-
-func pkgNameFor(filename string) string {
-	file, _ := parser.ParseFile(token.NewFileSet(), filename, nil, parser.PackageClauseOnly)
-	return file.Name.Name
-}
@@ -6,13 +6,15 @@ import (
 	"go/importer"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/mdempsky/gocode/srcimporter"
 	"github.com/mdempsky/gocode/suggest"
 )
 
 func TestRegress(t *testing.T) {
-	s := suggest.New(testing.Verbose())
+	s := suggest.New(testing.Verbose(), false)
 
 	testDirs := flag.Args()
 	if len(testDirs) == 0 {
@@ -55,7 +57,7 @@ func testRegress(t *testing.T, s *suggest.Suggester, testDir string) bool {
 	}
 	data = append(data[:cursor], data[cursor+1:]...)
 
-	candidates, prefixLen := s.Suggest(importer.Default(), filename, data, cursor, true)
+	candidates, prefixLen := s.Suggest(importer.Default(), filename, data, cursor, nil, nil, true)
 
 	var out bytes.Buffer
 	suggest.NiceFormat(&out, candidates, prefixLen)
@@ -68,3 +70,173 @@ func testRegress(t *testing.T, s *suggest.Suggester, testDir string) bool {
 
 	return true
 }
+
+func TestUnimported(t *testing.T) {
+	var tests = [...]struct {
+		src     string
+		imports []string // import paths of the candidates named name
+		name    string
+		want    string // src after applying the edits of the first of them
+	}{{
+		src:     "package p\n\nfunc _() {\n\tstrings.TrimSp@\n}\n",
+		imports: []string{"strings"},
+		name:    "TrimSpace",
+		want:    "package p\n\nimport \"strings\"\n\nfunc _() {\n\tstrings.TrimSp\n}\n",
+	}, {
+		src:     "package p\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\n\t\"example.com/x\"\n)\n\nfunc _() {\n\tstrings.TrimSp@\n}\n",
+		imports: []string{"strings"},
+		name:    "TrimSpace",
+		want:    "package p\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\t\"strings\"\n\n\t\"example.com/x\"\n)\n\nfunc _() {\n\tstrings.TrimSp\n}\n",
+	}, {
+		src:     "package p\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc _() {\n\tstrings.TrimSp@\n}\n",
+		imports: []string{"strings"},
+		name:    "TrimSpace",
+		want:    "package p\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\t\"strings\"\n)\n\nfunc _() {\n\tstrings.TrimSp\n}\n",
+	}, {
+		src:     "package p\n\nimport \"os\"\n\nfunc _() {\n\ttemplate.Must@\n}\n",
+		imports: []string{"html/template", "text/template"},
+		name:    "Must",
+		want:    "package p\n\nimport (\n\t\"html/template\"\n\t\"os\"\n)\n\nfunc _() {\n\ttemplate.Must\n}\n",
+	}, {
+		src:     "package p\n\nimport \"strings\"\n\nfunc _() {\n\tstrco@\n}\n",
+		imports: []string{"strconv"},
+		name:    "strconv",
+		want:    "package p\n\nimport (\n\t\"strconv\"\n\t\"strings\"\n)\n\nfunc _() {\n\tstrco\n}\n",
+	}}
+
+	s := suggest.New(testing.Verbose(), false)
+	filename := filepath.Join(t.TempDir(), "p.go")
+	for _, test := range tests {
+		cursor := strings.IndexByte(test.src, '@')
+		data := []byte(test.src[:cursor] + test.src[cursor+1:])
+		imp := srcimporter.New(nil, filename, nil, nil)
+		candidates, _ := s.Suggest(imp, filename, data, cursor, nil, nil, true)
+
+		var imports []string
+		var first *suggest.Candidate
+		for i, c := range candidates {
+			if c.Name != test.name || c.Import == "" {
+				continue
+			}
+			imports = append(imports, c.Import)
+			if first == nil {
+				first = &candidates[i]
+			}
+		}
+		if strings.Join(imports, " ") != strings.Join(test.imports, " ") {
+			t.Errorf("%q: %s imported from %q, want %q", test.src, test.name, imports, test.imports)
+			continue
+		}
+
+		got := string(data)
+		for i := len(first.AdditionalEdits) - 1; i >= 0; i-- {
+			e := first.AdditionalEdits[i]
+			got = got[:e.Start] + e.NewText + got[e.End:]
+		}
+		if got != test.want {
+			t.Errorf("%q: edits give:\n%s\nwant:\n%s", test.src, got, test.want)
+		}
+	}
+}
+
+func TestImportPaths(t *testing.T) {
+	var tests = [...]struct {
+		src     string
+		want    []string // some of the candidates
+		notWant []string
+	}{{
+		src:  "package p\n\nimport (\n\t\"fmt\"\n\t\"net/h@",
+		want: []string{"net/http", "net/http/httptest"},
+	}, {
+		src:  "package p\n\nimport x \"encoding/j@\"\n",
+		want: []string{"encoding/json"},
+	}, {
+		src:     "package p\n\nimport (\n\t\"strings\"\n\t\"str@\"\n)\n",
+		want:    []string{"strconv"},
+		notWant: []string{"strings"},
+	}}
+
+	s := suggest.New(testing.Verbose(), false)
+	filename := filepath.Join(t.TempDir(), "p.go")
+	for _, test := range tests {
+		cursor := strings.IndexByte(test.src, '@')
+		data := []byte(test.src[:cursor] + test.src[cursor+1:])
+		imp := srcimporter.New(nil, filename, nil, nil)
+		candidates, n := s.Suggest(imp, filename, data, cursor, nil, nil, true)
+
+		typed := test.src[strings.LastIndexByte(test.src[:cursor], '"')+1 : cursor]
+		if n != len(typed) {
+			t.Errorf("%q: replace %d bytes, want %d", test.src, n, len(typed))
+		}
+		got := make(map[string]bool)
+		for _, c := range candidates {
+			got[c.Name] = true
+		}
+		for _, path := range test.want {
+			if !got[path] {
+				t.Errorf("%q: missing %s", test.src, path)
+			}
+		}
+		for _, path := range test.notWant {
+			if got[path] {
+				t.Errorf("%q: unexpected %s", test.src, path)
+			}
+		}
+	}
+}
+
+func TestSnippets(t *testing.T) {
+	var tests = [...]struct {
+		src     string
+		name    string
+		snippet string
+		replace [2]int
+	}{{
+		src:     "package p\n\nimport \"fmt\"\n\nfunc _() {\n\tfmt.Fpri@\n}\n",
+		name:    "Fprintf",
+		snippet: "Fprintf(${1:w}, ${2:format}, ${3:a...})",
+		replace: [2]int{41, 45},
+	}, {
+		src:     "package p\n\nfunc f(int, _ string, m map[string]struct{}) {}\n\nfunc _() {\n\tf@\n}\n",
+		name:    "f",
+		snippet: "f(${1:int}, ${2:string}, ${3:m})",
+		replace: [2]int{72, 73},
+	}, {
+		src:     "package p\n\nfunc g(struct{}) {}\n\nfunc _() {\n\tg@\n}\n",
+		name:    "g",
+		snippet: "g(${1:struct{\\}})",
+		replace: [2]int{44, 45},
+	}, {
+		src:     "package p\n\nvar value int\n\nfunc _() {\n\tval@\n}\n",
+		name:    "value",
+		snippet: "value",
+		replace: [2]int{38, 41},
+	}}
+
+	for _, snippets := range []bool{true, false} {
+		s := suggest.New(testing.Verbose(), snippets)
+		for _, test := range tests {
+			cursor := strings.IndexByte(test.src, '@')
+			data := []byte(test.src[:cursor] + test.src[cursor+1:])
+			candidates, _ := s.Suggest(importer.Default(), filepath.Join(t.TempDir(), "p.go"), data, cursor, nil, nil, true)
+			want := test.snippet
+			if !snippets {
+				// Snippets are only computed on request.
+				want = ""
+			}
+			found := false
+			for _, c := range candidates {
+				if c.Name != test.name {
+					continue
+				}
+				found = true
+				if c.Snippet != want || c.Replace != test.replace {
+					t.Errorf("%q (snippets=%v): got snippet %q replacing %v, want %q replacing %v", test.src, snippets, c.Snippet, c.Replace, want, test.replace)
+				}
+			}
+			if !found {
+				t.Errorf("%q: no candidate %s", test.src, test.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package p
+
+type T struct{ Field int }
+
+// F returns t.
+func F(t T) T { return t }
+
+func _() {
+	var t T
+	t.Fi
+	F(t)
+	undefined()
+}